@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"sorcia/internal"
+	"sorcia/pkg"
+)
+
+// RunHook is called by the git hooks which sorcia installs into every
+// repository, e.g. "sorcia hook pre-receive".
+func RunHook(conf *pkg.BaseStruct) {
+	if len(os.Args) < 3 {
+		fmt.Fprintln(os.Stderr, "Expected a hook name.")
+		os.Exit(1)
+	}
+
+	db := conf.DBConn
+	code := internal.RunHook(db, conf, os.Args[2], os.Args[3:])
+	db.Close()
+
+	os.Exit(code)
+}
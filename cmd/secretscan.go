@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"sorcia/internal"
+	"sorcia/pkg"
+)
+
+// SecretScan scans the history of all repositories for secrets and prints
+// a report. It exits with 1 if something was found.
+func SecretScan(conf *pkg.BaseStruct) {
+	total, err := internal.ScanRepositoryHistory(conf, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Secret scan failed: %v\n", err)
+		os.Exit(2)
+	}
+
+	fmt.Printf("%d possible secret(s) found.\n", total)
+	if total > 0 {
+		os.Exit(1)
+	}
+}
@@ -31,8 +31,23 @@ func RunWeb(conf *pkg.BaseStruct) {
 	models.CreateSSHPubKey(db)
 	models.CreateRepo(db)
 	models.CreateRepoMembers(db)
+	models.CreateDeployKey(db)
+	models.CreateProtectedBranch(db)
+	models.CreatePushPolicy(db)
+	models.CreateLFS(db)
+	models.CreatePushMirror(db)
+	models.CreatePullMirror(db)
+	models.CreateSigningKey(db)
+	models.CreateInvite(db)
+	models.CreatePasswordReset(db)
+
+	internal.InstallAllGitHooks(conf)
 
 	go internal.RunSSH(conf, db)
+	if conf.Server.GitDaemonPort != "" {
+		go internal.RunGitDaemon(conf, db)
+	}
+	go internal.RunMirrorScheduler(db, conf)
 
 	// Mux initiate
 	m := mux.NewRouter()
@@ -40,8 +55,13 @@ func RunWeb(conf *pkg.BaseStruct) {
 
 	http.Handle("/", m)
 
-	allowedOrigins := []string{"*"}
-	allowedMethods := []string{"GET", "POST"}
+	// Cross-origin requests are refused unless origins are configured
+	// explicitly with cors_allowed_origins.
+	var handler http.Handler = m
+	if allowedOrigins := conf.Server.CORSAllowedOrigins; len(allowedOrigins) > 0 {
+		allowedMethods := []string{"GET", "POST"}
+		handler = handlers.CORS(handlers.AllowedOrigins(allowedOrigins), handlers.AllowedMethods(allowedMethods))(m)
+	}
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", conf.Server.HTTPPort), handlers.CORS(handlers.AllowedOrigins(allowedOrigins), handlers.AllowedMethods(allowedMethods))(m)))
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", conf.Server.HTTPPort), handler))
 }
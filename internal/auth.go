@@ -14,6 +14,7 @@ import (
 	"sorcia/pkg"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -55,6 +56,7 @@ type LoginPageResponse struct {
 	ShowLoginMenu      bool
 	HeaderActiveMenu   string
 	SorciaVersion      string
+	CSRFToken          string
 	IsShowSignUp       bool
 	LoginErrMessage    string
 	RegisterErrMessage string
@@ -84,6 +86,7 @@ func GetLogin(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.Base
 			ShowLoginMenu:      false,
 			HeaderActiveMenu:   "",
 			SorciaVersion:      conf.Version,
+			CSRFToken:          csrfToken(w),
 			IsShowSignUp:       !models.CheckIfFirstUserExists(db),
 			LoginErrMessage:    "",
 			RegisterErrMessage: "",
@@ -171,6 +174,7 @@ func invalidLoginCredentials(w http.ResponseWriter, r *http.Request, db *sql.DB,
 		ShowLoginMenu:      false,
 		HeaderActiveMenu:   "",
 		SorciaVersion:      conf.Version,
+		CSRFToken:          csrfToken(w),
 		LoginErrMessage:    "Your username or password is incorrect.",
 		RegisterErrMessage: "",
 		SiteSettings:       GetSiteSettings(db, conf),
@@ -235,6 +239,7 @@ func postRegister(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.
 			ShowLoginMenu:      false,
 			HeaderActiveMenu:   "",
 			SorciaVersion:      conf.Version,
+			CSRFToken:          csrfToken(w),
 			IsShowSignUp:       !models.CheckIfFirstUserExists(db),
 			LoginErrMessage:    "",
 			RegisterErrMessage: "Username is too long (maximum is 39 characters).",
@@ -260,6 +265,7 @@ func postRegister(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.
 			ShowLoginMenu:      false,
 			HeaderActiveMenu:   "",
 			SorciaVersion:      conf.Version,
+			CSRFToken:          csrfToken(w),
 			IsShowSignUp:       !models.CheckIfFirstUserExists(db),
 			LoginErrMessage:    "",
 			RegisterErrMessage: "Username may only contain alphanumeric characters or single hyphens, and cannot begin or end with a hyphen.",
@@ -290,11 +296,261 @@ func postRegister(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-// GetLogout ...
-func GetLogout(w http.ResponseWriter, r *http.Request) {
+// PostLogout ...
+func PostLogout(w http.ResponseWriter, r *http.Request) {
 	// Clear the cookie
 	c := &http.Cookie{Name: "sorcia-token", Value: "", Path: "/", Domain: strings.Split(r.Host, ":")[0], MaxAge: -1}
 	http.SetCookie(w, c)
 
 	http.Redirect(w, r, "/login", http.StatusFound)
 }
+
+// usernameErrMessage returns the reason why the username can't be used, or
+// an empty string if it's valid.
+func usernameErrMessage(db *sql.DB, s string) string {
+	if s == "" {
+		return "Username is required."
+	} else if len(s) > 39 {
+		return "Username is too long (maximum is 39 characters)."
+	} else if strings.HasPrefix(s, "-") || strings.Contains(s, "--") || strings.HasSuffix(s, "-") || !pkg.IsAlnumOrHyphen(s) {
+		return "Username may only contain alphanumeric characters or single hyphens, and cannot begin or end with a hyphen."
+	} else if models.GetUserIDFromUsername(db, s) > 0 {
+		return "Username is already taken."
+	}
+
+	return ""
+}
+
+func setLoginCookie(w http.ResponseWriter, r *http.Request, token string) {
+	now := time.Now()
+	duration := now.Add(365 * 24 * time.Hour).Sub(now)
+	maxAge := int(duration.Seconds())
+	c := &http.Cookie{Name: "sorcia-token", Value: token, Path: "/", Domain: strings.Split(r.Host, ":")[0], MaxAge: maxAge}
+	http.SetCookie(w, c)
+}
+
+// TokenPageResponse struct
+type TokenPageResponse struct {
+	IsLoggedIn       bool
+	ShowLoginMenu    bool
+	HeaderActiveMenu string
+	SorciaVersion    string
+	CSRFToken        string
+	IsTokenValid     bool
+	Token            string
+	Username         string
+	ErrMessage       string
+	SiteSettings     SiteSettings
+}
+
+func writeTokenPage(w http.ResponseWriter, db *sql.DB, conf *pkg.BaseStruct, mainPage string, data TokenPageResponse) {
+	layoutPage := filepath.Join(conf.Paths.TemplatePath, "layout.html")
+	headerPage := filepath.Join(conf.Paths.TemplatePath, "header.html")
+	tokenPage := filepath.Join(conf.Paths.TemplatePath, mainPage)
+	footerPage := filepath.Join(conf.Paths.TemplatePath, "footer.html")
+
+	tmpl, err := template.ParseFiles(layoutPage, headerPage, tokenPage, footerPage)
+	pkg.CheckError("Error on template parse", err)
+
+	data.ShowLoginMenu = true
+	data.SorciaVersion = conf.Version
+	data.CSRFToken = csrfToken(w)
+	data.SiteSettings = GetSiteSettings(db, conf)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if data.IsTokenValid {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+	}
+
+	tmpl.ExecuteTemplate(w, "layout", data)
+}
+
+// GetInviteSignUp ...
+func GetInviteSignUp(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct) {
+	token := mux.Vars(r)["token"]
+	invite := models.GetInviteFromToken(db, token, time.Now().Unix())
+
+	data := TokenPageResponse{
+		IsTokenValid: invite.ID > 0,
+		Token:        token,
+	}
+
+	writeTokenPage(w, db, conf, "invite.html", data)
+}
+
+// InviteSignUpRequest struct
+type InviteSignUpRequest struct {
+	Username string `schema:"username"`
+	Password string `schema:"password"`
+}
+
+// PostInviteSignUp ...
+func PostInviteSignUp(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct, decoder *schema.Decoder) {
+	token := mux.Vars(r)["token"]
+	invite := models.GetInviteFromToken(db, token, time.Now().Unix())
+
+	data := TokenPageResponse{
+		IsTokenValid: invite.ID > 0,
+		Token:        token,
+	}
+
+	if !data.IsTokenValid {
+		writeTokenPage(w, db, conf, "invite.html", data)
+		return
+	}
+
+	// NOTE: Invoke ParseForm or ParseMultipartForm before reading form values
+	if err := r.ParseForm(); err != nil {
+		writeHdr(w, http.StatusBadRequest, fmt.Sprintf("ParseForm() err: %v", err))
+		return
+	}
+
+	var inviteSignUpRequest = &InviteSignUpRequest{}
+	err := decoder.Decode(inviteSignUpRequest, r.PostForm)
+	pkg.CheckError("Error on post invite sign up decoder", err)
+
+	data.Username = inviteSignUpRequest.Username
+
+	if errMessage := usernameErrMessage(db, inviteSignUpRequest.Username); errMessage != "" {
+		data.ErrMessage = errMessage
+		writeTokenPage(w, db, conf, "invite.html", data)
+		return
+	}
+
+	if inviteSignUpRequest.Password == "" {
+		data.ErrMessage = "Password can't be empty."
+		writeTokenPage(w, db, conf, "invite.html", data)
+		return
+	}
+
+	// Generate password hash using bcrypt
+	passwordHash, err := HashPassword(inviteSignUpRequest.Password)
+	pkg.CheckError("Error on post invite sign up hash password", err)
+
+	// Generate JWT token using the hash password above
+	jwtToken, err := GenerateJWTToken(passwordHash)
+	pkg.CheckError("Error on post invite sign up generate jwt token", err)
+
+	canCreateRepo := 0
+	if invite.CanCreateRepo || invite.IsAdmin {
+		canCreateRepo = 1
+	}
+
+	isAdmin := 0
+	if invite.IsAdmin {
+		isAdmin = 1
+	}
+
+	cas := models.CreateAccountStruct{
+		Username:      inviteSignUpRequest.Username,
+		PasswordHash:  passwordHash,
+		Token:         jwtToken,
+		CanCreateRepo: canCreateRepo,
+		IsAdmin:       isAdmin,
+	}
+
+	used, err := models.InsertAccountFromInvite(db, invite.ID, cas)
+	if !used {
+		pkg.CheckError("Error on post invite sign up mark invite used", err)
+		data.IsTokenValid = false
+		writeTokenPage(w, db, conf, "invite.html", data)
+		return
+	}
+	if err != nil {
+		// Someone else took the username since it was checked.
+		pkg.CheckError("Error on post invite sign up insert account", err)
+		data.ErrMessage = "Username is already taken."
+		writeTokenPage(w, db, conf, "invite.html", data)
+		return
+	}
+
+	setLoginCookie(w, r, jwtToken)
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// GetResetPassword ...
+func GetResetPassword(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct) {
+	token := mux.Vars(r)["token"]
+	pr := models.GetPasswordResetFromToken(db, token, time.Now().Unix())
+
+	data := TokenPageResponse{
+		IsTokenValid: pr.ID > 0,
+		Token:        token,
+		Username:     pr.Username,
+	}
+
+	writeTokenPage(w, db, conf, "reset-password.html", data)
+}
+
+// ResetPasswordRequest struct
+type ResetPasswordRequest struct {
+	Password string `schema:"password"`
+}
+
+// PostResetPassword ...
+func PostResetPassword(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct, decoder *schema.Decoder) {
+	token := mux.Vars(r)["token"]
+	pr := models.GetPasswordResetFromToken(db, token, time.Now().Unix())
+
+	data := TokenPageResponse{
+		IsTokenValid: pr.ID > 0,
+		Token:        token,
+		Username:     pr.Username,
+	}
+
+	if !data.IsTokenValid {
+		writeTokenPage(w, db, conf, "reset-password.html", data)
+		return
+	}
+
+	// NOTE: Invoke ParseForm or ParseMultipartForm before reading form values
+	if err := r.ParseForm(); err != nil {
+		writeHdr(w, http.StatusBadRequest, fmt.Sprintf("ParseForm() err: %v", err))
+		return
+	}
+
+	var resetPasswordRequest = &ResetPasswordRequest{}
+	err := decoder.Decode(resetPasswordRequest, r.PostForm)
+	pkg.CheckError("Error on post reset password decoder", err)
+
+	if resetPasswordRequest.Password == "" {
+		data.ErrMessage = "Password can't be empty."
+		writeTokenPage(w, db, conf, "reset-password.html", data)
+		return
+	}
+
+	// Generate password hash using bcrypt
+	passwordHash, err := HashPassword(resetPasswordRequest.Password)
+	pkg.CheckError("Error on post reset password hash password", err)
+
+	// Generate JWT token using the hash password above. This also logs out
+	// every existing session of the user.
+	jwtToken, err := GenerateJWTToken(passwordHash)
+	pkg.CheckError("Error on post reset password generate jwt token", err)
+
+	resetPass := models.ResetUserPasswordbyUsernameStruct{
+		PasswordHash: passwordHash,
+		JwtToken:     jwtToken,
+		Username:     pr.Username,
+	}
+	used, err := models.ResetPasswordFromReset(db, pr.ID, resetPass)
+	pkg.CheckError("Error on post reset password", err)
+	if !used || err != nil {
+		data.IsTokenValid = false
+		writeTokenPage(w, db, conf, "reset-password.html", data)
+		return
+	}
+
+	setLoginCookie(w, r, jwtToken)
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// csrfToken returns the token which every POST form has to submit in its
+// csrf_token field. It's set by middleware.CSRF.
+func csrfToken(w http.ResponseWriter) string {
+	return w.Header().Get("sorcia-csrf-token")
+}
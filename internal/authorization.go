@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"html/template"
+	"net/http"
+	"path/filepath"
+
+	"sorcia/models"
+	"sorcia/pkg"
+
+	"github.com/gorilla/mux"
+)
+
+// Actions on a repository which can be authorized.
+const (
+	RepoRead  = "read"
+	RepoWrite = "write"
+	RepoAdmin = "admin"
+)
+
+// RepoContext holds the repository a request is about and what the
+// requesting user is allowed to do with it.
+type RepoContext struct {
+	RepoID      int
+	Reponame    string
+	Description string
+	IsPrivate   bool
+	OwnerID     int
+	UserID      int
+	IsOwner     bool
+	Permission  string
+}
+
+// Can reports whether the user of the context may perform action. A nil
+// context can't do anything.
+func (rc *RepoContext) Can(action string) bool {
+	if rc == nil {
+		return false
+	}
+
+	return authorize(rc.IsPrivate, rc.IsOwner, rc.Permission, action)
+}
+
+// authorize is the single place which decides repository access. The owner
+// can do everything, members get what their permission says and everyone
+// else may only read public repositories.
+func authorize(isPrivate, isOwner bool, permission, action string) bool {
+	if isOwner {
+		return true
+	}
+
+	switch action {
+	case RepoRead:
+		return !isPrivate || permission == "read" || permission == "read/write"
+	case RepoWrite:
+		return permission == "read/write"
+	}
+
+	return false
+}
+
+// LoadRepoContext resolves what the user can do with the repository. userID
+// is 0 for anonymous users. It returns nil if the repository doesn't exist.
+func LoadRepoContext(db *sql.DB, userID int, reponame string) *RepoContext {
+	repo := models.GetRepoFromReponame(db, reponame)
+	if repo.ID == 0 {
+		return nil
+	}
+
+	rc := &RepoContext{
+		RepoID:      repo.ID,
+		Reponame:    repo.Name,
+		Description: repo.Description,
+		IsPrivate:   repo.IsPrivate,
+		OwnerID:     repo.OwnerID,
+		UserID:      userID,
+	}
+
+	if userID > 0 {
+		if repo.OwnerID == userID {
+			rc.IsOwner = true
+			rc.Permission = "read/write"
+		} else {
+			rc.Permission = models.GetRepoMemberPermissionFromUserIDAndRepoID(db, userID, repo.ID)
+		}
+	}
+
+	return rc
+}
+
+// AuthorizeRepo reports whether the user may perform action on the
+// repository. It's false for repositories which don't exist.
+func AuthorizeRepo(db *sql.DB, userID int, reponame, action string) bool {
+	rc := LoadRepoContext(db, userID, reponame)
+	if rc == nil {
+		return false
+	}
+
+	return rc.Can(action)
+}
+
+type repoContextKey struct{}
+
+// GetRepoContext returns the repository context loaded by RepoRequest.
+func GetRepoContext(r *http.Request) *RepoContext {
+	rc, _ := r.Context().Value(repoContextKey{}).(*RepoContext)
+	return rc
+}
+
+// RepoRequest loads the context of the {reponame} repository of the route
+// for the logged in user and makes sure they can read it. If they can't,
+// the response is written here and false is returned.
+func RepoRequest(w http.ResponseWriter, r *http.Request, db *sql.DB) (*http.Request, bool) {
+	reponame := mux.Vars(r)["reponame"]
+
+	var userID int
+	if checkUserLoggedIn(w) {
+		token := w.Header().Get("sorcia-cookie-token")
+		userID = models.GetUserIDFromToken(db, token)
+	}
+
+	rc := LoadRepoContext(db, userID, reponame)
+	if rc == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return r, false
+	}
+
+	if !rc.Can(RepoRead) {
+		if userID == 0 {
+			http.Redirect(w, r, "/login", http.StatusFound)
+		} else {
+			noRepoAccess(w)
+		}
+		return r, false
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), repoContextKey{}, rc)), true
+}
+
+// IsAdminRequest reports whether the request comes from a logged in admin.
+func IsAdminRequest(w http.ResponseWriter, db *sql.DB) bool {
+	if !checkUserLoggedIn(w) {
+		return false
+	}
+
+	token := w.Header().Get("sorcia-cookie-token")
+	userID := models.GetUserIDFromToken(db, token)
+
+	return models.CheckifUserIsAnAdmin(db, userID)
+}
+
+// ErrorPageResponse struct
+type ErrorPageResponse struct {
+	IsLoggedIn       bool
+	ShowLoginMenu    bool
+	HeaderActiveMenu string
+	SorciaVersion    string
+	CSRFToken        string
+	ErrMessage       string
+	SiteSettings     SiteSettings
+}
+
+// Forbidden writes the 403 page.
+func Forbidden(w http.ResponseWriter, db *sql.DB, conf *pkg.BaseStruct, message string) {
+	layoutPage := filepath.Join(conf.Paths.TemplatePath, "layout.html")
+	headerPage := filepath.Join(conf.Paths.TemplatePath, "header.html")
+	forbiddenPage := filepath.Join(conf.Paths.TemplatePath, "forbidden.html")
+	footerPage := filepath.Join(conf.Paths.TemplatePath, "footer.html")
+
+	tmpl, err := template.ParseFiles(layoutPage, headerPage, forbiddenPage, footerPage)
+	pkg.CheckError("Error on template parse", err)
+
+	data := ErrorPageResponse{
+		IsLoggedIn:       checkUserLoggedIn(w),
+		ShowLoginMenu:    true,
+		HeaderActiveMenu: "",
+		SorciaVersion:    conf.Version,
+		CSRFToken:        csrfToken(w),
+		ErrMessage:       message,
+		SiteSettings:     GetSiteSettings(db, conf),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+
+	tmpl.ExecuteTemplate(w, "layout", data)
+}
@@ -0,0 +1,281 @@
+package internal
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sorcia/models"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestDB returns an empty database with the tables of sorcia.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "sorcia-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "sorcia.db?_foreign_keys=on"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+
+	models.CreateAccount(db)
+	models.CreateSSHPubKey(db)
+	models.CreateRepo(db)
+	models.CreateRepoMembers(db)
+	models.CreateDeployKey(db)
+
+	return db
+}
+
+// insertTestUser creates an account whose token is its username.
+func insertTestUser(t *testing.T, db *sql.DB, username string, isAdmin bool) int {
+	t.Helper()
+
+	cas := models.CreateAccountStruct{
+		Username:     username,
+		PasswordHash: "x",
+		Token:        username,
+	}
+	if isAdmin {
+		cas.IsAdmin = 1
+		cas.CanCreateRepo = 1
+	}
+	models.InsertAccount(db, cas)
+
+	return models.GetUserIDFromUsername(db, username)
+}
+
+func insertTestRepo(t *testing.T, db *sql.DB, reponame string, ownerID int, isPrivate bool) int {
+	t.Helper()
+
+	crs := models.CreateRepoStruct{
+		Name:   reponame,
+		UserID: ownerID,
+	}
+	if isPrivate {
+		crs.IsPrivate = 1
+	}
+	models.InsertRepo(db, crs)
+
+	return models.GetRepoIDFromReponame(db, reponame)
+}
+
+// authorizationFixture has a public and a private repository of owner, with
+// a read/write and a read member on both.
+type authorizationFixture struct {
+	db                                     *sql.DB
+	owner, writer, reader, admin, stranger int
+	pubID, privID                          int
+}
+
+func newAuthorizationFixture(t *testing.T) authorizationFixture {
+	db := newTestDB(t)
+
+	f := authorizationFixture{db: db}
+	f.owner = insertTestUser(t, db, "owner", false)
+	f.writer = insertTestUser(t, db, "writer", false)
+	f.reader = insertTestUser(t, db, "reader", false)
+	f.admin = insertTestUser(t, db, "admin", true)
+	f.stranger = insertTestUser(t, db, "stranger", false)
+
+	f.pubID = insertTestRepo(t, db, "pub", f.owner, false)
+	f.privID = insertTestRepo(t, db, "priv", f.owner, true)
+
+	for _, repoID := range []int{f.pubID, f.privID} {
+		models.InsertRepoMember(db, models.CreateRepoMember{UserID: f.writer, RepoID: repoID, Permission: "read/write"})
+		models.InsertRepoMember(db, models.CreateRepoMember{UserID: f.reader, RepoID: repoID, Permission: "read"})
+	}
+
+	return f
+}
+
+func TestAuthorizeRepo(t *testing.T) {
+	f := newAuthorizationFixture(t)
+
+	tests := []struct {
+		name     string
+		userID   int
+		reponame string
+		action   string
+		want     bool
+	}{
+		{"owner reads private", f.owner, "priv", RepoRead, true},
+		{"owner writes private", f.owner, "priv", RepoWrite, true},
+		{"owner administers private", f.owner, "priv", RepoAdmin, true},
+
+		{"read/write member reads", f.writer, "priv", RepoRead, true},
+		{"read/write member writes", f.writer, "priv", RepoWrite, true},
+		{"read/write member can't administer", f.writer, "priv", RepoAdmin, false},
+
+		{"read member reads", f.reader, "priv", RepoRead, true},
+		{"read member can't write", f.reader, "priv", RepoWrite, false},
+		{"read member can't administer", f.reader, "priv", RepoAdmin, false},
+
+		{"anonymous reads public", 0, "pub", RepoRead, true},
+		{"anonymous can't write public", 0, "pub", RepoWrite, false},
+		{"anonymous can't read private", 0, "priv", RepoRead, false},
+
+		// Being a site admin doesn't give access to repositories.
+		{"admin reads public", f.admin, "pub", RepoRead, true},
+		{"admin can't write public", f.admin, "pub", RepoWrite, false},
+		{"admin can't read private", f.admin, "priv", RepoRead, false},
+		{"admin can't administer public", f.admin, "pub", RepoAdmin, false},
+
+		{"stranger reads public", f.stranger, "pub", RepoRead, true},
+		{"stranger can't read private", f.stranger, "priv", RepoRead, false},
+
+		{"owner can't read missing repo", f.owner, "missing", RepoRead, false},
+		{"unknown action for member", f.writer, "priv", "delete", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AuthorizeRepo(f.db, tt.userID, tt.reponame, tt.action); got != tt.want {
+				t.Errorf("AuthorizeRepo(%d, %q, %q) = %v, want %v", tt.userID, tt.reponame, tt.action, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizeDeployKey(t *testing.T) {
+	f := newAuthorizationFixture(t)
+
+	readKey := models.DeployKey{ID: 1, RepoID: f.privID, Reponame: "priv"}
+	writeKey := models.DeployKey{ID: 2, RepoID: f.privID, Reponame: "priv", ReadWrite: true}
+
+	tests := []struct {
+		name     string
+		key      models.DeployKey
+		reponame string
+		action   string
+		want     bool
+	}{
+		{"read key reads", readKey, "priv", RepoRead, true},
+		{"read key can't write", readKey, "priv", RepoWrite, false},
+		{"read key can't administer", readKey, "priv", RepoAdmin, false},
+		{"read key can't read other repo", readKey, "pub", RepoRead, false},
+
+		{"write key reads", writeKey, "priv", RepoRead, true},
+		{"write key writes", writeKey, "priv", RepoWrite, true},
+		{"write key can't administer", writeKey, "priv", RepoAdmin, false},
+		{"write key can't write other repo", writeKey, "pub", RepoWrite, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := tt.key
+			pusher, ok := authorizeSSH(f.db, sshIdentity{DeployKey: &key}, tt.reponame, tt.action)
+			if ok != tt.want {
+				t.Fatalf("authorizeSSH(deploy key %d, %q, %q) = %v, want %v", key.ID, tt.reponame, tt.action, ok, tt.want)
+			}
+			if ok && (pusher.DeployKeyID != key.ID || pusher.UserID != 0) {
+				t.Errorf("pusher = %+v, want deploy key %d", pusher, key.ID)
+			}
+		})
+	}
+}
+
+func TestLoadRepoContext(t *testing.T) {
+	f := newAuthorizationFixture(t)
+
+	tests := []struct {
+		name       string
+		userID     int
+		isOwner    bool
+		permission string
+	}{
+		{"owner", f.owner, true, "read/write"},
+		{"read/write member", f.writer, false, "read/write"},
+		{"read member", f.reader, false, "read"},
+		{"admin", f.admin, false, ""},
+		{"anonymous", 0, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := LoadRepoContext(f.db, tt.userID, "priv")
+			if rc == nil {
+				t.Fatal("LoadRepoContext returned nil for an existing repository")
+			}
+			if rc.RepoID != f.privID || rc.OwnerID != f.owner || !rc.IsPrivate {
+				t.Errorf("repository = %d owned by %d private %v, want %d owned by %d private", rc.RepoID, rc.OwnerID, rc.IsPrivate, f.privID, f.owner)
+			}
+			if rc.IsOwner != tt.isOwner || rc.Permission != tt.permission {
+				t.Errorf("IsOwner = %v, Permission = %q, want %v, %q", rc.IsOwner, rc.Permission, tt.isOwner, tt.permission)
+			}
+		})
+	}
+
+	if rc := LoadRepoContext(f.db, f.owner, "missing"); rc != nil {
+		t.Errorf("LoadRepoContext of a missing repository = %+v, want nil", rc)
+	}
+
+	var rc *RepoContext
+	if rc.Can(RepoRead) {
+		t.Error("nil context can read")
+	}
+}
+
+func TestRepoRequest(t *testing.T) {
+	f := newAuthorizationFixture(t)
+
+	tests := []struct {
+		name     string
+		username string
+		reponame string
+		status   int
+		ok       bool
+	}{
+		{"anonymous on public", "", "pub", http.StatusOK, true},
+		{"anonymous on private", "", "priv", http.StatusFound, false},
+		{"member on private", "reader", "priv", http.StatusOK, true},
+		{"owner on private", "owner", "priv", http.StatusOK, true},
+		{"admin on private", "admin", "priv", http.StatusBadRequest, false},
+		{"stranger on private", "stranger", "priv", http.StatusBadRequest, false},
+		{"missing repository", "owner", "missing", http.StatusNotFound, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			// Set by the user middleware for logged in users.
+			if tt.username != "" {
+				w.Header().Set("user-present", "true")
+				w.Header().Set("sorcia-cookie-token", tt.username)
+			}
+
+			r := httptest.NewRequest("GET", "/r/"+tt.reponame, nil)
+			r = mux.SetURLVars(r, map[string]string{"reponame": tt.reponame})
+
+			r, ok := RepoRequest(w, r, f.db)
+			if ok != tt.ok || w.Code != tt.status {
+				t.Fatalf("RepoRequest = %v with status %d, want %v with %d", ok, w.Code, tt.ok, tt.status)
+			}
+
+			if tt.status == http.StatusFound && w.Header().Get("Location") != "/login" {
+				t.Errorf("redirected to %q, want /login", w.Header().Get("Location"))
+			}
+
+			if ok {
+				rc := GetRepoContext(r)
+				if rc == nil || rc.Reponame != tt.reponame {
+					t.Errorf("repository context = %+v, want %q", rc, tt.reponame)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"sorcia/models"
+	"sorcia/pkg"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+)
+
+// PostDeployKeyRequest struct
+type PostDeployKeyRequest struct {
+	Title     string `schema:"title"`
+	AuthKey   string `schema:"key"`
+	ReadWrite string `schema:"read_write"`
+}
+
+// PostDeployKey adds a deploy key to the repository. Deploy keys can only
+// be managed by the owner of the repository.
+func PostDeployKey(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct, decoder *schema.Decoder) {
+	reponame := mux.Vars(r)["reponame"]
+
+	rc := GetRepoContext(r)
+	if !rc.Can(RepoAdmin) {
+		noRepoAccess(w)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeHdr(w, http.StatusBadRequest, "ParseForm() err: "+err.Error())
+		return
+	}
+
+	var postDeployKeyRequest = &PostDeployKeyRequest{}
+	err := decoder.Decode(postDeployKeyRequest, r.PostForm)
+	pkg.CheckError("Error on post deploy key decoder", err)
+
+	title := strings.TrimSpace(postDeployKeyRequest.Title)
+
+	if title == "" {
+		writeRepoSettings(w, r, db, conf, repoSettingsErrors{DeployKey: "Title of the deploy key is required."})
+		return
+	}
+
+	key, err := pkg.ParseSSHKey(postDeployKeyRequest.AuthKey, conf.SSH.MinRSAKeySize)
+	if err != nil {
+		writeRepoSettings(w, r, db, conf, repoSettingsErrors{DeployKey: err.Error()})
+		return
+	}
+
+	if models.CheckSSHFingerprintExists(db, key.Fingerprint) {
+		writeRepoSettings(w, r, db, conf, repoSettingsErrors{DeployKey: "This key is already in use, either as a deploy key or as the key of a user."})
+		return
+	}
+
+	idk := models.InsertDeployKeyStruct{
+		RepoID:      rc.RepoID,
+		Title:       title,
+		AuthKey:     key.AuthorizedKey,
+		Fingerprint: key.Fingerprint,
+		ReadWrite:   postDeployKeyRequest.ReadWrite != "",
+	}
+	models.InsertDeployKey(db, idk)
+
+	http.Redirect(w, r, "/r/"+reponame+"/settings", http.StatusFound)
+}
+
+// DeleteDeployKey ...
+func DeleteDeployKey(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	vars := mux.Vars(r)
+	reponame := vars["reponame"]
+
+	if rc := GetRepoContext(r); rc.Can(RepoAdmin) {
+		keyID, err := strconv.Atoi(vars["keyID"])
+		if err == nil {
+			models.DeleteDeployKeyByID(db, keyID, rc.RepoID)
+		}
+	}
+
+	http.Redirect(w, r, "/r/"+reponame+"/settings", http.StatusFound)
+}
+
+// authorizeDeployKey reports whether a deploy key may perform action on the
+// repository. Deploy keys only ever grant access to their own repository.
+func authorizeDeployKey(dk models.DeployKey, reponame, action string) bool {
+	if dk.Reponame != reponame {
+		return false
+	}
+
+	switch action {
+	case RepoRead:
+		return true
+	case RepoWrite:
+		return dk.ReadWrite
+	}
+
+	return false
+}
@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"sorcia/pkg"
+)
+
+// gitDaemonRequestTimeout is how long a client may take to send its
+// request after connecting.
+const gitDaemonRequestTimeout = 30 * time.Second
+
+// errGitDaemonNoRepo is shown for repositories which don't exist and for
+// private ones alike.
+var errGitDaemonNoRepo = errors.New("repository not found, git:// only serves public repositories")
+
+// RunGitDaemon serves anonymous clones of public repositories over the
+// git:// protocol. It never runs receive-pack.
+func RunGitDaemon(conf *pkg.BaseStruct, db *sql.DB) {
+	log.Printf("Starting git daemon on port %s...", conf.Server.GitDaemonPort)
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%s", conf.Server.GitDaemonPort))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("git daemon: accept: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		go handleGitDaemonConn(conn, db, conf)
+	}
+}
+
+// gitDaemonRequest is the first packet of a connection, e.g.
+// "git-upload-pack /project.git\0host=example.com\0\0version=2\0".
+type gitDaemonRequest struct {
+	service string
+	path    string
+	// gitProtocol are the extra parameters, in the format of GIT_PROTOCOL.
+	gitProtocol string
+}
+
+func readGitDaemonRequest(r *bufio.Reader) (gitDaemonRequest, error) {
+	var req gitDaemonRequest
+
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return req, err
+	}
+
+	n, err := strconv.ParseUint(string(size[:]), 16, 16)
+	if err != nil || n <= 4 {
+		return req, errors.New("invalid request")
+	}
+
+	packet := make([]byte, n-4)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return req, err
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(packet), "\n"), "\x00")
+
+	command := strings.SplitN(fields[0], " ", 2)
+	if len(command) != 2 {
+		return req, errors.New("invalid request")
+	}
+	req.service = command[0]
+	req.path = command[1]
+
+	// The extra parameters follow an empty field after the optional host.
+	rest := fields[1:]
+	if len(rest) > 0 && strings.HasPrefix(rest[0], "host=") {
+		rest = rest[1:]
+	}
+
+	var params []string
+	if len(rest) > 0 && rest[0] == "" {
+		for _, param := range rest[1:] {
+			if param != "" {
+				params = append(params, param)
+			}
+		}
+	}
+	req.gitProtocol = strings.Join(params, ":")
+
+	return req, nil
+}
+
+// gitDaemonReject sends an error, which git shows as "remote error".
+func gitDaemonReject(conn net.Conn, message string) {
+	conn.Write(packetWrite("ERR " + message + "\n"))
+}
+
+func handleGitDaemonConn(conn net.Conn, db *sql.DB, conf *pkg.BaseStruct) {
+	defer conn.Close()
+
+	ip := addrIP(conn.RemoteAddr())
+	input := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(gitDaemonRequestTimeout))
+	req, err := readGitDaemonRequest(input)
+	if err != nil {
+		log.Printf("git daemon: bad request from %s: %v", ip, err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if req.service != "git-upload-pack" {
+		log.Printf("git daemon: %s refused for %s", req.service, ip)
+		gitDaemonReject(conn, "git:// is read-only, push over SSH or HTTP")
+		return
+	}
+
+	gitRepo := strings.TrimPrefix(req.path, "/")
+	reponame := strings.TrimSuffix(gitRepo, ".git")
+	if validateReponame(reponame) != nil || !AuthorizeRepo(db, 0, reponame, RepoRead) {
+		log.Printf("git daemon: no repo access to %q for %s", req.path, ip)
+		gitDaemonReject(conn, errGitDaemonNoRepo.Error())
+		return
+	}
+
+	release, err := gitLimits.acquire(conf, &gitProcess{
+		client:    gitClientFromPusher(HookPusher{}, ip),
+		transport: "git",
+		service:   req.service,
+		reponame:  reponame,
+	})
+	if err != nil {
+		gitDaemonReject(conn, err.Error())
+		return
+	}
+	defer release()
+
+	wd := newGitWatchdog()
+
+	cmd := exec.Command("git-upload-pack", "--strict", reponame+".git")
+	cmd.Dir = conf.Paths.RepoPath
+	cmd.Env = gitProtocolEnv(req.gitProtocol)
+	cmd.Stdout = wd.writer(conn)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		log.Printf("git daemon: cant open stdin pipe: %v", err)
+		return
+	}
+
+	if err := cmd.Start(); err != nil {
+		log.Printf("git daemon: start error: %v", err)
+		return
+	}
+	wd.start(conf, cmd)
+
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(stdin, wd.reader(input))
+		stdin.Close()
+		close(copied)
+	}()
+
+	err = cmd.Wait()
+	stopped := wd.stop()
+	release()
+
+	// git has written its whole output, closing the connection ends the
+	// copy if the client didn't close its side.
+	conn.Close()
+	<-copied
+
+	if stopped != nil {
+		log.Printf("git daemon: git-upload-pack of %s for %s: %v", reponame, ip, stopped)
+		return
+	}
+	if err != nil {
+		log.Printf("git daemon: git-upload-pack of %s for %s failed: %v", reponame, ip, err)
+	}
+}
@@ -0,0 +1,313 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sorcia/pkg"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// Errors of the git process limits, they're shown to the client.
+var (
+	errGitServerBusy = errors.New("The server is busy with other git operations, please try again later.")
+	errGitClientBusy = errors.New("Too many of your git operations are running at once, please try again when they have finished.")
+)
+
+// gitProcess is a git process of a transport which is running or waiting
+// for a slot.
+type gitProcess struct {
+	client    string
+	transport string
+	service   string
+	reponame  string
+	queuedAt  time.Time
+	startedAt time.Time
+}
+
+// gitLimiter limits the git processes which run at once, on the whole
+// server and per client.
+type gitLimiter struct {
+	mu        sync.Mutex
+	processes map[*gitProcess]bool
+	running   int
+	perClient map[string]int
+	// released is closed when a process ends, waking up the queued ones.
+	released chan struct{}
+}
+
+var gitLimits = &gitLimiter{
+	processes: make(map[*gitProcess]bool),
+	perClient: make(map[string]int),
+	released:  make(chan struct{}),
+}
+
+// addrIP returns the IP address of addr, without the port.
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
+
+// gitClientFromPusher names the client the per client limit counts
+// processes for: the user or deploy key, or the IP address of anonymous
+// clients.
+func gitClientFromPusher(pusher HookPusher, ip string) string {
+	switch {
+	case pusher.DeployKeyID != 0:
+		return "deploy key " + strconv.Itoa(pusher.DeployKeyID)
+	case pusher.Username != "":
+		return "user " + pusher.Username
+	}
+
+	return "ip " + ip
+}
+
+// sshLimitsOption applies idle_timeout and max_duration to whole SSH
+// connections as well, so idle connections and the commands which don't run
+// git, like git-lfs-authenticate, time out too.
+func sshLimitsOption(conf *pkg.BaseStruct) ssh.Option {
+	return func(srv *ssh.Server) error {
+		srv.IdleTimeout = conf.Limits.IdleTimeout
+		srv.MaxTimeout = conf.Limits.MaxDuration
+		return nil
+	}
+}
+
+// acquire waits for a slot for p, at most for queue_timeout. The returned
+// function frees the slot, calling it again does nothing.
+func (l *gitLimiter) acquire(conf *pkg.BaseStruct, p *gitProcess) (func(), error) {
+	limits := conf.Limits
+	p.queuedAt = time.Now()
+
+	var timeout <-chan time.Time
+	if limits.QueueTimeout > 0 {
+		timer := time.NewTimer(limits.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	l.mu.Lock()
+	l.processes[p] = false
+
+	for {
+		serverFull := limits.MaxGitProcesses > 0 && l.running >= limits.MaxGitProcesses
+		clientFull := limits.MaxGitProcessesPerClient > 0 && l.perClient[p.client] >= limits.MaxGitProcessesPerClient
+
+		if !serverFull && !clientFull {
+			l.processes[p] = true
+			l.running++
+			l.perClient[p.client]++
+			p.startedAt = time.Now()
+			l.mu.Unlock()
+
+			var once sync.Once
+			return func() { once.Do(func() { l.release(p) }) }, nil
+		}
+
+		released := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-released:
+			l.mu.Lock()
+		case <-timeout:
+			l.mu.Lock()
+			delete(l.processes, p)
+			l.mu.Unlock()
+
+			if clientFull {
+				return nil, errGitClientBusy
+			}
+			return nil, errGitServerBusy
+		}
+	}
+}
+
+func (l *gitLimiter) release(p *gitProcess) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.processes, p)
+	l.running--
+	l.perClient[p.client]--
+	if l.perClient[p.client] == 0 {
+		delete(l.perClient, p.client)
+	}
+
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// GitProcess is a git process on the usage page.
+type GitProcess struct {
+	Client    string
+	Transport string
+	Service   string
+	Reponame  string
+	Queued    bool
+	Since     string
+}
+
+// GitProcessesUsage are the git processes on the usage page.
+type GitProcessesUsage struct {
+	Running   int
+	Queued    int
+	Limit     string
+	Processes []GitProcess
+}
+
+func (l *gitLimiter) usage(conf *pkg.BaseStruct) GitProcessesUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	usage := GitProcessesUsage{
+		Running: l.running,
+		Queued:  len(l.processes) - l.running,
+		Limit:   "no limit",
+	}
+	if conf.Limits.MaxGitProcesses > 0 {
+		usage.Limit = strconv.Itoa(conf.Limits.MaxGitProcesses)
+	}
+
+	var processes []*gitProcess
+	for p := range l.processes {
+		processes = append(processes, p)
+	}
+	sort.Slice(processes, func(i, j int) bool { return processes[i].queuedAt.Before(processes[j].queuedAt) })
+
+	for _, p := range processes {
+		since := p.startedAt
+		if !l.processes[p] {
+			since = p.queuedAt
+		}
+
+		usage.Processes = append(usage.Processes, GitProcess{
+			Client:    p.client,
+			Transport: p.transport,
+			Service:   p.service,
+			Reponame:  p.reponame,
+			Queued:    !l.processes[p],
+			Since:     time.Since(since).Round(time.Second).String(),
+		})
+	}
+
+	return usage
+}
+
+// gitWatchdog stops a git process which is idle or runs for too long.
+// Reads and writes through it count as activity.
+type gitWatchdog struct {
+	// lastActive is the time of the last read or write in unix nanoseconds.
+	lastActive int64
+	done       chan struct{}
+	mu         sync.Mutex
+	stopped    error
+}
+
+func newGitWatchdog() *gitWatchdog {
+	return &gitWatchdog{
+		lastActive: time.Now().UnixNano(),
+		done:       make(chan struct{}),
+	}
+}
+
+// start watches cmd, which has to be started, until stop is called.
+func (wd *gitWatchdog) start(conf *pkg.BaseStruct, cmd *exec.Cmd) {
+	idle := conf.Limits.IdleTimeout
+	maxDuration := conf.Limits.MaxDuration
+	if idle <= 0 && maxDuration <= 0 {
+		return
+	}
+
+	go func() {
+		startedAt := time.Now()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-wd.done:
+				return
+			case now := <-ticker.C:
+				var err error
+				switch {
+				case maxDuration > 0 && now.Sub(startedAt) > maxDuration:
+					err = fmt.Errorf("git operation stopped after running for %s", maxDuration)
+				case idle > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&wd.lastActive))) > idle:
+					err = fmt.Errorf("git operation stopped after %s without data", idle)
+				}
+
+				if err != nil {
+					wd.mu.Lock()
+					wd.stopped = err
+					wd.mu.Unlock()
+
+					cmd.Process.Kill()
+					return
+				}
+			}
+		}
+	}()
+}
+
+// stop ends the watchdog and returns why it killed the process, if it did.
+func (wd *gitWatchdog) stop() error {
+	close(wd.done)
+
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+
+	return wd.stopped
+}
+
+func (wd *gitWatchdog) active() {
+	atomic.StoreInt64(&wd.lastActive, time.Now().UnixNano())
+}
+
+// reader and writer count the data passing through r and w as activity.
+func (wd *gitWatchdog) reader(r io.Reader) io.Reader {
+	return watchdogReader{wd, r}
+}
+
+func (wd *gitWatchdog) writer(w io.Writer) io.Writer {
+	return watchdogWriter{wd, w}
+}
+
+type watchdogReader struct {
+	wd *gitWatchdog
+	r  io.Reader
+}
+
+func (r watchdogReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.wd.active()
+	}
+	return n, err
+}
+
+type watchdogWriter struct {
+	wd *gitWatchdog
+	w  io.Writer
+}
+
+func (w watchdogWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.wd.active()
+	}
+	return n, err
+}
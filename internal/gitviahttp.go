@@ -5,6 +5,8 @@ import (
 	"compress/gzip"
 	"database/sql"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
@@ -29,6 +31,16 @@ type gitHandler struct {
 	repoPath    string
 	refsPath    string
 	db          *sql.DB
+	conf        *pkg.BaseStruct
+	pusher      HookPusher
+	// pushCreate is set for the requests of a push, which may create the
+	// repository.
+	pushCreate bool
+	// newRepo is set if the repository doesn't exist and receive-pack
+	// creates it.
+	newRepo bool
+	// createErr is why a push couldn't create the repository.
+	createErr error
 }
 
 func (gh *gitHandler) basicAuth(realm string) (string, string, bool) {
@@ -37,87 +49,93 @@ func (gh *gitHandler) basicAuth(realm string) (string, string, bool) {
 	return user, pass, ok
 }
 
-func (gh *gitHandler) processRepoAccess(rpc, realm string) bool {
-	isRepoPrivate := models.GetRepoType(gh.db, gh.reponame)
-
-	if isRepoPrivate && rpc == "upload-pack" {
-		username, password, ok := gh.basicAuth(realm)
-		if !ok {
-			return false
-		}
-
-		sphjwt := models.SelectPasswordHashAndJWTTokenStruct{
-			Username: username,
-		}
-		sphjwtr := models.SelectPasswordHashAndJWTToken(gh.db, sphjwt)
-
-		isPasswordValid := CheckPasswordHash(password, sphjwtr.PasswordHash)
-
-		if isPasswordValid {
-			userID := models.GetUserIDFromUsername(gh.db, username)
-			repoID := models.GetRepoIDFromReponame(gh.db, gh.reponame)
-			if models.CheckRepoOwnerFromUserIDAndReponame(gh.db, userID, gh.reponame) {
-				return true
-			} else if models.CheckRepoMemberExistFromUserIDAndRepoID(gh.db, userID, repoID) {
-				permission := models.GetRepoMemberPermissionFromUserIDAndRepoID(gh.db, userID, repoID)
-				if permission == "read" || permission == "read/write" {
-					return true
-				}
-			}
-		} else {
-			return false
-		}
-	} else if rpc == "upload-pack" {
+// processRepoAccess reports whether the request may perform action on the
+// repository. Anonymous access is tried first so that public repositories can
+// be cloned without credentials, otherwise the basic auth user is checked.
+func (gh *gitHandler) processRepoAccess(action, realm string) bool {
+	if AuthorizeRepo(gh.db, 0, gh.reponame, action) {
 		return true
-	} else if rpc == "receive-pack" {
-		username, password, ok := gh.basicAuth(realm)
-		if !ok {
-			return false
-		}
+	}
 
-		sphjwt := models.SelectPasswordHashAndJWTTokenStruct{
-			Username: username,
-		}
-		sphjwtr := models.SelectPasswordHashAndJWTToken(gh.db, sphjwt)
+	username, password, ok := gh.basicAuth(realm)
+	if !ok {
+		return false
+	}
 
-		isPasswordValid := CheckPasswordHash(password, sphjwtr.PasswordHash)
+	sphjwt := models.SelectPasswordHashAndJWTTokenStruct{
+		Username: username,
+	}
+	sphjwtr := models.SelectPasswordHashAndJWTToken(gh.db, sphjwt)
 
-		if isPasswordValid {
-			userID := models.GetUserIDFromUsername(gh.db, username)
-			repoID := models.GetRepoIDFromReponame(gh.db, gh.reponame)
-			if models.CheckRepoOwnerFromUserIDAndReponame(gh.db, userID, gh.reponame) {
-				return true
-			} else if models.CheckRepoMemberExistFromUserIDAndRepoID(gh.db, userID, repoID) {
-				permission := models.GetRepoMemberPermissionFromUserIDAndRepoID(gh.db, userID, repoID)
-				if permission == "read/write" {
-					return true
-				}
+	if !CheckPasswordHash(password, sphjwtr.PasswordHash) {
+		return false
+	}
 
-				return false
+	userID := models.GetUserIDFromUsername(gh.db, username)
+	gh.pusher = HookPusher{UserID: userID, Username: username, Protocol: "http"}
 
-			} else {
-				return false
-			}
-		} else {
+	if gh.pushCreate {
+		newRepo, err := canPushToCreate(gh.db, gh.conf, userID, gh.reponame)
+		if err != nil {
+			gh.createErr = err
 			return false
 		}
+		if newRepo {
+			gh.newRepo = true
+			return true
+		}
 	}
 
-	return true
+	return AuthorizeRepo(gh.db, userID, gh.reponame, action)
 }
 
 func getServiceType(r *http.Request) string {
-	vars := r.URL.Query()
-	serviceType := vars["service"][0]
+	serviceType := r.URL.Query().Get("service")
 	if !strings.HasPrefix(serviceType, "git-") {
 		return ""
 	}
 	return strings.TrimPrefix(serviceType, "git-")
 }
 
+// gitProtocolParam matches the value of the Git-Protocol header and the
+// GIT_PROTOCOL environment variable, colon separated key=value pairs.
+var gitProtocolParam = regexp.MustCompile(`^[A-Za-z0-9._=:-]+$`)
+
+// gitProtocolEnv returns the environment which makes upload-pack speak the
+// protocol version requested by the client. Requests without a valid
+// parameter get the default v0 behaviour.
+func gitProtocolEnv(param string) []string {
+	env := os.Environ()
+	if gitProtocolParam.MatchString(param) {
+		env = append(env, "GIT_PROTOCOL="+param)
+	}
+
+	return env
+}
+
+// isGitProtocolV2 reports whether the client asked for protocol v2.
+func isGitProtocolV2(param string) bool {
+	if !gitProtocolParam.MatchString(param) {
+		return false
+	}
+
+	for _, kv := range strings.Split(param, ":") {
+		if kv == "version=2" {
+			return true
+		}
+	}
+
+	return false
+}
+
 func gitCommand(dir string, args ...string) []byte {
+	return gitCommandEnv(dir, nil, args...)
+}
+
+func gitCommandEnv(dir string, env []string, args ...string) []byte {
 	cmd := exec.Command("git", args...)
 	cmd.Dir = dir
+	cmd.Env = env
 	out, err := cmd.Output()
 	pkg.CheckError("Error on git command function", err)
 
@@ -177,46 +195,111 @@ func serviceReceivePack(gh gitHandler) {
 }
 
 func postServiceRPC(gh gitHandler, rpc string) {
-	if gh.processRepoAccess(rpc, "Please enter your username and password") {
-		if gh.r.Header.Get("Content-Type") != fmt.Sprintf("application/x-git-%s-request", rpc) {
-			gh.w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+	if gh.r.Header.Get("Content-Type") != fmt.Sprintf("application/x-git-%s-request", rpc) {
+		gh.w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 
-		gh.w.Header().Set("Content-Type", fmt.Sprintf("application/x-git-%s-result", rpc))
+	gh.w.Header().Set("Content-Type", fmt.Sprintf("application/x-git-%s-result", rpc))
 
-		var err error
-		reqBody := gh.r.Body
+	var err error
+	reqBody := gh.r.Body
 
-		// Handle GZIP
-		if gh.r.Header.Get("Content-Encoding") == "gzip" {
-			reqBody, err = gzip.NewReader(reqBody)
-			if err != nil {
-				fmt.Printf("Fail to create gzip reader: %v", err)
-				gh.w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+	// Handle GZIP
+	if gh.r.Header.Get("Content-Encoding") == "gzip" {
+		reqBody, err = gzip.NewReader(reqBody)
+		if err != nil {
+			fmt.Printf("Fail to create gzip reader: %v", err)
+			gh.w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
+	}
 
-		cmd := exec.Command("git", rpc, "--stateless-rpc", gh.dir)
-
-		var stderr bytes.Buffer
+	release, ok := gh.acquireGitSlot(rpc)
+	if !ok {
+		return
+	}
+	defer release()
 
-		cmd.Dir = gh.dir
-		cmd.Stdin = reqBody
-		cmd.Stdout = gh.w
-		cmd.Stderr = &stderr
-		if err := cmd.Run(); err != nil {
-			fmt.Println(fmt.Sprintf("Fail to serve RPC(%s): %v - %s", rpc, err, stderr.String()))
+	newRepo := false
+	if gh.newRepo {
+		if newRepo, err = pushToCreate(gh.db, gh.conf, gh.pusher.UserID, gh.reponame); err != nil {
+			writeHdr(gh.w, http.StatusForbidden, err.Error()+"\n")
 			return
 		}
 
-		if rpc == "receive-pack" {
-			go pkg.GenerateRefs(gh.refsPath, gh.repoPath, gh.repoGitName)
+		// Another push created it in the meantime.
+		if !newRepo && !AuthorizeRepo(gh.db, gh.pusher.UserID, gh.reponame, RepoWrite) {
+			writeHdr(gh.w, http.StatusForbidden, "The repository cannot be accessed with your credentials.\n")
+			return
 		}
+	}
+	if newRepo {
+		defer removePushCreatedRepo(gh.db, gh.conf, gh.reponame)
+	}
+
+	cmd := exec.Command("git", rpc, "--stateless-rpc", gh.dir)
+
+	var stderr bytes.Buffer
+
+	cmd.Dir = gh.dir
+	if rpc == "upload-pack" {
+		cmd.Env = gitProtocolEnv(gh.r.Header.Get("Git-Protocol"))
 	} else {
-		gh.w.Header().Set("WWW-Authenticate", "Basic realm=\".\"")
-		writeHdr(gh.w, http.StatusUnauthorized, "The repository cannot be accessed with your credentials.\n")
+		cmd.Env = quotaEnv(hookEnv(os.Environ(), gh.reponame, gh.pusher), gh.conf)
+		if newRepo {
+			cmd.Env = append(cmd.Env, hookEnvNewRepo+"=1")
+		}
+	}
+	wd := newGitWatchdog()
+	cmd.Stdout = wd.writer(gh.w)
+	cmd.Stderr = &stderr
+
+	input, err := cmd.StdinPipe()
+	if err != nil {
+		fmt.Printf("Fail to open stdin of RPC(%s): %v", rpc, err)
+		gh.w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := cmd.Start(); err != nil {
+		fmt.Printf("Fail to start RPC(%s): %v", rpc, err)
+		gh.w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	wd.start(gh.conf, cmd)
+
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(input, wd.reader(reqBody))
+		input.Close()
+		close(copied)
+	}()
+
+	err = cmd.Wait()
+	stopped := wd.stop()
+	release()
+
+	// The body can't be read after the handler returned. Wait closed the
+	// pipe, so the copy ends with the end of the body or the next data of
+	// the client. A client which stops sending only holds this request, not
+	// a slot.
+	if f, ok := gh.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	<-copied
+
+	if stopped != nil {
+		fmt.Printf("Stopped RPC(%s) of %s: %v\n", rpc, gh.reponame, stopped)
+		return
+	}
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Fail to serve RPC(%s): %v - %s", rpc, err, stderr.String()))
+		return
+	}
+
+	if rpc == "receive-pack" {
+		go SyncPushMirrors(gh.db, gh.conf, gh.reponame)
 	}
 }
 
@@ -225,29 +308,52 @@ func getInfoRefs(gh gitHandler) {
 
 	rpc := getServiceType(gh.r)
 
-	if gh.processRepoAccess(rpc, "Please enter your username and password") {
+	if rpc != "upload-pack" && rpc != "receive-pack" {
+		updateServerInfo(gh.dir)
+		gh.sendFile("text/plain; charset=utf-8")
+		return
+	}
+
+	release, ok := gh.acquireGitSlot(rpc)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Only upload-pack speaks protocol v2, pushes always use v0.
+	var env []string
+	v2 := false
+	if rpc == "upload-pack" {
+		gitProtocol := gh.r.Header.Get("Git-Protocol")
+		env = gitProtocolEnv(gitProtocol)
+		v2 = isGitProtocolV2(gitProtocol)
+	}
 
-		if rpc != "upload-pack" && rpc != "receive-pack" {
-			gh := gitHandler{}
-			updateServerInfo(gh.dir)
-			gh.sendFile("text/plain; charset=utf-8")
+	dir := gh.dir
+	if gh.newRepo {
+		// The repository is created when the push is received, until
+		// then the refs of an empty one are advertised.
+		tmpDir, err := ioutil.TempDir("", "sorcia-new-repo")
+		if err != nil {
+			writeHdr(gh.w, http.StatusInternalServerError, "Internal server error\n")
 			return
 		}
+		defer os.RemoveAll(tmpDir)
+
+		gitCommand(tmpDir, "init", "--bare", "--quiet")
+		dir = tmpDir
+	}
 
-		refs := gitCommand(gh.dir, rpc, "--stateless-rpc", "--advertise-refs", ".")
-		gh.w.Header().Set("Content-Type", fmt.Sprintf("application/x-git-%s-advertisement", rpc))
-		gh.w.WriteHeader(http.StatusOK)
+	refs := gitCommandEnv(dir, env, rpc, "--stateless-rpc", "--advertise-refs", ".")
+	gh.w.Header().Set("Content-Type", fmt.Sprintf("application/x-git-%s-advertisement", rpc))
+	gh.w.WriteHeader(http.StatusOK)
+
+	// A v2 capability advertisement replaces the service announcement.
+	if !v2 {
 		gh.w.Write(packetWrite("# service=git-" + rpc + "\n"))
 		gh.w.Write([]byte("0000"))
-		gh.w.Write(refs)
-
-		if rpc == "receive-pack" {
-			go pkg.GenerateRefs(gh.refsPath, gh.repoPath, gh.repoGitName)
-		}
-	} else {
-		gh.w.Header().Set("WWW-Authenticate", "Basic realm=\".\"")
-		writeHdr(gh.w, http.StatusUnauthorized, "The repository cannot be accessed with your credentials.\n")
 	}
+	gh.w.Write(refs)
 }
 
 func getTextFile(gh gitHandler) {
@@ -293,6 +399,30 @@ var routes = []struct {
 	{regexp.MustCompile("(.*?)/objects/pack/pack-[0-9a-f]{40}\\.idx$"), "GET", getIdxFile},
 }
 
+// acquireGitSlot waits for a slot of the git process limits. The client
+// gets the reason as text, which git shows, if there's none.
+func (gh *gitHandler) acquireGitSlot(rpc string) (func(), bool) {
+	release, err := gitLimits.acquire(gh.conf, &gitProcess{
+		client:    gitClientFromPusher(gh.pusher, pkg.ClientIP(gh.r)),
+		transport: "http",
+		service:   "git-" + rpc,
+		reponame:  gh.reponame,
+	})
+	if err != nil {
+		status := http.StatusServiceUnavailable
+		if err == errGitClientBusy {
+			status = http.StatusTooManyRequests
+		}
+
+		gh.w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		gh.w.Header().Set("Retry-After", "60")
+		writeHdr(gh.w, status, err.Error()+"\n")
+		return nil, false
+	}
+
+	return release, true
+}
+
 func writeHdr(w http.ResponseWriter, status int, text string) {
 	w.WriteHeader(status)
 	_, err := w.Write([]byte(text))
@@ -305,8 +435,22 @@ func getProjectRootDir() string {
 	return projectRootDir
 }
 
+// repoDirectory returns the directory of a bare repository, e.g.
+// "sorcia.git".
+func repoDirectory(conf *pkg.BaseStruct, repoGitName string) string {
+	if conf.Paths.RepoPath == "." || conf.Paths.RepoPath == "" || conf.Paths.RepoPath == "./repositories" {
+		return filepath.Join(getProjectRootDir(), "repositories", repoGitName)
+	}
+
+	return filepath.Join(conf.Paths.RepoPath, repoGitName)
+}
+
 // GitviaHTTP ...
 func GitviaHTTP(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct) {
+	if serveLFS(w, r, db, conf) {
+		return
+	}
+
 	for _, route := range routes {
 		reqPath := strings.ToLower(r.URL.Path)
 		reqPath = "/" + strings.Split(reqPath, "/r/")[1]
@@ -325,14 +469,7 @@ func GitviaHTTP(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.Ba
 			return
 		}
 
-		var repoDir string
-		projectRootDir := getProjectRootDir()
-
-		if conf.Paths.RepoPath == "." || conf.Paths.RepoPath == "" || conf.Paths.RepoPath == "./repositories" {
-			repoDir = filepath.Join(projectRootDir, "repositories", routeMatch[1])
-		} else {
-			repoDir = filepath.Join(conf.Paths.RepoPath, routeMatch[1])
-		}
+		repoDir := repoDirectory(conf, routeMatch[1])
 
 		file := strings.TrimPrefix(reqPath, routeMatch[1]+"/")
 		repoGitName := strings.TrimPrefix(routeMatch[1], "/")
@@ -348,6 +485,26 @@ func GitviaHTTP(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.Ba
 			repoPath:    conf.Paths.RepoPath,
 			refsPath:    conf.Paths.RefsPath,
 			db:          db,
+			conf:        conf,
+		}
+
+		// Every route, including the dumb protocol files, goes through
+		// the same authorization. Only pushes need write access.
+		action := RepoRead
+		if strings.HasSuffix(reqPath, "/git-receive-pack") || getServiceType(r) == "receive-pack" {
+			action = RepoWrite
+			gh.pushCreate = strings.HasSuffix(reqPath, "/git-receive-pack") || strings.HasSuffix(reqPath, "/info/refs")
+		}
+
+		if !gh.processRepoAccess(action, "Please enter your username and password") {
+			if gh.createErr != nil {
+				writeHdr(w, http.StatusForbidden, gh.createErr.Error()+"\n")
+				return
+			}
+
+			w.Header().Set("WWW-Authenticate", "Basic realm=\".\"")
+			writeHdr(w, http.StatusUnauthorized, "The repository cannot be accessed with your credentials.\n")
+			return
 		}
 
 		route.handler(gh)
@@ -1,14 +1,17 @@
 package internal
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"os/exec"
-	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"sorcia/models"
 	"sorcia/pkg"
@@ -17,129 +20,391 @@ import (
 	gossh "golang.org/x/crypto/ssh"
 )
 
-var authorizedKey []byte
-var gitRPC, gitRepo string
-var userID string
-var reponame string
+// sshIdentity is who an SSH connection authenticated as. The public key
+// handler stores it in the ssh.Context of the connection, so concurrent
+// connections can't see each other's identity.
+type sshIdentity struct {
+	UserID int
+	// KeyID is the ID of the user's key, it's 0 for certificates.
+	KeyID int
+	// DeployKey is set instead of UserID for deploy keys.
+	DeployKey *models.DeployKey
+}
 
-// RunSSH ...
-func RunSSH(conf *pkg.BaseStruct, db *sql.DB) {
-	ssh.Handle(func(s ssh.Session) {
-		authorizedKey = gossh.MarshalAuthorizedKey(s.PublicKey())
+type sshIdentityContextKey struct{}
 
-		if len(s.Command()) == 2 {
-			gitRPC = s.Command()[0]
-			gitRepo = s.Command()[1]
+func sshIdentityFromContext(ctx context.Context) (sshIdentity, bool) {
+	identity, ok := ctx.Value(sshIdentityContextKey{}).(sshIdentity)
+	return identity, ok
+}
 
-			if strings.HasPrefix(gitRepo, "/") {
-				gitRepo = strings.Split(gitRepo, "/")[1]
-			}
+// sshCommands are the only commands which can be run over SSH, mapped to
+// the repository access they need.
+var sshCommands = map[string]string{
+	"git-upload-pack":    RepoRead,
+	"git-upload-archive": RepoRead,
+	"git-receive-pack":   RepoWrite,
+	// The access of git-lfs-authenticate depends on its operation.
+	"git-lfs-authenticate": RepoRead,
+}
 
-			if !strings.HasSuffix(gitRepo, ".git") {
-				log.Printf("ssh: invalid git repository name")
-				return
-			}
+// sshNoRepoAccess is sent for repositories which don't exist as well, so
+// private repositories can't be discovered.
+const sshNoRepoAccess = "repository not found or access denied"
 
-			reponame = strings.Split(gitRepo, ".git")[0]
-			userIDInt, err := strconv.Atoi(userID)
-			if err != nil {
-				log.Printf("ssh: cannot convert userID to integer")
-				return
-			}
-			repoID := models.GetRepoIDFromReponame(db, reponame)
-
-			if isRepoPrivate := models.GetRepoType(db, reponame); isRepoPrivate && gitRPC == "upload-pack" {
-				if !models.CheckRepoOwnerFromUserIDAndReponame(db, userIDInt, reponame) && !models.CheckRepoMemberExistFromUserIDAndRepoID(db, userIDInt, repoID) {
-					log.Printf("ssh: no repo access")
-					return
-				} else if models.CheckRepoMemberExistFromUserIDAndRepoID(db, userIDInt, repoID) {
-					permission := models.GetRepoMemberPermissionFromUserIDAndRepoID(db, userIDInt, repoID)
-					if permission != "read" && permission != "read/write" {
-						log.Printf("ssh: no repo access")
-						return
-					}
-				}
-			}
+// parseSSHCommand checks a command sent by an SSH client against
+// sshCommands. It returns the git command, the repository directory name
+// and the access needed.
+func parseSSHCommand(command []string) (string, string, string, error) {
+	// Some clients send "git upload-pack" instead of "git-upload-pack".
+	if len(command) == 3 && command[0] == "git" {
+		command = []string{"git-" + command[1], command[2]}
+	}
 
-			if gitRPC == "git-receive-pack" {
-				if !models.CheckRepoOwnerFromUserIDAndReponame(db, userIDInt, reponame) && !models.CheckRepoMemberExistFromUserIDAndRepoID(db, userIDInt, repoID) {
-					log.Printf("ssh: no repo access")
-					return
-				} else if models.CheckRepoMemberExistFromUserIDAndRepoID(db, userIDInt, repoID) {
-					permission := models.GetRepoMemberPermissionFromUserIDAndRepoID(db, userIDInt, repoID)
-					if permission != "read/write" {
-						log.Printf("ssh: no repo access")
-						return
-					}
-				}
-			}
-		} else {
-			log.Printf("ssh: no git command")
-			return
+	if len(command) == 0 {
+		return "", "", "", errors.New("interactive shell access is not provided")
+	}
+
+	action, ok := sshCommands[command[0]]
+	if !ok {
+		return "", "", "", fmt.Errorf("unsupported command %q", command[0])
+	}
+
+	// "git-lfs-authenticate <repository> <operation>"
+	if command[0] == "git-lfs-authenticate" {
+		if len(command) != 3 || (command[2] != "upload" && command[2] != "download") {
+			return "", "", "", errors.New("git-lfs-authenticate expects a repository and upload or download")
 		}
 
-		cmd := exec.Command(gitRPC, gitRepo)
-		cmd.Dir = conf.Paths.RepoPath
+		if command[2] == "upload" {
+			action = RepoWrite
+		}
+		command = command[:2]
+	}
 
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			log.Printf("ssh: cant open stdout pipe: %v", err)
-			return
+	if len(command) != 2 {
+		return "", "", "", fmt.Errorf("%s expects exactly one repository", command[0])
+	}
+
+	repo := strings.TrimPrefix(command[1], "/")
+	if !strings.HasSuffix(repo, ".git") || !pkg.IsAlnumOrHyphen(strings.TrimSuffix(repo, ".git")) {
+		return "", "", "", fmt.Errorf("invalid repository %q", command[1])
+	}
+
+	return command[0], repo, action, nil
+}
+
+// sshReject writes message to the stderr of the client and ends the session
+// with a non-zero exit status.
+func sshReject(s ssh.Session, message string) {
+	fmt.Fprintf(s.Stderr(), "sorcia: %s\n", message)
+	s.Exit(1)
+}
+
+// sessionGitProtocol returns GIT_PROTOCOL as sent by the client with an env
+// request, which is how ssh clients ask for protocol v2.
+func sessionGitProtocol(s ssh.Session) string {
+	for _, kv := range s.Environ() {
+		if strings.HasPrefix(kv, "GIT_PROTOCOL=") {
+			return strings.TrimPrefix(kv, "GIT_PROTOCOL=")
 		}
+	}
 
-		stderr, err := cmd.StderrPipe()
-		if err != nil {
-			log.Printf("ssh: cant open stderr pipe: %v", err)
-			return
+	return ""
+}
+
+// authorizeSSH checks the access of an identity to a repository and
+// returns the pusher passed to the hooks.
+func authorizeSSH(db *sql.DB, identity sshIdentity, reponame, action string) (HookPusher, bool) {
+	pusher := HookPusher{Protocol: "ssh"}
+
+	if dk := identity.DeployKey; dk != nil {
+		if !authorizeDeployKey(*dk, reponame, action) {
+			log.Printf("ssh: no repo access for deploy key %s", dk.Fingerprint)
+			return pusher, false
 		}
 
-		input, err := cmd.StdinPipe()
-		if err != nil {
-			log.Printf("ssh: cant open stdin pipe: %v", err)
+		pusher.DeployKeyID = dk.ID
+		return pusher, true
+	}
+
+	if !AuthorizeRepo(db, identity.UserID, reponame, action) {
+		log.Printf("ssh: no repo access for user %d", identity.UserID)
+		return pusher, false
+	}
+
+	pusher.UserID = identity.UserID
+	pusher.Username = models.GetUsernameFromUserID(db, identity.UserID)
+
+	if identity.KeyID != 0 {
+		models.UpdateSSHKeyLastUsed(db, identity.KeyID, time.Now().Unix())
+	}
+
+	return pusher, true
+}
+
+// handleSSHSession serves one SSH session. All of its state is local, a
+// connection can carry several sessions and connections are served
+// concurrently.
+func handleSSHSession(s ssh.Session, db *sql.DB, conf *pkg.BaseStruct) {
+	identity, ok := sshIdentityFromContext(s.Context())
+	if !ok {
+		sshReject(s, sshNoRepoAccess)
+		return
+	}
+
+	if isSSHManagementCommand(s.Command()) {
+		runSSHManagementCommand(s, db, conf, identity, s.Command())
+		return
+	}
+
+	gitRPC, gitRepo, action, err := parseSSHCommand(s.Command())
+	if err != nil {
+		sshReject(s, err.Error())
+		return
+	}
+
+	reponame := strings.TrimSuffix(gitRepo, ".git")
+
+	newRepo := false
+	if gitRPC == "git-receive-pack" && identity.DeployKey == nil {
+		if newRepo, err = pushToCreate(db, conf, identity.UserID, reponame); err != nil {
+			sshReject(s, err.Error())
 			return
 		}
+	}
+	if newRepo {
+		defer removePushCreatedRepo(db, conf, reponame)
+	}
 
-		if err = cmd.Start(); err != nil {
-			log.Printf("ssh: start error: %v", err)
-			return
+	pusher, ok := authorizeSSH(db, identity, reponame, action)
+	if !ok {
+		sshReject(s, sshNoRepoAccess)
+		return
+	}
+
+	if gitRPC == "git-lfs-authenticate" {
+		lfsAuthenticate(s, db, conf, reponame, pusher, action)
+		return
+	}
+
+	release, err := gitLimits.acquire(conf, &gitProcess{
+		client:    gitClientFromPusher(pusher, addrIP(s.RemoteAddr())),
+		transport: "ssh",
+		service:   gitRPC,
+		reponame:  reponame,
+	})
+	if err != nil {
+		sshReject(s, err.Error())
+		return
+	}
+	defer release()
+
+	cmd := exec.Command(gitRPC, gitRepo)
+	cmd.Dir = conf.Paths.RepoPath
+	switch gitRPC {
+	case "git-upload-pack":
+		cmd.Env = gitProtocolEnv(sessionGitProtocol(s))
+	case "git-receive-pack":
+		cmd.Env = quotaEnv(hookEnv(os.Environ(), reponame, pusher), conf)
+		if newRepo {
+			cmd.Env = append(cmd.Env, hookEnvNewRepo+"=1")
 		}
+	}
 
-		go io.Copy(input, s)
-		io.Copy(s, stdout)
-		io.Copy(s.Stderr(), stderr)
+	status := runSSHCommand(s, conf, cmd, release)
 
-		if err = cmd.Wait(); err != nil {
-			log.Printf("ssh: command failed: %v", err)
-			return
+	if status == 0 && gitRPC == "git-receive-pack" {
+		go SyncPushMirrors(db, conf, reponame)
+	}
+}
+
+// sshSessionCloseTimeout is how long a client has to close a session which
+// ended, before its connection is closed.
+const sshSessionCloseTimeout = 10 * time.Second
+
+// runSSHCommand runs cmd with the input and output of the session, ends the
+// session with its exit status and returns it. release is called as soon as
+// git exited.
+func runSSHCommand(s ssh.Session, conf *pkg.BaseStruct, cmd *exec.Cmd, release func()) int {
+	wd := newGitWatchdog()
+
+	// exec copies stdout and stderr concurrently and Wait waits for both,
+	// so a full stderr pipe can't block git while stdout is copied.
+	cmd.Stdout = wd.writer(s)
+	cmd.Stderr = wd.writer(s.Stderr())
+
+	input, err := cmd.StdinPipe()
+	if err != nil {
+		log.Printf("ssh: cant open stdin pipe: %v", err)
+		fmt.Fprintln(s.Stderr(), "sorcia: internal server error")
+		s.Exit(1)
+		return 1
+	}
+
+	if err = cmd.Start(); err != nil {
+		log.Printf("ssh: start error: %v", err)
+		fmt.Fprintln(s.Stderr(), "sorcia: internal server error")
+		s.Exit(1)
+		return 1
+	}
+	wd.start(conf, cmd)
+
+	// Protocol v2 upload-pack serves commands until its stdin is closed, so
+	// the client's EOF has to be passed on.
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(input, wd.reader(s))
+		input.Close()
+		close(copied)
+	}()
+
+	err = cmd.Wait()
+	status := sshExitStatus(s, cmd.Args[0], err, wd.stop())
+	release()
+
+	// Clients don't always close their side before git exits, Exit closes
+	// the session which ends the copy once the client confirms. The session
+	// can't be read after the handler returned.
+	s.Exit(status)
+	select {
+	case <-copied:
+	case <-time.After(sshSessionCloseTimeout):
+		// Closing the connection ends the copy of a client which ignores
+		// the end of the session.
+		if conn, ok := s.Context().Value(ssh.ContextKeyConn).(gossh.Conn); ok {
+			conn.Close()
 		}
+		<-copied
+	}
+
+	return status
+}
 
-		s.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+// sshExitStatus returns the exit status for the client of a git command
+// which ended with err, or which the watchdog stopped.
+func sshExitStatus(s ssh.Session, command string, err, stopped error) int {
+	if stopped != nil {
+		log.Printf("ssh: %s: %v", command, stopped)
+		fmt.Fprintf(s.Stderr(), "sorcia: %v\n", stopped)
+		return 1
+	}
+	if err == nil {
+		return 0
+	}
 
-		if gitRPC == "git-receive-pack" {
-			go pkg.GenerateRefs(conf.Paths.RefsPath, conf.Paths.RepoPath, gitRepo)
+	log.Printf("ssh: %s failed: %v", command, err)
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+		return exitErr.ExitCode()
+	}
+
+	// Killed by a signal.
+	return 1
+}
+
+// sshAuthKeyContextKey is the key a connection authenticates with.
+type sshAuthKeyContextKey struct{}
+
+// sshAuthenticate is the public key handler of the SSH server. It's called
+// for the keys a client offers, but x/crypto caches the results: when a
+// client signs with a key it queried before, the handler isn't called
+// again. So the first accepted key is the only one a connection can
+// authenticate with, otherwise a client could query someone else's key and
+// sign with its own one to get their identity.
+func sshAuthenticate(ctx ssh.Context, key ssh.PublicKey, db *sql.DB, caKeys []gossh.PublicKey) bool {
+	if authKey, ok := ctx.Value(sshAuthKeyContextKey{}).(ssh.PublicKey); ok {
+		return ssh.KeysEqual(key, authKey)
+	}
+
+	identity, ok := sshKeyIdentity(ctx, key, db, caKeys)
+	if !ok {
+		return false
+	}
+
+	ctx.SetValue(sshAuthKeyContextKey{}, key)
+	ctx.SetValue(sshIdentityContextKey{}, identity)
+
+	return true
+}
+
+// sshKeyIdentity returns who key belongs to.
+func sshKeyIdentity(ctx ssh.Context, key ssh.PublicKey, db *sql.DB, caKeys []gossh.PublicKey) (sshIdentity, bool) {
+	// Certificates are only accepted from the configured CAs, the key
+	// inside them doesn't have to be registered.
+	if cert, ok := key.(*gossh.Certificate); ok {
+		if len(caKeys) == 0 {
+			log.Printf("ssh: certificate offered but no trusted_user_ca_keys configured")
+			return sshIdentity{}, false
 		}
 
-		return
-	})
+		certUser, err := certUserID(db, cert, ctx.RemoteAddr(), caKeys)
+		if err != nil {
+			log.Printf("ssh: certificate %q rejected: %v", cert.KeyId, err)
+			return sshIdentity{}, false
+		}
 
-	publicKeyOption := ssh.PublicKeyAuth(func(ctx ssh.Context, key ssh.PublicKey) bool {
-		sshDetail := models.GetSSHAllAuthKeys(db)
+		return sshIdentity{UserID: certUser}, true
+	}
+
+	sshDetail := models.GetSSHAllAuthKeys(db, time.Now().Unix())
 
-		for i := 0; i < len(sshDetail.AuthKeys); i++ {
-			authKeyByte := []byte(sshDetail.AuthKeys[i])
-			allowed, _, _, _, err := gossh.ParseAuthorizedKey(authKeyByte)
-			pkg.CheckError("Error on Parse authorized key", err)
+	for i := 0; i < len(sshDetail.AuthKeys); i++ {
+		authKeyByte := []byte(sshDetail.AuthKeys[i])
+		allowed, _, _, _, err := gossh.ParseAuthorizedKey(authKeyByte)
+		pkg.CheckError("Error on Parse authorized key", err)
 
-			if ssh.KeysEqual(key, allowed) {
-				userID = sshDetail.UserIDs[i]
-				return true
+		if ssh.KeysEqual(key, allowed) {
+			keyUserID, err := strconv.Atoi(sshDetail.UserIDs[i])
+			if err != nil {
+				log.Printf("ssh: cannot convert userID to integer")
+				return sshIdentity{}, false
 			}
+
+			return sshIdentity{UserID: keyUserID, KeyID: sshDetail.KeyIDs[i]}, true
 		}
-		log.Printf("Failed to handshake")
-		return false
+	}
+
+	// Deploy keys aren't tied to a user, the session is limited to the
+	// repository of the key.
+	for _, dk := range models.GetAllDeployKeys(db) {
+		allowed, _, _, _, err := gossh.ParseAuthorizedKey([]byte(dk.AuthKey))
+		pkg.CheckError("Error on Parse deploy key", err)
+		if err != nil {
+			continue
+		}
+
+		if ssh.KeysEqual(key, allowed) {
+			return sshIdentity{DeployKey: &dk}, true
+		}
+	}
+	log.Printf("Failed to handshake")
+	return sshIdentity{}, false
+}
+
+// RunSSH ...
+func RunSSH(conf *pkg.BaseStruct, db *sql.DB) {
+	ssh.Handle(func(s ssh.Session) {
+		handleSSHSession(s, db, conf)
+	})
+
+	caKeys := loadTrustedUserCAKeys(conf.SSH.TrustedUserCAKeys)
+
+	publicKeyOption := ssh.PublicKeyAuth(func(ctx ssh.Context, key ssh.PublicKey) bool {
+		return sshAuthenticate(ctx, key, db, caKeys)
 	})
 
+	// A rotation whose grace period ended while sorcia was stopped replaces
+	// the keys before they're loaded.
+	_, err := pkg.PromoteHostKeys(conf.Paths.SSHPath, conf.SSH.HostKeyGrace)
+	pkg.CheckError("Error on ssh replace host keys", err)
+
+	hostKeys := &hostKeyStore{sshPath: conf.Paths.SSHPath}
+	err = hostKeys.load()
+	pkg.CheckError("Error on ssh load host keys", err)
+
+	go hostKeys.promote(conf.SSH.HostKeyGrace)
+
 	log.Printf("Starting ssh server on port %s...", conf.Server.SSHPort)
 	sshPort := fmt.Sprintf(":%s", conf.Server.SSHPort)
-	log.Fatal(ssh.ListenAndServe(sshPort, nil, ssh.NoPty(), publicKeyOption, ssh.HostKeyFile(filepath.Join(conf.Paths.SSHPath, "id_rsa"))))
+	log.Fatal(ssh.ListenAndServe(sshPort, nil, ssh.NoPty(), publicKeyOption, sshHostKeysOption(hostKeys), sshLimitsOption(conf)))
 }
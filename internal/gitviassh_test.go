@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"sorcia/models"
+	"sorcia/pkg"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// newTestSSHServer serves SSH with sshAuthenticate. Sessions write the
+// identity they run as.
+func newTestSSHServer(t *testing.T, db *sql.DB) string {
+	t.Helper()
+
+	srv := &ssh.Server{
+		Handler: func(s ssh.Session) {
+			io.WriteString(s, sshIdentityString(sshIdentityFromContext(s.Context())))
+		},
+		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
+			return sshAuthenticate(ctx, key, db, nil)
+		},
+	}
+	srv.AddHostKey(newTestSigner(t))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	return ln.Addr().String()
+}
+
+func sshIdentityString(identity sshIdentity, ok bool) string {
+	switch {
+	case !ok:
+		return "none"
+	case identity.DeployKey != nil:
+		return fmt.Sprintf("deploy key %d", identity.DeployKey.ID)
+	}
+
+	return fmt.Sprintf("user %d key %d", identity.UserID, identity.KeyID)
+}
+
+// testSSHWhoami connects with the signers, which are tried in order, and
+// returns the identity the session runs as.
+func testSSHWhoami(addr string, signers ...gossh.Signer) (string, error) {
+	client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User:            "git",
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(signers...)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	output, err := session.Output("whoami")
+	return string(output), err
+}
+
+// parseTestSSHKey parses key like the forms which add keys.
+func parseTestSSHKey(t *testing.T, key gossh.PublicKey) *pkg.SSHKey {
+	t.Helper()
+
+	parsed, err := pkg.ParseSSHKey(string(gossh.MarshalAuthorizedKey(key)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed
+}
+
+func insertTestSSHKey(t *testing.T, db *sql.DB, userID int, key gossh.PublicKey) {
+	t.Helper()
+
+	parsed := parseTestSSHKey(t, key)
+	models.InsertSSHPubKey(db, models.InsertSSHPubKeyStruct{
+		AuthKey:           parsed.AuthorizedKey,
+		Title:             "test",
+		Fingerprint:       parsed.Fingerprint,
+		FingerprintSHA256: parsed.FingerprintSHA256,
+		UserID:            userID,
+	})
+}
+
+// queryOnlySigner offers a key it doesn't have. The server is asked whether
+// it accepts the key, the signature has an unknown format and is refused
+// without ending the connection.
+type queryOnlySigner struct {
+	key gossh.PublicKey
+}
+
+func (s queryOnlySigner) PublicKey() gossh.PublicKey {
+	return s.key
+}
+
+func (s queryOnlySigner) Sign(rand io.Reader, data []byte) (*gossh.Signature, error) {
+	return &gossh.Signature{Format: "query-only"}, nil
+}
+
+func TestSSHAuthenticateQueriedKeys(t *testing.T) {
+	db := newTestDB(t)
+	aliceID := insertTestUser(t, db, "alice", false)
+	bobID := insertTestUser(t, db, "bob", false)
+	repoID := insertTestRepo(t, db, "project", bobID, true)
+
+	alice := newTestSigner(t)
+	insertTestSSHKey(t, db, aliceID, alice.PublicKey())
+
+	bob := newTestSigner(t)
+	insertTestSSHKey(t, db, bobID, bob.PublicKey())
+
+	deployKey := newTestSigner(t)
+	parsed := parseTestSSHKey(t, deployKey.PublicKey())
+	models.InsertDeployKey(db, models.InsertDeployKeyStruct{
+		RepoID:      repoID,
+		Title:       "test",
+		AuthKey:     parsed.AuthorizedKey,
+		Fingerprint: parsed.Fingerprint,
+		ReadWrite:   true,
+	})
+
+	addr := newTestSSHServer(t, db)
+
+	aliceIdentity, err := testSSHWhoami(addr, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The public keys of others are known, e.g. from /<username>.keys. A
+	// client queries its own key, then the victim's, and signs with its own.
+	// The result of the first query is cached, so the handler doesn't see
+	// which key signed.
+	victims := map[string]gossh.PublicKey{
+		"user key":   bob.PublicKey(),
+		"deploy key": deployKey.PublicKey(),
+	}
+	for name, victim := range victims {
+		t.Run(name, func(t *testing.T) {
+			got, err := testSSHWhoami(addr,
+				queryOnlySigner{alice.PublicKey()},
+				queryOnlySigner{victim},
+				alice,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != aliceIdentity {
+				t.Errorf("session runs as %s, want %s", got, aliceIdentity)
+			}
+		})
+	}
+}
+
+func TestSSHAuthenticateConcurrent(t *testing.T) {
+	db := newTestDB(t)
+	addr := newTestSSHServer(t, db)
+
+	const users = 10
+	signers := make([]gossh.Signer, users)
+	for i := range signers {
+		userID := insertTestUser(t, db, fmt.Sprintf("user%d", i), false)
+		signers[i] = newTestSigner(t)
+		insertTestSSHKey(t, db, userID, signers[i].PublicKey())
+	}
+
+	want := make([]string, users)
+	for i, signer := range signers {
+		identity, err := testSSHWhoami(addr, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[i] = identity
+	}
+
+	unknown := newTestSigner(t)
+
+	var wg sync.WaitGroup
+	for round := 0; round < 5; round++ {
+		for i := range signers {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				// An unknown key first, like a client with several
+				// keys in its agent.
+				got, err := testSSHWhoami(addr, unknown, signers[i])
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if got != want[i] {
+					t.Errorf("session of user%d runs as %s, want %s", i, got, want[i])
+				}
+			}(i)
+		}
+	}
+	wg.Wait()
+}
@@ -17,6 +17,7 @@ type IndexPageResponse struct {
 	ShowLoginMenu    bool
 	HeaderActiveMenu string
 	SorciaVersion    string
+	CSRFToken        string
 	CanCreateRepo    bool
 	Repos            GetReposStruct
 	SiteSettings     SiteSettings
@@ -116,6 +117,7 @@ func GetHome(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseS
 			IsLoggedIn:       true,
 			HeaderActiveMenu: "",
 			SorciaVersion:    conf.Version,
+			CSRFToken:        csrfToken(w),
 			CanCreateRepo:    models.CheckifUserCanCreateRepo(db, userID),
 			Repos:            grs,
 			SiteSettings:     GetSiteSettings(db, conf),
@@ -154,6 +156,7 @@ func GetHome(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseS
 			IsLoggedIn:    false,
 			ShowLoginMenu: true,
 			SorciaVersion: conf.Version,
+			CSRFToken:     csrfToken(w),
 			Repos:         grs,
 			SiteSettings:  GetSiteSettings(db, conf),
 		}
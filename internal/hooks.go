@@ -0,0 +1,382 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"sorcia/models"
+	"sorcia/pkg"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+)
+
+// Environment variables which pass the pusher from receive-pack to the
+// hooks.
+const (
+	hookEnvRepo        = "SORCIA_REPO"
+	hookEnvUserID      = "SORCIA_USER_ID"
+	hookEnvUsername    = "SORCIA_USERNAME"
+	hookEnvDeployKeyID = "SORCIA_DEPLOY_KEY_ID"
+	hookEnvProtocol    = "SORCIA_PROTOCOL"
+	hookEnvNewRepo     = "SORCIA_NEW_REPO"
+)
+
+// HookPusher is who pushes. UserID is 0 for deploy keys and for pushes
+// which didn't go through sorcia.
+type HookPusher struct {
+	UserID      int
+	Username    string
+	DeployKeyID int
+	Protocol    string
+}
+
+// hookEnv adds the repository and the pusher to env for the hooks.
+func hookEnv(env []string, reponame string, pusher HookPusher) []string {
+	return append(env,
+		hookEnvRepo+"="+reponame,
+		hookEnvUserID+"="+strconv.Itoa(pusher.UserID),
+		hookEnvUsername+"="+pusher.Username,
+		hookEnvDeployKeyID+"="+strconv.Itoa(pusher.DeployKeyID),
+		hookEnvProtocol+"="+pusher.Protocol,
+	)
+}
+
+func pusherFromEnv() HookPusher {
+	userID, _ := strconv.Atoi(os.Getenv(hookEnvUserID))
+	deployKeyID, _ := strconv.Atoi(os.Getenv(hookEnvDeployKeyID))
+
+	return HookPusher{
+		UserID:      userID,
+		Username:    os.Getenv(hookEnvUsername),
+		DeployKeyID: deployKeyID,
+		Protocol:    os.Getenv(hookEnvProtocol),
+	}
+}
+
+// ZeroRev is the object name git uses for the old value of created refs and
+// the new value of deleted refs.
+const ZeroRev = "0000000000000000000000000000000000000000"
+
+// RefUpdate is a ref which a push updates.
+type RefUpdate struct {
+	OldRev  string
+	NewRev  string
+	RefName string
+}
+
+// IsCreate reports whether the ref is new.
+func (u RefUpdate) IsCreate() bool {
+	return u.OldRev == ZeroRev
+}
+
+// IsDelete reports whether the ref is deleted.
+func (u RefUpdate) IsDelete() bool {
+	return u.NewRev == ZeroRev
+}
+
+// parseRefUpdates parses the "<old> <new> <ref>" lines given to the
+// pre-receive and post-receive hooks.
+func parseRefUpdates(input []byte) []RefUpdate {
+	var updates []RefUpdate
+
+	scanner := bufio.NewScanner(bytes.NewReader(input))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+
+		updates = append(updates, RefUpdate{OldRev: fields[0], NewRev: fields[1], RefName: fields[2]})
+	}
+
+	return updates
+}
+
+// HookContext is passed to the hook handlers.
+type HookContext struct {
+	DB       *sql.DB
+	Conf     *pkg.BaseStruct
+	Pusher   HookPusher
+	Reponame string
+	RepoDir  string
+	// NewRepo is set if the push created the repository.
+	NewRepo bool
+	stderr  io.Writer
+}
+
+// Message sends a line to the pushing client, which shows it prefixed with
+// "remote:".
+func (hc *HookContext) Message(format string, a ...interface{}) {
+	fmt.Fprintf(hc.stderr, "sorcia: "+format+"\n", a...)
+}
+
+// PreReceiveHandler can reject a whole push by returning an error, its
+// message is sent to the client.
+type PreReceiveHandler func(hc *HookContext, updates []RefUpdate) error
+
+// UpdateHandler can reject the update of a single ref by returning an error.
+type UpdateHandler func(hc *HookContext, update RefUpdate) error
+
+// PostReceiveHandler reacts to a push after all refs are updated.
+type PostReceiveHandler func(hc *HookContext, updates []RefUpdate)
+
+var preReceiveHandlers []PreReceiveHandler
+var updateHandlers []UpdateHandler
+var postReceiveHandlers []PostReceiveHandler
+
+// RegisterPreReceiveHandler adds a handler to the pre-receive hook.
+// Handlers run in the order they are registered.
+func RegisterPreReceiveHandler(h PreReceiveHandler) {
+	preReceiveHandlers = append(preReceiveHandlers, h)
+}
+
+// RegisterUpdateHandler adds a handler to the update hook.
+func RegisterUpdateHandler(h UpdateHandler) {
+	updateHandlers = append(updateHandlers, h)
+}
+
+// RegisterPostReceiveHandler adds a handler to the post-receive hook.
+func RegisterPostReceiveHandler(h PostReceiveHandler) {
+	postReceiveHandlers = append(postReceiveHandlers, h)
+}
+
+func init() {
+	RegisterPostReceiveHandler(generateRefsHook)
+}
+
+// generateRefsHook creates the release archives of pushed tags.
+func generateRefsHook(hc *HookContext, updates []RefUpdate) {
+	for _, u := range updates {
+		if strings.HasPrefix(u.RefName, "refs/tags/") && !u.IsDelete() {
+			pkg.GenerateRefs(hc.Conf.Paths.RefsPath, hc.Conf.Paths.RepoPath, hc.Reponame+".git")
+			return
+		}
+	}
+}
+
+// gitOutput runs git in the repository with the environment of the hook,
+// which gives access to the objects of a push before they are accepted.
+func gitOutput(repoDir string, stdin []byte, args ...string) (string, error) {
+	cmd := exec.Command(pkg.GetGitBinPath(), args...)
+	cmd.Dir = repoDir
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return string(out), nil
+}
+
+// RunHook runs the Go handlers and then the custom script of a hook. It's
+// called by "sorcia hook <name>" from the hooks installed into the
+// repositories and returns the exit status of the hook.
+func RunHook(db *sql.DB, conf *pkg.BaseStruct, name string, args []string) int {
+	repoDir := os.Getenv("GIT_DIR")
+
+	reponame := os.Getenv(hookEnvRepo)
+	if reponame == "" {
+		reponame = strings.TrimSuffix(filepath.Base(repoDir), ".git")
+	}
+
+	hc := &HookContext{
+		DB:       db,
+		Conf:     conf,
+		Pusher:   pusherFromEnv(),
+		Reponame: reponame,
+		RepoDir:  repoDir,
+		NewRepo:  os.Getenv(hookEnvNewRepo) == "1",
+		stderr:   os.Stderr,
+	}
+
+	input, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		hc.Message("cannot read hook input: %v", err)
+		return 1
+	}
+
+	switch name {
+	case "pre-receive":
+		updates := parseRefUpdates(input)
+		for _, h := range preReceiveHandlers {
+			if err := h(hc, updates); err != nil {
+				hc.Message("%v", err)
+				return 1
+			}
+		}
+	case "update":
+		if len(args) != 3 {
+			hc.Message("update hook expects 3 arguments")
+			return 1
+		}
+
+		update := RefUpdate{RefName: args[0], OldRev: args[1], NewRev: args[2]}
+		for _, h := range updateHandlers {
+			if err := h(hc, update); err != nil {
+				hc.Message("%s: %v", update.RefName, err)
+				return 1
+			}
+		}
+	case "post-receive":
+		updates := parseRefUpdates(input)
+		for _, h := range postReceiveHandlers {
+			h(hc, updates)
+		}
+	default:
+		hc.Message("unknown hook %q", name)
+		return 1
+	}
+
+	return runCustomHook(hc, name, args, input)
+}
+
+// runCustomHook runs the custom script of the hook if the repository has
+// one and returns its exit status.
+func runCustomHook(hc *HookContext, name string, args []string, input []byte) int {
+	script := filepath.Join(hc.RepoDir, pkg.CustomHooksDir, name)
+	if _, err := os.Stat(script); os.IsNotExist(err) {
+		return 0
+	}
+
+	cmd := exec.Command(script, args...)
+	cmd.Dir = hc.RepoDir
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = hc.stderr
+	cmd.Stderr = hc.stderr
+
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+
+		hc.Message("cannot run custom %s hook: %v", name, err)
+		return 1
+	}
+
+	return 0
+}
+
+// installGitHooks points the hooks of a bare repository to the running
+// sorcia binary.
+func installGitHooks(repoDir string) {
+	binPath, err := os.Executable()
+	pkg.CheckError("Error on finding sorcia executable", err)
+
+	workDir, err := os.Getwd()
+	pkg.CheckError("Error on getting working directory", err)
+
+	err = pkg.InstallGitHooks(repoDir, binPath, workDir)
+	pkg.CheckError("Error on installing git hooks in "+repoDir, err)
+}
+
+// InstallAllGitHooks installs the hooks into all repositories, so they keep
+// working when the binary or the working directory changes.
+func InstallAllGitHooks(conf *pkg.BaseStruct) {
+	repoDirs, err := filepath.Glob(repoDirectory(conf, "*.git"))
+	pkg.CheckError("Error on listing repositories for git hooks", err)
+
+	for _, repoDir := range repoDirs {
+		installGitHooks(repoDir)
+	}
+}
+
+// CustomHook is a custom hook script of a repository.
+type CustomHook struct {
+	Name   string
+	Field  string
+	Script string
+}
+
+// customHookField is the form field of a hook, "pre-receive" becomes
+// "pre_receive".
+func customHookField(name string) string {
+	return strings.Replace(name, "-", "_", -1)
+}
+
+func readCustomHooks(repoDir string) []CustomHook {
+	var hooks []CustomHook
+
+	for _, name := range pkg.GitHookNames {
+		script, _ := ioutil.ReadFile(filepath.Join(repoDir, pkg.CustomHooksDir, name))
+		hooks = append(hooks, CustomHook{Name: name, Field: customHookField(name), Script: string(script)})
+	}
+
+	return hooks
+}
+
+// PostCustomHooksRequest struct
+type PostCustomHooksRequest struct {
+	PreReceive  string `schema:"pre_receive"`
+	Update      string `schema:"update"`
+	PostReceive string `schema:"post_receive"`
+}
+
+// PostCustomHooks saves the custom hook scripts of a repository. They run
+// on the server with the rights of sorcia, only admins can change them.
+func PostCustomHooks(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct, decoder *schema.Decoder) {
+	reponame := mux.Vars(r)["reponame"]
+
+	if !models.CheckRepoExists(db, reponame) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeHdr(w, http.StatusBadRequest, "ParseForm() err: "+err.Error())
+		return
+	}
+
+	var postCustomHooksRequest = &PostCustomHooksRequest{}
+	err := decoder.Decode(postCustomHooksRequest, r.PostForm)
+	pkg.CheckError("Error on post custom hooks decoder", err)
+
+	scripts := map[string]string{
+		"pre-receive":  postCustomHooksRequest.PreReceive,
+		"update":       postCustomHooksRequest.Update,
+		"post-receive": postCustomHooksRequest.PostReceive,
+	}
+
+	hooksDir := filepath.Join(repoDirectory(conf, reponame+".git"), pkg.CustomHooksDir)
+	err = os.MkdirAll(hooksDir, os.ModePerm)
+	pkg.CheckError("Error on creating custom hooks directory", err)
+
+	for name, script := range scripts {
+		scriptPath := filepath.Join(hooksDir, name)
+
+		// Browsers send textareas with CRLF line endings, which break
+		// the shebang line.
+		script = strings.Replace(script, "\r\n", "\n", -1)
+
+		if strings.TrimSpace(script) == "" {
+			if err := os.Remove(scriptPath); err != nil && !os.IsNotExist(err) {
+				pkg.CheckError("Error on removing custom hook", err)
+			}
+			continue
+		}
+
+		err := ioutil.WriteFile(scriptPath, []byte(script), 0755)
+		pkg.CheckError("Error on writing custom hook", err)
+
+		err = os.Chmod(scriptPath, 0755)
+		pkg.CheckError("Error on custom hook chmod", err)
+	}
+
+	http.Redirect(w, r, "/r/"+reponame+"/settings", http.StatusFound)
+}
@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"database/sql"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"sorcia/models"
+	"sorcia/pkg"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// hostKeyStore holds the host keys the SSH server offers. They're reloaded
+// from ssh_path when a rotation replaces them, without a restart.
+type hostKeyStore struct {
+	sshPath string
+	mu      sync.RWMutex
+	// signers are the current keys by their type, e.g. "ssh-ed25519".
+	signers map[string]gossh.Signer
+}
+
+func readHostKey(path string) (gossh.Signer, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return gossh.ParsePrivateKey(key)
+}
+
+func (hs *hostKeyStore) load() error {
+	signers := make(map[string]gossh.Signer)
+
+	for _, path := range pkg.HostKeyFiles(hs.sshPath) {
+		signer, err := readHostKey(path)
+		if err != nil {
+			return err
+		}
+
+		signers[signer.PublicKey().Type()] = signer
+	}
+
+	hs.mu.Lock()
+	hs.signers = signers
+	hs.mu.Unlock()
+
+	return nil
+}
+
+// serverConfig offers the current host keys on every connection, it's the
+// ServerConfigCallback of the SSH server.
+func (hs *hostKeyStore) serverConfig(ctx ssh.Context) *gossh.ServerConfig {
+	config := &gossh.ServerConfig{}
+
+	hs.mu.RLock()
+	for _, signer := range hs.signers {
+		config.AddHostKey(signer)
+	}
+	hs.mu.RUnlock()
+
+	return config
+}
+
+// promote replaces the host keys once the grace period of a rotation is
+// over. It runs for as long as the SSH server.
+func (hs *hostKeyStore) promote(grace time.Duration) {
+	for {
+		time.Sleep(time.Hour)
+
+		promoted, err := pkg.PromoteHostKeys(hs.sshPath, grace)
+		if err != nil {
+			log.Printf("ssh: cannot replace host keys: %v", err)
+		}
+
+		if promoted {
+			if err := hs.load(); err != nil {
+				log.Printf("ssh: cannot load host keys: %v", err)
+			} else {
+				log.Printf("ssh: host keys replaced by the rotated ones")
+			}
+		}
+	}
+}
+
+// currentHostKey is the current host key of a type. gliderlabs/ssh
+// generates a key unless one is set on the server, this one always matches
+// what serverConfig offers.
+type currentHostKey struct {
+	hs      *hostKeyStore
+	keyType string
+}
+
+func (k currentHostKey) signer() gossh.Signer {
+	k.hs.mu.RLock()
+	defer k.hs.mu.RUnlock()
+
+	return k.hs.signers[k.keyType]
+}
+
+func (k currentHostKey) PublicKey() gossh.PublicKey {
+	return k.signer().PublicKey()
+}
+
+func (k currentHostKey) Sign(rand io.Reader, data []byte) (*gossh.Signature, error) {
+	return k.signer().Sign(rand, data)
+}
+
+// sshHostKeysOption makes the SSH server offer the keys of hs.
+func sshHostKeysOption(hs *hostKeyStore) ssh.Option {
+	return func(srv *ssh.Server) error {
+		srv.ServerConfigCallback = hs.serverConfig
+		srv.HostSigners = []ssh.Signer{currentHostKey{hs: hs, keyType: gossh.KeyAlgoED25519}}
+		return nil
+	}
+}
+
+// HostKey is a host key on the host keys page.
+type HostKey struct {
+	Type        string
+	Fingerprint string
+	// KnownHost is the line for the known_hosts file of OpenSSH.
+	KnownHost string
+}
+
+func hostKeysFromFiles(files []string, knownHost string) []HostKey {
+	var keys []HostKey
+
+	for _, path := range files {
+		signer, err := readHostKey(path)
+		if err != nil {
+			log.Printf("ssh: cannot read host key %s: %v", filepath.Base(path), err)
+			continue
+		}
+
+		publicKey := signer.PublicKey()
+		keys = append(keys, HostKey{
+			Type:        publicKey.Type(),
+			Fingerprint: gossh.FingerprintSHA256(publicKey),
+			KnownHost:   knownHost + " " + strings.TrimSpace(string(gossh.MarshalAuthorizedKey(publicKey))),
+		})
+	}
+
+	return keys
+}
+
+// HostKeysResponse struct
+type HostKeysResponse struct {
+	IsLoggedIn       bool
+	ShowLoginMenu    bool
+	IsAdmin          bool
+	HeaderActiveMenu string
+	SorciaVersion    string
+	CSRFToken        string
+	HostKeys         []HostKey
+	NextHostKeys     []HostKey
+	NextHostKeysFrom string
+	ErrMessage       string
+	SiteSettings     SiteSettings
+}
+
+// GetHostKeys shows the fingerprints of the SSH host keys, so users can
+// check them when they connect for the first time.
+func GetHostKeys(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct) {
+	writeHostKeys(w, r, db, conf, "")
+}
+
+func writeHostKeys(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct, errMessage string) {
+	host := strings.Split(r.Host, ":")[0]
+	knownHost := host
+	if conf.Server.SSHPort != "22" {
+		knownHost = "[" + host + "]:" + conf.Server.SSHPort
+	}
+
+	nextFiles, startedAt := pkg.NextHostKeyFiles(conf.Paths.SSHPath)
+
+	data := HostKeysResponse{
+		IsLoggedIn:       checkUserLoggedIn(w),
+		ShowLoginMenu:    true,
+		IsAdmin:          IsAdminRequest(w, db),
+		HeaderActiveMenu: "",
+		SorciaVersion:    conf.Version,
+		CSRFToken:        csrfToken(w),
+		HostKeys:         hostKeysFromFiles(pkg.HostKeyFiles(conf.Paths.SSHPath), knownHost),
+		NextHostKeys:     hostKeysFromFiles(nextFiles, knownHost),
+		ErrMessage:       errMessage,
+		SiteSettings:     GetSiteSettings(db, conf),
+	}
+	if len(nextFiles) > 0 {
+		data.NextHostKeysFrom = startedAt.Add(conf.SSH.HostKeyGrace).Format("2006-01-02 15:04 MST")
+	}
+
+	layoutPage := filepath.Join(conf.Paths.TemplatePath, "layout.html")
+	headerPage := filepath.Join(conf.Paths.TemplatePath, "header.html")
+	hostKeysPage := filepath.Join(conf.Paths.TemplatePath, "host-keys.html")
+	footerPage := filepath.Join(conf.Paths.TemplatePath, "footer.html")
+
+	tmpl, err := template.ParseFiles(layoutPage, headerPage, hostKeysPage, footerPage)
+	pkg.CheckError("Error on template parse", err)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	tmpl.ExecuteTemplate(w, "layout", data)
+}
+
+// PostRotateHostKeys creates new host keys, which replace the current ones
+// after the grace period. It's only reachable by admins.
+func PostRotateHostKeys(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct) {
+	if err := pkg.RotateHostKeys(conf.Paths.SSHPath); err != nil {
+		writeHostKeys(w, r, db, conf, err.Error())
+		return
+	}
+
+	token := w.Header().Get("sorcia-cookie-token")
+	log.Printf("ssh: host key rotation started by %s", models.GetUsernameFromToken(db, token))
+
+	http.Redirect(w, r, "/ssh-host-keys", http.StatusFound)
+}
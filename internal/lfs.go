@@ -0,0 +1,516 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"sorcia/models"
+	"sorcia/pkg"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// LFS objects are stored in the lfs directory of the bare repository, so
+// they move and get deleted together with it and count towards its size.
+const lfsDir = "lfs"
+
+const lfsContentType = "application/vnd.git-lfs+json"
+
+// lfsTokenLifetime is how long a token of git-lfs-authenticate is valid.
+const lfsTokenLifetime = time.Hour
+
+var lfsOIDPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// lfsPathPattern splits the path of an LFS request into the repository and
+// the LFS endpoint.
+var lfsPathPattern = regexp.MustCompile(`^/r/([^/]+\.git)/info/lfs(/.*)$`)
+
+var lfsRoutes = []struct {
+	rxp     *regexp.Regexp
+	method  string
+	handler func(gh *gitHandler, match []string)
+}{
+	{regexp.MustCompile("^/objects/batch$"), "POST", lfsBatch},
+	{regexp.MustCompile("^/objects/([0-9a-f]{64})$"), "GET", lfsDownload},
+	{regexp.MustCompile("^/objects/([0-9a-f]{64})$"), "PUT", lfsUpload},
+	{regexp.MustCompile("^/locks$"), "GET", lfsListLocks},
+	{regexp.MustCompile("^/locks$"), "POST", lfsCreateLock},
+	{regexp.MustCompile("^/locks/verify$"), "POST", lfsVerifyLocks},
+	{regexp.MustCompile("^/locks/([0-9]+)/unlock$"), "POST", lfsUnlock},
+}
+
+// lfsObjectPath returns where an object is stored, like git-lfs does in the
+// clients: lfs/objects/ab/cd/abcd...
+func lfsObjectPath(repoDir, oid string) string {
+	return filepath.Join(repoDir, lfsDir, "objects", oid[0:2], oid[2:4], oid)
+}
+
+// lfsSize returns the size of the LFS objects of a repository.
+func lfsSize(conf *pkg.BaseStruct, reponame string) int64 {
+	return pkg.DirSize(filepath.Join(repoDirectory(conf, reponame+".git"), lfsDir))
+}
+
+// serveLFS handles the requests of the LFS API below the clone URL of a
+// repository. It returns false for requests which aren't for the LFS API.
+func serveLFS(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct) bool {
+	pathMatch := lfsPathPattern.FindStringSubmatch(r.URL.Path)
+	if pathMatch == nil {
+		return false
+	}
+
+	repoGitName := pathMatch[1]
+
+	gh := &gitHandler{
+		w:           w,
+		r:           r,
+		dir:         repoDirectory(conf, repoGitName),
+		reponame:    strings.TrimSuffix(repoGitName, ".git"),
+		repoGitName: repoGitName,
+		repoPath:    conf.Paths.RepoPath,
+		refsPath:    conf.Paths.RefsPath,
+		db:          db,
+		conf:        conf,
+	}
+
+	for _, route := range lfsRoutes {
+		match := route.rxp.FindStringSubmatch(pathMatch[2])
+		if match == nil || route.method != r.Method {
+			continue
+		}
+
+		route.handler(gh, match)
+		return true
+	}
+
+	lfsError(w, http.StatusNotFound, "Not found")
+	return true
+}
+
+// lfsAuthorize reports whether the request may perform action. Requests
+// carry either a token of git-lfs-authenticate or the same credentials as
+// git over HTTP.
+func (gh *gitHandler) lfsAuthorize(action string) bool {
+	auth := gh.r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "RemoteAuth ") {
+		return gh.processRepoAccess(action, "Please enter your username and password")
+	}
+
+	lt := models.GetLFSToken(gh.db, strings.TrimPrefix(auth, "RemoteAuth "), time.Now().Unix())
+	if lt.RepoID == 0 || lt.RepoID != models.GetRepoIDFromReponame(gh.db, gh.reponame) {
+		return false
+	}
+
+	if action != RepoRead && !lt.CanWrite {
+		return false
+	}
+
+	gh.pusher = HookPusher{UserID: lt.UserID, DeployKeyID: lt.DeployKeyID, Protocol: "ssh"}
+	if lt.UserID != 0 {
+		gh.pusher.Username = models.GetUsernameFromUserID(gh.db, lt.UserID)
+	}
+
+	return true
+}
+
+// lfsNoAccess asks for credentials if the request had none.
+func lfsNoAccess(gh *gitHandler) {
+	if gh.r.Header.Get("Authorization") == "" {
+		gh.w.Header().Set("LFS-Authenticate", `Basic realm="sorcia"`)
+		lfsError(gh.w, http.StatusUnauthorized, "Credentials needed")
+		return
+	}
+
+	lfsError(gh.w, http.StatusForbidden, "The repository cannot be accessed with your credentials.")
+}
+
+func lfsJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", lfsContentType)
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	pkg.CheckError("Error on lfs json encode", err)
+}
+
+func lfsError(w http.ResponseWriter, status int, message string) {
+	lfsJSON(w, status, map[string]string{"message": message})
+}
+
+type lfsObject struct {
+	OID  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+type lfsBatchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers"`
+	Objects   []lfsObject `json:"objects"`
+	HashAlgo  string      `json:"hash_algo"`
+}
+
+type lfsAction struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header,omitempty"`
+	ExpiresIn int               `json:"expires_in,omitempty"`
+}
+
+type lfsObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lfsObjectResponse struct {
+	OID           string               `json:"oid"`
+	Size          int64                `json:"size"`
+	Authenticated bool                 `json:"authenticated,omitempty"`
+	Actions       map[string]lfsAction `json:"actions,omitempty"`
+	Error         *lfsObjectError      `json:"error,omitempty"`
+}
+
+type lfsBatchResponse struct {
+	Transfer string              `json:"transfer"`
+	Objects  []lfsObjectResponse `json:"objects"`
+	HashAlgo string              `json:"hash_algo"`
+}
+
+// lfsBatch tells the client where to upload or download objects. Only the
+// basic transfer is supported.
+func lfsBatch(gh *gitHandler, match []string) {
+	var req lfsBatchRequest
+	if err := json.NewDecoder(gh.r.Body).Decode(&req); err != nil {
+		lfsError(gh.w, http.StatusUnprocessableEntity, "Invalid batch request: "+err.Error())
+		return
+	}
+
+	action := RepoRead
+	switch req.Operation {
+	case "download":
+	case "upload":
+		action = RepoWrite
+	default:
+		lfsError(gh.w, http.StatusUnprocessableEntity, fmt.Sprintf("Unknown operation %q", req.Operation))
+		return
+	}
+
+	if !gh.lfsAuthorize(action) {
+		lfsNoAccess(gh)
+		return
+	}
+
+	if req.HashAlgo != "" && req.HashAlgo != "sha256" {
+		lfsError(gh.w, http.StatusConflict, fmt.Sprintf("Unsupported hash algorithm %q", req.HashAlgo))
+		return
+	}
+
+	basic := len(req.Transfers) == 0
+	for _, transfer := range req.Transfers {
+		basic = basic || transfer == "basic"
+	}
+	if !basic {
+		lfsError(gh.w, http.StatusUnprocessableEntity, "Only the basic transfer is supported")
+		return
+	}
+
+	// Transfers with a token of git-lfs-authenticate need the token as
+	// well, clients send their own credentials for basic auth.
+	var header map[string]string
+	if auth := gh.r.Header.Get("Authorization"); strings.HasPrefix(auth, "RemoteAuth ") {
+		header = map[string]string{"Authorization": auth}
+	}
+
+	var uploadSize int64
+	objects := []lfsObjectResponse{}
+	for _, obj := range req.Objects {
+		or := lfsObjectResponse{OID: obj.OID, Size: obj.Size}
+
+		if !lfsOIDPattern.MatchString(obj.OID) || obj.Size < 0 {
+			or.Error = &lfsObjectError{Code: http.StatusUnprocessableEntity, Message: "Invalid object"}
+			objects = append(objects, or)
+			continue
+		}
+
+		href := fmt.Sprintf("%s/r/%s/info/lfs/objects/%s", getBaseURL(gh.r), gh.repoGitName, obj.OID)
+		fi, err := os.Stat(lfsObjectPath(gh.dir, obj.OID))
+		exists := err == nil && fi.Size() == obj.Size
+
+		if req.Operation == "download" {
+			if exists {
+				or.Authenticated = true
+				or.Actions = map[string]lfsAction{"download": {Href: href, Header: header}}
+			} else {
+				or.Error = &lfsObjectError{Code: http.StatusNotFound, Message: "Object does not exist"}
+			}
+		} else if !exists {
+			or.Authenticated = true
+			or.Actions = map[string]lfsAction{"upload": {Href: href, Header: header}}
+			uploadSize += obj.Size
+		}
+
+		objects = append(objects, or)
+	}
+
+	if uploadSize > 0 {
+		if err := checkUploadQuota(gh.db, gh.conf, gh.reponame, uploadSize); err != nil {
+			lfsError(gh.w, http.StatusInsufficientStorage, "Quota exceeded: "+err.Error())
+			return
+		}
+	}
+
+	lfsJSON(gh.w, http.StatusOK, lfsBatchResponse{Transfer: "basic", Objects: objects, HashAlgo: "sha256"})
+}
+
+func lfsDownload(gh *gitHandler, match []string) {
+	if !gh.lfsAuthorize(RepoRead) {
+		lfsNoAccess(gh)
+		return
+	}
+
+	objectPath := lfsObjectPath(gh.dir, match[1])
+	if _, err := os.Stat(objectPath); err != nil {
+		lfsError(gh.w, http.StatusNotFound, "Object does not exist")
+		return
+	}
+
+	gh.w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(gh.w, gh.r, objectPath)
+}
+
+// lfsUpload stores an object. It's written to a temporary file first and
+// only moved into place if its content matches the object ID.
+func lfsUpload(gh *gitHandler, match []string) {
+	if !gh.lfsAuthorize(RepoWrite) {
+		lfsNoAccess(gh)
+		return
+	}
+
+	oid := match[1]
+	objectPath := lfsObjectPath(gh.dir, oid)
+	if _, err := os.Stat(objectPath); err == nil {
+		gh.w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	size := gh.r.ContentLength
+	if size < 0 {
+		lfsError(gh.w, http.StatusLengthRequired, "Content-Length is required")
+		return
+	}
+
+	if err := checkUploadQuota(gh.db, gh.conf, gh.reponame, size); err != nil {
+		lfsError(gh.w, http.StatusInsufficientStorage, "Quota exceeded: "+err.Error())
+		return
+	}
+
+	tmpDir := filepath.Join(gh.dir, lfsDir, "tmp")
+	err := os.MkdirAll(tmpDir, os.ModePerm)
+	pkg.CheckError("Error on creating lfs tmp directory", err)
+
+	tmp, err := os.Create(filepath.Join(tmpDir, pkg.RandomString(16)))
+	pkg.CheckError("Error on creating lfs tmp file", err)
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(gh.r.Body, size+1))
+	tmp.Close()
+
+	if err != nil {
+		lfsError(gh.w, http.StatusBadRequest, "Upload failed: "+err.Error())
+		return
+	}
+
+	if written != size || hex.EncodeToString(h.Sum(nil)) != oid {
+		lfsError(gh.w, http.StatusUnprocessableEntity, "Content does not match the object ID and size")
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(objectPath), os.ModePerm)
+	pkg.CheckError("Error on creating lfs object directory", err)
+
+	err = os.Rename(tmp.Name(), objectPath)
+	pkg.CheckError("Error on moving lfs object", err)
+
+	gh.w.WriteHeader(http.StatusOK)
+}
+
+type lfsLockOwner struct {
+	Name string `json:"name"`
+}
+
+type lfsLockResponse struct {
+	ID       string       `json:"id"`
+	Path     string       `json:"path"`
+	LockedAt string       `json:"locked_at"`
+	Owner    lfsLockOwner `json:"owner"`
+}
+
+func newLFSLockResponse(lock models.LFSLock) lfsLockResponse {
+	return lfsLockResponse{
+		ID:       strconv.Itoa(lock.ID),
+		Path:     lock.Path,
+		LockedAt: time.Unix(lock.LockedAt, 0).UTC().Format(time.RFC3339),
+		Owner:    lfsLockOwner{Name: lock.Username},
+	}
+}
+
+func newLFSLockResponses(locks []models.LFSLock) []lfsLockResponse {
+	responses := []lfsLockResponse{}
+	for _, lock := range locks {
+		responses = append(responses, newLFSLockResponse(lock))
+	}
+
+	return responses
+}
+
+// lfsLockUser authorizes a request which changes locks. Locks belong to
+// users, so deploy keys can't use them.
+func (gh *gitHandler) lfsLockUser() bool {
+	if !gh.lfsAuthorize(RepoWrite) {
+		lfsNoAccess(gh)
+		return false
+	}
+
+	if gh.pusher.UserID == 0 {
+		lfsError(gh.w, http.StatusForbidden, "Locks can only be used by users")
+		return false
+	}
+
+	return true
+}
+
+func lfsListLocks(gh *gitHandler, match []string) {
+	if !gh.lfsAuthorize(RepoRead) {
+		lfsNoAccess(gh)
+		return
+	}
+
+	id, _ := strconv.Atoi(gh.r.URL.Query().Get("id"))
+	if gh.r.URL.Query().Get("id") != "" && id == 0 {
+		lfsJSON(gh.w, http.StatusOK, map[string]interface{}{"locks": []lfsLockResponse{}})
+		return
+	}
+
+	locks := models.GetLFSLocks(gh.db, models.GetRepoIDFromReponame(gh.db, gh.reponame), gh.r.URL.Query().Get("path"), id)
+	lfsJSON(gh.w, http.StatusOK, map[string]interface{}{"locks": newLFSLockResponses(locks)})
+}
+
+func lfsCreateLock(gh *gitHandler, match []string) {
+	if !gh.lfsLockUser() {
+		return
+	}
+
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(gh.r.Body).Decode(&req); err != nil || req.Path == "" {
+		lfsError(gh.w, http.StatusUnprocessableEntity, "A path is required")
+		return
+	}
+
+	repoID := models.GetRepoIDFromReponame(gh.db, gh.reponame)
+
+	id := models.InsertLFSLock(gh.db, models.LFSLock{RepoID: repoID, Path: req.Path, UserID: gh.pusher.UserID, LockedAt: time.Now().Unix()})
+	if id == 0 {
+		if locks := models.GetLFSLocks(gh.db, repoID, req.Path, 0); len(locks) > 0 {
+			lfsJSON(gh.w, http.StatusConflict, map[string]interface{}{"lock": newLFSLockResponse(locks[0]), "message": "already locked"})
+			return
+		}
+		lfsError(gh.w, http.StatusConflict, "already locked")
+		return
+	}
+
+	locks := models.GetLFSLocks(gh.db, repoID, "", id)
+	lfsJSON(gh.w, http.StatusCreated, map[string]interface{}{"lock": newLFSLockResponse(locks[0])})
+}
+
+// lfsVerifyLocks splits the locks into the ones of the pushing user and the
+// ones of others, which git-lfs checks before a push.
+func lfsVerifyLocks(gh *gitHandler, match []string) {
+	if !gh.lfsLockUser() {
+		return
+	}
+
+	ours := []lfsLockResponse{}
+	theirs := []lfsLockResponse{}
+	for _, lock := range models.GetLFSLocks(gh.db, models.GetRepoIDFromReponame(gh.db, gh.reponame), "", 0) {
+		if lock.UserID == gh.pusher.UserID {
+			ours = append(ours, newLFSLockResponse(lock))
+		} else {
+			theirs = append(theirs, newLFSLockResponse(lock))
+		}
+	}
+
+	lfsJSON(gh.w, http.StatusOK, map[string]interface{}{"ours": ours, "theirs": theirs})
+}
+
+// lfsUnlock removes a lock. Locks of other users can only be removed with
+// force by the owner of the repository.
+func lfsUnlock(gh *gitHandler, match []string) {
+	if !gh.lfsLockUser() {
+		return
+	}
+
+	var req struct {
+		Force bool `json:"force"`
+	}
+	json.NewDecoder(gh.r.Body).Decode(&req)
+
+	repoID := models.GetRepoIDFromReponame(gh.db, gh.reponame)
+	id, _ := strconv.Atoi(match[1])
+
+	locks := models.GetLFSLocks(gh.db, repoID, "", id)
+	if len(locks) == 0 {
+		lfsError(gh.w, http.StatusNotFound, "Lock not found")
+		return
+	}
+
+	lock := locks[0]
+	if lock.UserID != gh.pusher.UserID {
+		if !req.Force {
+			lfsError(gh.w, http.StatusForbidden, fmt.Sprintf("Lock is owned by %s", lock.Username))
+			return
+		}
+
+		if !AuthorizeRepo(gh.db, gh.pusher.UserID, gh.reponame, RepoAdmin) {
+			lfsError(gh.w, http.StatusForbidden, "Only the owner of the repository can remove locks of others")
+			return
+		}
+	}
+
+	models.DeleteLFSLockByID(gh.db, lock.ID, repoID)
+
+	lfsJSON(gh.w, http.StatusOK, map[string]interface{}{"lock": newLFSLockResponse(lock)})
+}
+
+// lfsAuthenticate answers git-lfs-authenticate over SSH with the LFS API
+// URL and a token for it, so the client doesn't need a password.
+func lfsAuthenticate(s ssh.Session, db *sql.DB, conf *pkg.BaseStruct, reponame string, pusher HookPusher, action string) {
+	now := time.Now()
+	token := pkg.RandomString(32)
+
+	models.InsertLFSToken(db, models.LFSToken{
+		Token:       token,
+		RepoID:      models.GetRepoIDFromReponame(db, reponame),
+		UserID:      pusher.UserID,
+		DeployKeyID: pusher.DeployKeyID,
+		CanWrite:    action == RepoWrite,
+		ExpiresAt:   now.Add(lfsTokenLifetime).Unix(),
+	}, now.Unix())
+
+	json.NewEncoder(s).Encode(lfsAction{
+		Href:      fmt.Sprintf("%s/r/%s.git/info/lfs", conf.Server.BaseURL, reponame),
+		Header:    map[string]string{"Authorization": "RemoteAuth " + token},
+		ExpiresIn: int(lfsTokenLifetime.Seconds()),
+	})
+
+	s.Exit(0)
+}
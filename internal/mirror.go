@@ -0,0 +1,532 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sorcia/models"
+	"sorcia/pkg"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+)
+
+func init() {
+	RegisterPreReceiveHandler(pullMirrorHook)
+}
+
+// maxMirrorErrorLength limits the git output kept as the last error.
+const maxMirrorErrorLength = 2000
+
+// mirrorLocks makes sure a mirror isn't synced twice at the same time, e.g.
+// by a push and the schedule.
+var mirrorLocks sync.Map
+
+func lockMirror(key string) func() {
+	mu, _ := mirrorLocks.LoadOrStore(key, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+
+	return mu.(*sync.Mutex).Unlock
+}
+
+// mirrorsSyncing are the mirrors synced in the background, by the key of
+// lockMirror.
+var mirrorsSyncing sync.Map
+
+// syncMirrorInBackground runs run in its own goroutine, so a mirror which
+// hangs until the timeout doesn't hold up others. It does nothing while a
+// background sync of the mirror runs.
+func syncMirrorInBackground(key string, run func()) {
+	if _, running := mirrorsSyncing.LoadOrStore(key, true); running {
+		return
+	}
+
+	go func() {
+		defer mirrorsSyncing.Delete(key)
+		run()
+	}()
+}
+
+// mirrorGit runs git for a mirror with a timeout. The environment refuses
+// transports other than pkg.MirrorGitProtocols and never prompts for
+// credentials.
+func mirrorGit(conf *pkg.BaseStruct, dir string, env []string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Mirror.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, pkg.GetGitBinPath(), args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), append([]string{
+		"GIT_ALLOW_PROTOCOL=" + pkg.MirrorGitProtocols,
+		"GIT_TERMINAL_PROMPT=0",
+	}, env...)...)
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.New("timed out after " + conf.Mirror.Timeout.String())
+	}
+	if err != nil {
+		message := strings.TrimSpace(output.String())
+		if message == "" {
+			message = err.Error()
+		}
+		if len(message) > maxMirrorErrorLength {
+			message = "..." + message[len(message)-maxMirrorErrorLength:]
+		}
+		return errors.New(message)
+	}
+
+	return nil
+}
+
+// mirrorAuthEnv returns the environment which authenticates git against a
+// mirror. Private keys are written to a file in tmpDir for ssh, no other key
+// is used: neither the keys nor the ssh config of the account sorcia runs
+// as. Host keys of ssh mirrors are trusted on first use.
+func mirrorAuthEnv(conf *pkg.BaseStruct, tmpDir, authType, username, password, privateKey string) ([]string, error) {
+	if authType == models.MirrorAuthPassword {
+		// The credentials are passed in the environment, so they don't
+		// show up in the process list. Configuration passed to sorcia the
+		// same way is kept.
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		parameters := "'http.extraheader=Authorization: Basic " + credentials + "'"
+		if inherited := os.Getenv("GIT_CONFIG_PARAMETERS"); inherited != "" {
+			parameters = inherited + " " + parameters
+		}
+		return []string{"GIT_CONFIG_PARAMETERS=" + parameters}, nil
+	}
+
+	knownHosts := filepath.Join(conf.Paths.SSHPath, "mirror_known_hosts")
+	sshCommand := "ssh -F /dev/null -o BatchMode=yes -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new -o UserKnownHostsFile=" + pkg.ShellQuote(knownHosts)
+
+	if authType != models.MirrorAuthKey {
+		return []string{"GIT_SSH_COMMAND=" + sshCommand + " -o IdentityFile=none"}, nil
+	}
+
+	keyPath := filepath.Join(tmpDir, "id")
+	if err := ioutil.WriteFile(keyPath, []byte(privateKey), 0600); err != nil {
+		return nil, err
+	}
+
+	return []string{"GIT_SSH_COMMAND=" + sshCommand + " -i " + pkg.ShellQuote(keyPath)}, nil
+}
+
+// syncPushMirror pushes all refs of the repository to the mirror and records
+// the result.
+func syncPushMirror(db *sql.DB, conf *pkg.BaseStruct, pm models.PushMirror) error {
+	unlock := lockMirror("push-" + strconv.Itoa(pm.ID))
+	defer unlock()
+
+	err := pushToMirror(conf, pm)
+
+	lastError := ""
+	if err != nil {
+		lastError = err.Error()
+		log.Printf("push mirror %s of %s: %v", pm.URL, pm.Reponame, err)
+	}
+	models.UpdatePushMirrorStatus(db, pm.ID, time.Now().Unix(), lastError)
+
+	return err
+}
+
+func pushToMirror(conf *pkg.BaseStruct, pm models.PushMirror) error {
+	tmpDir, err := ioutil.TempDir("", "sorcia-mirror")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	env, err := mirrorAuthEnv(conf, tmpDir, pm.AuthType, pm.Username, pm.Password, pm.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	repoDir := repoDirectory(conf, pm.Reponame+".git")
+
+	return mirrorGit(conf, repoDir, env, "push", "--mirror", "--quiet", pm.URL)
+}
+
+// SyncPushMirrors pushes the repository to all its mirrors. It's called
+// after receive-pack on both transports.
+func SyncPushMirrors(db *sql.DB, conf *pkg.BaseStruct, reponame string) {
+	for _, pm := range models.GetPushMirrorsFromRepoID(db, models.GetRepoIDFromReponame(db, reponame)) {
+		syncPushMirror(db, conf, pm)
+	}
+}
+
+// RunMirrorScheduler syncs the mirrors whose last sync is older than the
+// push_interval or pull_interval of [mirror], each in the background.
+func RunMirrorScheduler(db *sql.DB, conf *pkg.BaseStruct) {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+
+		if conf.Mirror.PullInterval > 0 {
+			for _, pm := range models.GetAllPullMirrors(db) {
+				if now.Sub(time.Unix(pm.LastSyncAt, 0)) >= conf.Mirror.PullInterval {
+					pm := pm
+					syncMirrorInBackground("pull-"+strconv.Itoa(pm.ID), func() { syncPullMirror(db, conf, pm) })
+				}
+			}
+		}
+
+		if conf.Mirror.PushInterval > 0 {
+			for _, pm := range models.GetAllPushMirrors(db) {
+				if now.Sub(time.Unix(pm.LastSyncAt, 0)) >= conf.Mirror.PushInterval {
+					pm := pm
+					syncMirrorInBackground("push-"+strconv.Itoa(pm.ID), func() { syncPushMirror(db, conf, pm) })
+				}
+			}
+		}
+	}
+}
+
+// pullMirrorHook rejects pushes to pull mirrors, the next fetch would
+// overwrite them.
+func pullMirrorHook(hc *HookContext, updates []RefUpdate) error {
+	pm := models.GetPullMirrorFromRepoID(hc.DB, models.GetRepoIDFromReponame(hc.DB, hc.Reponame))
+	if pm.ID != 0 {
+		return fmt.Errorf("%s is a mirror of %s and can't be pushed to", hc.Reponame, pm.URL)
+	}
+
+	return nil
+}
+
+// pullMirrorRefspecs fetch branches and tags only, hosts have other refs like
+// the ones of pull requests.
+var pullMirrorRefspecs = []string{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"}
+
+// syncPullMirror fetches the repository from its mirror and records the
+// result. Release archives are generated for new tags and push mirrors are
+// synced if anything changed, as no hooks run on fetch.
+func syncPullMirror(db *sql.DB, conf *pkg.BaseStruct, pm models.PullMirror) error {
+	unlock := lockMirror("pull-" + strconv.Itoa(pm.ID))
+	defer unlock()
+
+	repoDir := repoDirectory(conf, pm.Reponame+".git")
+	gitPath := pkg.GetGitBinPath()
+	refsArgs := []string{"for-each-ref", "--format=%(objectname) %(refname)"}
+
+	refsBefore := pkg.ForkExec(gitPath, refsArgs, repoDir)
+	tagsBefore, _ := pkg.GetGitTags(repoDir)
+
+	err := fetchFromMirror(conf, repoDir, pm)
+
+	lastError := ""
+	if err != nil {
+		lastError = err.Error()
+		log.Printf("pull mirror %s of %s: %v", pm.URL, pm.Reponame, err)
+	}
+	models.UpdatePullMirrorStatus(db, pm.ID, time.Now().Unix(), lastError)
+
+	if err != nil || pkg.ForkExec(gitPath, refsArgs, repoDir) == refsBefore {
+		return err
+	}
+
+	knownTags := make(map[string]bool)
+	for _, tag := range tagsBefore {
+		knownTags[tag] = true
+	}
+
+	tags, _ := pkg.GetGitTags(repoDir)
+	for _, tag := range tags {
+		if !knownTags[tag] {
+			pkg.GenerateRefs(conf.Paths.RefsPath, conf.Paths.RepoPath, pm.Reponame+".git")
+			break
+		}
+	}
+
+	SyncPushMirrors(db, conf, pm.Reponame)
+
+	return nil
+}
+
+func fetchFromMirror(conf *pkg.BaseStruct, repoDir string, pm models.PullMirror) error {
+	tmpDir, err := ioutil.TempDir("", "sorcia-mirror")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	env, err := mirrorAuthEnv(conf, tmpDir, pm.AuthType, pm.Username, pm.Password, "")
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{"fetch", "--prune", "--quiet", pm.URL}, pullMirrorRefspecs...)
+
+	return mirrorGit(conf, repoDir, env, args...)
+}
+
+// newPullMirror checks the mirror fields of the create repository form.
+func newPullMirror(w http.ResponseWriter, db *sql.DB, createRepoRequest *CreateRepoRequest) (models.PullMirror, error) {
+	pm := models.PullMirror{
+		URL:      strings.TrimSpace(createRepoRequest.MirrorURL),
+		AuthType: models.MirrorAuthNone,
+		Username: strings.TrimSpace(createRepoRequest.MirrorUsername),
+		Password: createRepoRequest.MirrorPassword,
+	}
+
+	kind, err := pkg.MirrorURLKind(pm.URL)
+	if err != nil {
+		return pm, err
+	}
+
+	// Local paths could point to other repositories on this server.
+	if kind == pkg.MirrorURLFile && !IsAdminRequest(w, db) {
+		return pm, errors.New("Only admins can mirror file:// URLs.")
+	}
+
+	if pm.Username != "" || pm.Password != "" {
+		if kind != pkg.MirrorURLHTTP {
+			return pm, errors.New("Username and password only work with http:// and https:// URLs.")
+		}
+		if pm.Username == "" || pm.Password == "" {
+			return pm, errors.New("Please enter both username and password of the mirror, or neither.")
+		}
+		pm.AuthType = models.MirrorAuthPassword
+	}
+
+	return pm, nil
+}
+
+// PullMirror is the pull mirror of a repository on its summary and settings
+// pages.
+type PullMirror struct {
+	URL       string
+	LastSync  string
+	LastError string
+}
+
+func pullMirrorForRepo(db *sql.DB, repoID int) PullMirror {
+	pm := models.GetPullMirrorFromRepoID(db, repoID)
+	if pm.ID == 0 {
+		return PullMirror{}
+	}
+
+	mirror := PullMirror{
+		URL:       pm.URL,
+		LastSync:  "Never",
+		LastError: pm.LastError,
+	}
+	if pm.LastSyncAt != 0 {
+		mirror.LastSync = time.Unix(pm.LastSyncAt, 0).Format("2006-01-02 15:04 MST")
+	}
+
+	return mirror
+}
+
+// PostPullMirrorSync fetches a pull mirror right away.
+func PostPullMirrorSync(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct) {
+	reponame := mux.Vars(r)["reponame"]
+
+	rc := GetRepoContext(r)
+	if !rc.Can(RepoAdmin) {
+		noRepoAccess(w)
+		return
+	}
+
+	// The result shows up on the settings page once the sync is done.
+	if pm := models.GetPullMirrorFromRepoID(db, rc.RepoID); pm.ID != 0 {
+		syncMirrorInBackground("pull-"+strconv.Itoa(pm.ID), func() { syncPullMirror(db, conf, pm) })
+	}
+
+	http.Redirect(w, r, "/r/"+reponame+"/settings", http.StatusFound)
+}
+
+// DeletePullMirror stops mirroring, the repository can be pushed to
+// afterwards.
+func DeletePullMirror(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	reponame := mux.Vars(r)["reponame"]
+
+	rc := GetRepoContext(r)
+	if !rc.Can(RepoAdmin) {
+		noRepoAccess(w)
+		return
+	}
+
+	models.DeletePullMirrorFromRepoID(db, rc.RepoID)
+
+	http.Redirect(w, r, "/r/"+reponame+"/settings", http.StatusFound)
+}
+
+// PushMirror is a push mirror on the repository settings page.
+type PushMirror struct {
+	ID        int
+	URL       string
+	AuthType  string
+	Username  string
+	PublicKey string
+	LastSync  string
+	LastError string
+}
+
+func pushMirrorsForSettings(db *sql.DB, repoID int) []PushMirror {
+	var mirrors []PushMirror
+
+	for _, pm := range models.GetPushMirrorsFromRepoID(db, repoID) {
+		mirror := PushMirror{
+			ID:        pm.ID,
+			URL:       pm.URL,
+			AuthType:  pm.AuthType,
+			Username:  pm.Username,
+			PublicKey: pm.PublicKey,
+			LastSync:  "Never",
+			LastError: pm.LastError,
+		}
+		if pm.LastSyncAt != 0 {
+			mirror.LastSync = time.Unix(pm.LastSyncAt, 0).Format("2006-01-02 15:04 MST")
+		}
+
+		mirrors = append(mirrors, mirror)
+	}
+
+	return mirrors
+}
+
+// PostPushMirrorRequest struct
+type PostPushMirrorRequest struct {
+	URL      string `schema:"url"`
+	AuthType string `schema:"auth_type"`
+	Username string `schema:"username"`
+	Password string `schema:"password"`
+}
+
+// PostPushMirror adds a push mirror to the repository. For key
+// authentication a keypair is generated, its public key has to be allowed
+// to push on the other side.
+func PostPushMirror(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct, decoder *schema.Decoder) {
+	reponame := mux.Vars(r)["reponame"]
+
+	rc := GetRepoContext(r)
+	if !rc.Can(RepoAdmin) {
+		noRepoAccess(w)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeHdr(w, http.StatusBadRequest, "ParseForm() err: "+err.Error())
+		return
+	}
+
+	var postPushMirrorRequest = &PostPushMirrorRequest{}
+	err := decoder.Decode(postPushMirrorRequest, r.PostForm)
+	pkg.CheckError("Error on post push mirror decoder", err)
+
+	mirrorURL := strings.TrimSpace(postPushMirrorRequest.URL)
+
+	kind, err := pkg.MirrorURLKind(mirrorURL)
+	if err != nil {
+		writeRepoSettings(w, r, db, conf, repoSettingsErrors{PushMirror: err.Error()})
+		return
+	}
+
+	// Local paths could point to other repositories on this server.
+	if kind == pkg.MirrorURLFile && !IsAdminRequest(w, db) {
+		writeRepoSettings(w, r, db, conf, repoSettingsErrors{PushMirror: "Only admins can add file:// mirrors."})
+		return
+	}
+
+	if models.CheckPushMirrorExists(db, rc.RepoID, mirrorURL) {
+		writeRepoSettings(w, r, db, conf, repoSettingsErrors{PushMirror: "This repository is already mirrored to this URL."})
+		return
+	}
+
+	pm := models.PushMirror{
+		RepoID:   rc.RepoID,
+		URL:      mirrorURL,
+		AuthType: postPushMirrorRequest.AuthType,
+	}
+
+	switch pm.AuthType {
+	case models.MirrorAuthNone:
+	case models.MirrorAuthPassword:
+		if kind != pkg.MirrorURLHTTP {
+			writeRepoSettings(w, r, db, conf, repoSettingsErrors{PushMirror: "Username and password only work with http:// and https:// URLs."})
+			return
+		}
+
+		pm.Username = strings.TrimSpace(postPushMirrorRequest.Username)
+		pm.Password = postPushMirrorRequest.Password
+		if pm.Username == "" || pm.Password == "" {
+			writeRepoSettings(w, r, db, conf, repoSettingsErrors{PushMirror: "Username and password are required."})
+			return
+		}
+	case models.MirrorAuthKey:
+		if kind != pkg.MirrorURLSSH {
+			writeRepoSettings(w, r, db, conf, repoSettingsErrors{PushMirror: "SSH keys only work with ssh URLs."})
+			return
+		}
+
+		pm.PrivateKey, pm.PublicKey, err = pkg.GenerateSSHKeyPair("sorcia push mirror of " + reponame)
+		pkg.CheckError("Error on generating push mirror key", err)
+	default:
+		writeRepoSettings(w, r, db, conf, repoSettingsErrors{PushMirror: "Please choose how to authenticate."})
+		return
+	}
+
+	models.InsertPushMirror(db, pm)
+
+	http.Redirect(w, r, "/r/"+reponame+"/settings", http.StatusFound)
+}
+
+// PostPushMirrorSync syncs a push mirror right away.
+func PostPushMirrorSync(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct) {
+	vars := mux.Vars(r)
+	reponame := vars["reponame"]
+
+	rc := GetRepoContext(r)
+	if !rc.Can(RepoAdmin) {
+		noRepoAccess(w)
+		return
+	}
+
+	mirrorID, err := strconv.Atoi(vars["mirrorID"])
+	if err != nil {
+		http.Redirect(w, r, "/r/"+reponame+"/settings", http.StatusFound)
+		return
+	}
+
+	// The result shows up on the settings page once the sync is done.
+	if pm := models.GetPushMirrorByID(db, mirrorID, rc.RepoID); pm.ID != 0 {
+		syncMirrorInBackground("push-"+strconv.Itoa(pm.ID), func() { syncPushMirror(db, conf, pm) })
+	}
+
+	http.Redirect(w, r, "/r/"+reponame+"/settings", http.StatusFound)
+}
+
+// DeletePushMirror ...
+func DeletePushMirror(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	vars := mux.Vars(r)
+	reponame := vars["reponame"]
+
+	rc := GetRepoContext(r)
+	if !rc.Can(RepoAdmin) {
+		noRepoAccess(w)
+		return
+	}
+
+	mirrorID, err := strconv.Atoi(vars["mirrorID"])
+	if err == nil {
+		models.DeletePushMirrorByID(db, mirrorID, rc.RepoID)
+	}
+
+	http.Redirect(w, r, "/r/"+reponame+"/settings", http.StatusFound)
+}
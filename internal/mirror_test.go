@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"sorcia/models"
+	"sorcia/pkg"
+)
+
+func runTestGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command(pkg.GetGitBinPath(), args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		"GIT_CONFIG_NOSYSTEM=1", "HOME="+dir,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, output)
+	}
+
+	return string(output)
+}
+
+func testRefs(t *testing.T, repoDir string) string {
+	return runTestGit(t, repoDir, "for-each-ref", "--format=%(objectname) %(refname)")
+}
+
+func TestSyncPushMirror(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "sorcia-mirror-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &pkg.BaseStruct{
+		Paths: pkg.PathsStruct{
+			RepoPath: filepath.Join(dir, "repositories"),
+			SSHPath:  filepath.Join(dir, "ssh"),
+		},
+		Mirror: pkg.MirrorStruct{Timeout: time.Minute},
+	}
+
+	repoDir := repoDirectory(conf, "project.git")
+	mirrorDir := filepath.Join(dir, "mirror.git")
+	workDir := filepath.Join(dir, "work")
+	for _, d := range []string{repoDir, mirrorDir, workDir} {
+		if err := os.MkdirAll(d, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runTestGit(t, repoDir, "init", "--bare", "--quiet")
+	runTestGit(t, mirrorDir, "init", "--bare", "--quiet")
+
+	runTestGit(t, workDir, "init", "--quiet")
+	runTestGit(t, workDir, "commit", "--allow-empty", "--quiet", "-m", "first")
+	runTestGit(t, workDir, "tag", "v1.0")
+	runTestGit(t, workDir, "push", "--quiet", repoDir, "HEAD:refs/heads/master", "HEAD:refs/heads/feature", "v1.0")
+
+	db := newTestDB(t)
+	models.CreatePushMirror(db)
+	ownerID := insertTestUser(t, db, "owner", false)
+	repoID := insertTestRepo(t, db, "project", ownerID, false)
+	models.InsertPushMirror(db, models.PushMirror{RepoID: repoID, URL: "file://" + mirrorDir, AuthType: models.MirrorAuthNone})
+	models.InsertPushMirror(db, models.PushMirror{RepoID: repoID, URL: "ext::sh -c true", AuthType: models.MirrorAuthNone})
+
+	SyncPushMirrors(db, conf, "project")
+
+	if got, want := testRefs(t, mirrorDir), testRefs(t, repoDir); got != want {
+		t.Fatalf("mirror refs:\n%s\nwant:\n%s", got, want)
+	}
+
+	for _, pm := range models.GetPushMirrorsFromRepoID(db, repoID) {
+		if pm.LastSyncAt == 0 {
+			t.Errorf("%s: last sync not recorded", pm.URL)
+		}
+
+		if strings.HasPrefix(pm.URL, "file://") && pm.LastError != "" {
+			t.Errorf("%s: last error %q, want none", pm.URL, pm.LastError)
+		}
+		// Transports which run commands are refused.
+		if strings.HasPrefix(pm.URL, "ext::") && pm.LastError == "" {
+			t.Errorf("%s: pushed, want refused", pm.URL)
+		}
+	}
+
+	// Later pushes are replicated, deleted refs included.
+	runTestGit(t, workDir, "commit", "--allow-empty", "--quiet", "-m", "second")
+	runTestGit(t, workDir, "push", "--quiet", repoDir, "HEAD:refs/heads/master", ":refs/heads/feature")
+
+	var pm models.PushMirror
+	for _, m := range models.GetPushMirrorsFromRepoID(db, repoID) {
+		if strings.HasPrefix(m.URL, "file://") {
+			pm = m
+		}
+	}
+	if err := syncPushMirror(db, conf, pm); err != nil {
+		t.Fatalf("syncPushMirror: %v", err)
+	}
+
+	got := testRefs(t, mirrorDir)
+	if want := testRefs(t, repoDir); got != want {
+		t.Fatalf("mirror refs after second push:\n%s\nwant:\n%s", got, want)
+	}
+	if strings.Contains(got, "refs/heads/feature") {
+		t.Error("deleted branch is still on the mirror")
+	}
+}
+
+func TestMirrorAuthEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sorcia-mirror-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &pkg.BaseStruct{Paths: pkg.PathsStruct{SSHPath: dir}}
+
+	// Without a key of the mirror, ssh must not fall back to the keys of
+	// the account sorcia runs as.
+	env, err := mirrorAuthEnv(conf, dir, models.MirrorAuthNone, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, option := range []string{"-F /dev/null", "IdentitiesOnly=yes", "IdentityFile=none"} {
+		if len(env) != 1 || !strings.Contains(env[0], option) {
+			t.Errorf("environment without a key %q, want %s", env, option)
+		}
+	}
+
+	env, err = mirrorAuthEnv(conf, dir, models.MirrorAuthKey, "", "", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "id")
+	if len(env) != 1 || !strings.Contains(env[0], "IdentitiesOnly=yes") || !strings.Contains(env[0], "-i "+pkg.ShellQuote(keyPath)) || strings.Contains(env[0], "IdentityFile=none") {
+		t.Errorf("environment with a key %q, want only %s", env, keyPath)
+	}
+	if key, err := ioutil.ReadFile(keyPath); err != nil || string(key) != "key" {
+		t.Errorf("key file %q (%v), want the key", key, err)
+	}
+
+	inherited := "'core.autocrlf=false'"
+	os.Setenv("GIT_CONFIG_PARAMETERS", inherited)
+	defer os.Unsetenv("GIT_CONFIG_PARAMETERS")
+
+	env, err = mirrorAuthEnv(conf, dir, models.MirrorAuthPassword, "user", "secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(env) != 1 || !strings.HasPrefix(env[0], "GIT_CONFIG_PARAMETERS="+inherited+" 'http.extraheader=Authorization: Basic ") {
+		t.Errorf("environment with a password %q, want the inherited parameters kept", env)
+	}
+}
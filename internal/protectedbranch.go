@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"sorcia/models"
+	"sorcia/pkg"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+)
+
+func init() {
+	RegisterUpdateHandler(protectedBranchHook)
+}
+
+// matchProtectedBranch returns the rules whose pattern matches the branch.
+// Patterns are globs as understood by path.Match, so "*" doesn't match "/".
+func matchProtectedBranch(rules []models.ProtectedBranch, branch string) []models.ProtectedBranch {
+	var matched []models.ProtectedBranch
+
+	for _, rule := range rules {
+		if ok, _ := path.Match(rule.Pattern, branch); ok {
+			matched = append(matched, rule)
+		}
+	}
+
+	return matched
+}
+
+// isForcePush reports whether the update moves the ref to a commit which
+// doesn't contain the old one.
+func isForcePush(repoDir string, update RefUpdate) bool {
+	if update.IsCreate() || update.IsDelete() {
+		return false
+	}
+
+	cmd := exec.Command(pkg.GetGitBinPath(), "merge-base", "--is-ancestor", update.OldRev, update.NewRev)
+	cmd.Dir = repoDir
+
+	return cmd.Run() != nil
+}
+
+// checkProtectedBranch returns why the pusher may not make the update, or
+// nil if all rules matching the branch allow it.
+func checkProtectedBranch(rules []models.ProtectedBranch, pusher HookPusher, branch string, forcePush bool, update RefUpdate) error {
+	for _, rule := range matchProtectedBranch(rules, branch) {
+		if rule.NoDeletion && update.IsDelete() {
+			return fmt.Errorf("branch %s is protected by rule %q, it cannot be deleted", branch, rule.Pattern)
+		}
+
+		if rule.NoForcePush && forcePush {
+			return fmt.Errorf("branch %s is protected by rule %q, force-pushes are not allowed", branch, rule.Pattern)
+		}
+
+		if len(rule.AllowedUserIDs) > 0 {
+			allowed := false
+			for _, userID := range rule.AllowedUserIDs {
+				if pusher.UserID != 0 && userID == pusher.UserID {
+					allowed = true
+					break
+				}
+			}
+
+			if !allowed {
+				return fmt.Errorf("branch %s is protected by rule %q, you are not allowed to push to it", branch, rule.Pattern)
+			}
+		}
+	}
+
+	return nil
+}
+
+// protectedBranchHook enforces the protected branch rules of the repository
+// on every pushed branch.
+func protectedBranchHook(hc *HookContext, update RefUpdate) error {
+	if !strings.HasPrefix(update.RefName, "refs/heads/") {
+		return nil
+	}
+
+	repo := models.GetRepoFromReponame(hc.DB, hc.Reponame)
+	if repo.ID == 0 {
+		return nil
+	}
+
+	rules := models.GetProtectedBranchesFromRepoID(hc.DB, repo.ID)
+	branch := strings.TrimPrefix(update.RefName, "refs/heads/")
+	if len(matchProtectedBranch(rules, branch)) == 0 {
+		return nil
+	}
+
+	return checkProtectedBranch(rules, hc.Pusher, branch, isForcePush(hc.RepoDir, update), update)
+}
+
+// PostProtectedBranchRequest struct
+type PostProtectedBranchRequest struct {
+	Pattern        string `schema:"pattern"`
+	NoForcePush    string `schema:"no_force_push"`
+	NoDeletion     string `schema:"no_deletion"`
+	AllowedPushers string `schema:"allowed_pushers"`
+}
+
+// parseAllowedPushers resolves a comma or space separated list of
+// usernames.
+func parseAllowedPushers(db *sql.DB, allowedPushers string) ([]int, error) {
+	var userIDs []int
+
+	fields := strings.FieldsFunc(allowedPushers, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	})
+
+	for _, username := range fields {
+		userID := models.GetUserIDFromUsername(db, username)
+		if userID == 0 {
+			return nil, fmt.Errorf("User %s does not exist.", username)
+		}
+
+		userIDs = append(userIDs, userID)
+	}
+
+	return userIDs, nil
+}
+
+// PostProtectedBranch adds a protected branch rule to the repository.
+func PostProtectedBranch(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct, decoder *schema.Decoder) {
+	reponame := mux.Vars(r)["reponame"]
+
+	rc := GetRepoContext(r)
+	if !rc.Can(RepoAdmin) {
+		noRepoAccess(w)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeHdr(w, http.StatusBadRequest, "ParseForm() err: "+err.Error())
+		return
+	}
+
+	var postProtectedBranchRequest = &PostProtectedBranchRequest{}
+	err := decoder.Decode(postProtectedBranchRequest, r.PostForm)
+	pkg.CheckError("Error on post protected branch decoder", err)
+
+	pattern := strings.TrimPrefix(strings.TrimSpace(postProtectedBranchRequest.Pattern), "refs/heads/")
+
+	if err := validateBranchPattern(pattern); err != nil {
+		writeRepoSettings(w, r, db, conf, repoSettingsErrors{ProtectedBranch: err.Error()})
+		return
+	}
+
+	if models.CheckProtectedBranchExists(db, rc.RepoID, pattern) {
+		writeRepoSettings(w, r, db, conf, repoSettingsErrors{ProtectedBranch: "There is already a rule for this pattern."})
+		return
+	}
+
+	userIDs, err := parseAllowedPushers(db, postProtectedBranchRequest.AllowedPushers)
+	if err != nil {
+		writeRepoSettings(w, r, db, conf, repoSettingsErrors{ProtectedBranch: err.Error()})
+		return
+	}
+
+	ipb := models.InsertProtectedBranchStruct{
+		RepoID:         rc.RepoID,
+		Pattern:        pattern,
+		NoForcePush:    postProtectedBranchRequest.NoForcePush != "",
+		NoDeletion:     postProtectedBranchRequest.NoDeletion != "",
+		AllowedUserIDs: userIDs,
+	}
+	models.InsertProtectedBranch(db, ipb)
+
+	http.Redirect(w, r, "/r/"+reponame+"/settings", http.StatusFound)
+}
+
+func validateBranchPattern(pattern string) error {
+	if pattern == "" {
+		return errors.New("Branch pattern is required.")
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return errors.New("Branch pattern is not a valid glob pattern.")
+	}
+
+	return nil
+}
+
+// DeleteProtectedBranch ...
+func DeleteProtectedBranch(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	vars := mux.Vars(r)
+	reponame := vars["reponame"]
+
+	if rc := GetRepoContext(r); rc.Can(RepoAdmin) {
+		ruleID, err := strconv.Atoi(vars["ruleID"])
+		if err == nil {
+			models.DeleteProtectedBranchByID(db, ruleID, rc.RepoID)
+		}
+	}
+
+	http.Redirect(w, r, "/r/"+reponame+"/settings", http.StatusFound)
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"sync"
+
+	"sorcia/models"
+	"sorcia/pkg"
+)
+
+func init() {
+	RegisterPostReceiveHandler(newRepoHook)
+}
+
+// pushCreateMu makes sure two pushes to the same new name don't both create
+// the repository.
+var pushCreateMu sync.Mutex
+
+// canPushToCreate reports whether a push of the user creates the repository:
+// it doesn't exist and the user may create repositories. The error is for
+// the pusher.
+func canPushToCreate(db *sql.DB, conf *pkg.BaseStruct, userID int, reponame string) (bool, error) {
+	if userID == 0 || models.CheckRepoExists(db, reponame) || !models.CheckifUserCanCreateRepo(db, userID) {
+		return false, nil
+	}
+
+	if err := validateReponame(reponame); err != nil {
+		return false, err
+	}
+
+	if err := checkCreateRepoQuota(db, conf, userID); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// pushToCreate creates the repository a user pushes to if canPushToCreate
+// allows it. It's called right before receive-pack runs, so the advertisement
+// of a push doesn't create anything. Repositories created this way are
+// private. It reports whether the repository was created, the error is for
+// the pusher.
+func pushToCreate(db *sql.DB, conf *pkg.BaseStruct, userID int, reponame string) (bool, error) {
+	pushCreateMu.Lock()
+	defer pushCreateMu.Unlock()
+
+	if ok, err := canPushToCreate(db, conf, userID, reponame); !ok {
+		return false, err
+	}
+
+	createRepo(db, conf, models.CreateRepoStruct{
+		Name:      reponame,
+		IsPrivate: 1,
+		UserID:    userID,
+	})
+	log.Printf("user %d created repository %s by pushing", userID, reponame)
+
+	return true, nil
+}
+
+// removePushCreatedRepo removes a repository created by a push unless the
+// push wrote a ref. Aborted and rejected pushes and the probes of large
+// pushes over HTTP write none.
+func removePushCreatedRepo(db *sql.DB, conf *pkg.BaseStruct, reponame string) {
+	pushCreateMu.Lock()
+	defer pushCreateMu.Unlock()
+
+	repoDir := repoDirectory(conf, reponame+".git")
+	if len(gitCommand(repoDir, "for-each-ref", "--count=1")) > 0 {
+		return
+	}
+
+	models.DeleteRepobyReponame(db, reponame)
+	err := os.RemoveAll(repoDir)
+	pkg.CheckError("Error on removing repository directory", err)
+
+	log.Printf("removed repository %s, the push which created it didn't write any ref", reponame)
+}
+
+// newRepoHook tells the pusher where to find a repository created by the
+// push.
+func newRepoHook(hc *HookContext, updates []RefUpdate) {
+	if hc.NewRepo {
+		hc.Message("created the private repository %s at", hc.Reponame)
+		hc.Message("  %s/r/%s", hc.Conf.Server.BaseURL, hc.Reponame)
+	}
+}
@@ -0,0 +1,322 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"sorcia/models"
+	"sorcia/pkg"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+)
+
+// maxPolicyViolations limits the violations listed back to the pusher.
+const maxPolicyViolations = 50
+
+var signedOffByTrailer = regexp.MustCompile(`(?m)^Signed-off-by: .+<.+>\s*$`)
+
+func init() {
+	RegisterPreReceiveHandler(pushPolicyHook)
+}
+
+// pushedCommits returns the commits a push adds to the repository, oldest
+// first.
+func pushedCommits(repoDir string, updates []RefUpdate) ([]string, error) {
+	args := []string{"rev-list", "--reverse"}
+	for _, u := range updates {
+		if !u.IsDelete() {
+			args = append(args, u.NewRev)
+		}
+	}
+
+	if len(args) == 2 {
+		return nil, nil
+	}
+
+	out, err := gitOutput(repoDir, nil, append(args, "--not", "--all")...)
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(out), nil
+}
+
+// pushedFile is a file a commit adds or modifies.
+type pushedFile struct {
+	Commit string
+	Path   string
+	Blob   string
+	Size   int64
+}
+
+// pushedFiles returns the files the commits add or modify with the size of
+// their blobs. Merges are compared to nothing, their changes come with the
+// merged commits.
+func pushedFiles(repoDir string, commits []string) ([]pushedFile, error) {
+	var files []pushedFile
+
+	for _, commit := range commits {
+		out, err := gitOutput(repoDir, nil, "diff-tree", "-r", "--root", "--no-commit-id", "--no-renames", "-z", commit)
+		if err != nil {
+			return nil, err
+		}
+
+		// Records are ":<old mode> <new mode> <old blob> <new blob>
+		// <status>" and the path, separated by NUL.
+		fields := strings.Split(out, "\x00")
+		for i := 0; i+1 < len(fields); i += 2 {
+			meta := strings.Fields(strings.TrimPrefix(fields[i], ":"))
+			if len(meta) != 5 || meta[3] == ZeroRev || meta[1] == "160000" {
+				continue
+			}
+
+			files = append(files, pushedFile{Commit: commit, Path: fields[i+1], Blob: meta[3]})
+		}
+	}
+
+	if len(files) == 0 {
+		return files, nil
+	}
+
+	var blobs bytes.Buffer
+	for _, f := range files {
+		blobs.WriteString(f.Blob + "\n")
+	}
+
+	out, err := gitOutput(repoDir, blobs.Bytes(), "cat-file", "--batch-check=%(objectsize)")
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for i := 0; i < len(files) && scanner.Scan(); i++ {
+		files[i].Size, _ = strconv.ParseInt(scanner.Text(), 10, 64)
+	}
+
+	return files, nil
+}
+
+// splitForbiddenPaths returns the globs of the forbidden_paths setting.
+func splitForbiddenPaths(forbiddenPaths string) []string {
+	var globs []string
+
+	for _, line := range strings.Split(forbiddenPaths, "\n") {
+		if glob := strings.TrimSpace(line); glob != "" {
+			globs = append(globs, glob)
+		}
+	}
+
+	return globs
+}
+
+// matchForbiddenPath tells whether a file path matches a glob. Globs with a
+// trailing slash match directories at any depth, globs without a slash
+// match the file name and other globs match the whole path.
+func matchForbiddenPath(glob, filePath string) bool {
+	if strings.HasSuffix(glob, "/") {
+		dirs := strings.Split(filePath, "/")
+		dirGlob := strings.TrimSuffix(glob, "/")
+		for _, dir := range dirs[:len(dirs)-1] {
+			if ok, _ := path.Match(dirGlob, dir); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !strings.Contains(glob, "/") {
+		ok, _ := path.Match(glob, path.Base(filePath))
+		return ok
+	}
+
+	ok, _ := path.Match(strings.TrimPrefix(glob, "/"), filePath)
+	return ok
+}
+
+// checkPushPolicy returns the violations of the policy by the pushed
+// commits, each prefixed with the abbreviated commit.
+func checkPushPolicy(repoDir string, pp models.PushPolicy, commits []string) ([]string, error) {
+	var violations []string
+
+	if pp.CommitMessageRegex != "" || pp.RequireSignoff {
+		messageRegex, err := regexp.Compile(pp.CommitMessageRegex)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, commit := range commits {
+			message, err := gitOutput(repoDir, nil, "show", "-s", "--format=%B", commit)
+			if err != nil {
+				return nil, err
+			}
+
+			if pp.CommitMessageRegex != "" && !messageRegex.MatchString(message) {
+				violations = append(violations, fmt.Sprintf("%.7s: commit message does not match %q", commit, pp.CommitMessageRegex))
+			}
+
+			if pp.RequireSignoff && !signedOffByTrailer.MatchString(message) {
+				violations = append(violations, fmt.Sprintf("%.7s: commit message has no Signed-off-by trailer", commit))
+			}
+		}
+	}
+
+	globs := splitForbiddenPaths(pp.ForbiddenPaths)
+	if pp.MaxBlobSize > 0 || len(globs) > 0 {
+		files, err := pushedFiles(repoDir, commits)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			if pp.MaxBlobSize > 0 && f.Size > pp.MaxBlobSize {
+				violations = append(violations, fmt.Sprintf("%.7s: %s is %s, the limit is %s", f.Commit, f.Path, pkg.FormatBytes(f.Size), pkg.FormatBytes(pp.MaxBlobSize)))
+			}
+
+			for _, glob := range globs {
+				if matchForbiddenPath(glob, f.Path) {
+					violations = append(violations, fmt.Sprintf("%.7s: %s matches forbidden path %q", f.Commit, f.Path, glob))
+					break
+				}
+			}
+		}
+	}
+
+	return violations, nil
+}
+
+// pushPolicyHook rejects pushes with commits which violate the push policy
+// of the repository and lists every violation.
+func pushPolicyHook(hc *HookContext, updates []RefUpdate) error {
+	repo := models.GetRepoFromReponame(hc.DB, hc.Reponame)
+	if repo.ID == 0 {
+		return nil
+	}
+
+	pp := models.GetPushPolicy(hc.DB, repo.ID)
+	if pp.CommitMessageRegex == "" && pp.MaxBlobSize == 0 && pp.ForbiddenPaths == "" && !pp.RequireSignoff {
+		return nil
+	}
+
+	commits, err := pushedCommits(hc.RepoDir, updates)
+	if err != nil {
+		return err
+	}
+
+	violations, err := checkPushPolicy(hc.RepoDir, pp, commits)
+	if err != nil {
+		return err
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+
+	for i, violation := range violations {
+		if i == maxPolicyViolations {
+			hc.Message("... and %d more", len(violations)-i)
+			break
+		}
+		hc.Message("%s", violation)
+	}
+
+	return fmt.Errorf("push rejected, %d push policy violation(s)", len(violations))
+}
+
+// PostPushPolicyRequest struct
+type PostPushPolicyRequest struct {
+	CommitMessageRegex string `schema:"commit_message_regex"`
+	MaxBlobSizeMB      string `schema:"max_blob_size_mb"`
+	ForbiddenPaths     string `schema:"forbidden_paths"`
+	RequireSignoff     string `schema:"require_signoff"`
+	SecretScanning     string `schema:"secret_scanning"`
+}
+
+// pushPolicyForm fills the push policy form of the settings page.
+func pushPolicyForm(pp models.PushPolicy) PostPushPolicyRequest {
+	form := PostPushPolicyRequest{
+		CommitMessageRegex: pp.CommitMessageRegex,
+		ForbiddenPaths:     pp.ForbiddenPaths,
+		SecretScanning:     pp.SecretScanning,
+	}
+
+	if pp.MaxBlobSize > 0 {
+		mb := strconv.FormatFloat(float64(pp.MaxBlobSize)/1024/1024, 'f', 2, 64)
+		form.MaxBlobSizeMB = strings.TrimSuffix(strings.TrimRight(mb, "0"), ".")
+	}
+
+	if pp.RequireSignoff {
+		form.RequireSignoff = "yes"
+	}
+
+	return form
+}
+
+// PostPushPolicy saves the push policy of the repository.
+func PostPushPolicy(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct, decoder *schema.Decoder) {
+	reponame := mux.Vars(r)["reponame"]
+
+	rc := GetRepoContext(r)
+	if !rc.Can(RepoAdmin) {
+		noRepoAccess(w)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeHdr(w, http.StatusBadRequest, "ParseForm() err: "+err.Error())
+		return
+	}
+
+	var postPushPolicyRequest = &PostPushPolicyRequest{}
+	err := decoder.Decode(postPushPolicyRequest, r.PostForm)
+	pkg.CheckError("Error on post push policy decoder", err)
+
+	messageRegex := strings.TrimSpace(postPushPolicyRequest.CommitMessageRegex)
+	if _, err := regexp.Compile(messageRegex); err != nil {
+		writeRepoSettings(w, r, db, conf, repoSettingsErrors{PushPolicy: "Commit message regex is invalid: " + err.Error()})
+		return
+	}
+
+	var maxBlobSize int64
+	if sizeMB := strings.TrimSpace(postPushPolicyRequest.MaxBlobSizeMB); sizeMB != "" {
+		mb, err := strconv.ParseFloat(sizeMB, 64)
+		if err != nil || mb < 0 {
+			writeRepoSettings(w, r, db, conf, repoSettingsErrors{PushPolicy: "Maximum file size has to be a positive number of MB."})
+			return
+		}
+		maxBlobSize = int64(mb * 1024 * 1024)
+	}
+
+	globs := splitForbiddenPaths(strings.Replace(postPushPolicyRequest.ForbiddenPaths, "\r\n", "\n", -1))
+	for _, glob := range globs {
+		if _, err := path.Match(strings.TrimSuffix(glob, "/"), ""); err != nil {
+			writeRepoSettings(w, r, db, conf, repoSettingsErrors{PushPolicy: fmt.Sprintf("Forbidden path %q is not a valid glob pattern.", glob)})
+			return
+		}
+	}
+
+	secretScanning := postPushPolicyRequest.SecretScanning
+	if secretScanning != pkg.SecretScanOff && secretScanning != pkg.SecretScanWarn && secretScanning != pkg.SecretScanReject {
+		writeRepoSettings(w, r, db, conf, repoSettingsErrors{PushPolicy: "Please choose what happens when secrets are found."})
+		return
+	}
+
+	pp := models.PushPolicy{
+		RepoID:             rc.RepoID,
+		CommitMessageRegex: messageRegex,
+		MaxBlobSize:        maxBlobSize,
+		ForbiddenPaths:     strings.Join(globs, "\n"),
+		RequireSignoff:     postPushPolicyRequest.RequireSignoff != "",
+		SecretScanning:     secretScanning,
+	}
+	models.UpdatePushPolicy(db, pp)
+
+	http.Redirect(w, r, "/r/"+reponame+"/settings", http.StatusFound)
+}
@@ -0,0 +1,304 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"sorcia/models"
+	"sorcia/pkg"
+)
+
+func init() {
+	RegisterPreReceiveHandler(quotaHook)
+}
+
+// QuotaUsage is how much of one quota is used.
+type QuotaUsage struct {
+	Name    string
+	Used    string
+	Limit   string
+	Percent int
+	// Warning is set from warn_percent of the limit on.
+	Warning  bool
+	Exceeded bool
+}
+
+func newQuotaUsage(conf *pkg.BaseStruct, name string, used, limit int64, format func(int64) string) QuotaUsage {
+	qu := QuotaUsage{Name: name, Used: format(used), Limit: format(limit)}
+
+	if limit > 0 {
+		qu.Percent = int(used * 100 / limit)
+		qu.Warning = qu.Percent >= conf.Quota.WarnPercent
+		qu.Exceeded = used >= limit
+	}
+
+	return qu
+}
+
+func formatCount(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+// repoSize returns the size of a repository on disk, including its LFS
+// objects.
+func repoSize(conf *pkg.BaseStruct, reponame string) int64 {
+	return pkg.DirSize(repoDirectory(conf, reponame+".git"))
+}
+
+// userStorage returns the number of repositories a user owns and their size.
+func userStorage(db *sql.DB, conf *pkg.BaseStruct, userID int) (int, int64) {
+	repos := models.GetReposFromUserID(db, userID).Repositories
+
+	var size int64
+	for _, repo := range repos {
+		size += repoSize(conf, repo.Name)
+	}
+
+	return len(repos), size
+}
+
+// userQuotaUsage returns the usage of the quotas which apply to a user.
+func userQuotaUsage(db *sql.DB, conf *pkg.BaseStruct, userID int) []QuotaUsage {
+	repos, size := userStorage(db, conf, userID)
+
+	var usage []QuotaUsage
+	if conf.Quota.MaxReposPerUser > 0 {
+		usage = append(usage, newQuotaUsage(conf, "repositories", int64(repos), int64(conf.Quota.MaxReposPerUser), formatCount))
+	}
+	if conf.Quota.MaxUserSize > 0 {
+		usage = append(usage, newQuotaUsage(conf, "storage", size, conf.Quota.MaxUserSize, pkg.FormatBytes))
+	}
+	if conf.Quota.MaxRepoSize > 0 {
+		for _, repo := range models.GetReposFromUserID(db, userID).Repositories {
+			usage = append(usage, newQuotaUsage(conf, repo.Name, repoSize(conf, repo.Name), conf.Quota.MaxRepoSize, pkg.FormatBytes))
+		}
+	}
+
+	return usage
+}
+
+// checkCreateRepoQuota tells whether a user may create another repository.
+func checkCreateRepoQuota(db *sql.DB, conf *pkg.BaseStruct, userID int) error {
+	repos, size := userStorage(db, conf, userID)
+
+	if conf.Quota.MaxReposPerUser > 0 && repos >= conf.Quota.MaxReposPerUser {
+		return fmt.Errorf("You already own %d repositories, the limit is %d.", repos, conf.Quota.MaxReposPerUser)
+	}
+
+	if conf.Quota.MaxUserSize > 0 && size >= conf.Quota.MaxUserSize {
+		return fmt.Errorf("Your repositories use %s, the limit is %s.", pkg.FormatBytes(size), pkg.FormatBytes(conf.Quota.MaxUserSize))
+	}
+
+	return nil
+}
+
+// checkQuota checks whether an upload of size bytes fits into a repository
+// of repoSize bytes whose owner uses userSize bytes.
+func checkQuota(conf *pkg.BaseStruct, repoSize, userSize, size int64) error {
+	q := conf.Quota
+
+	if q.MaxPushSize > 0 && size > q.MaxPushSize {
+		return fmt.Errorf("upload is %s, the limit is %s", pkg.FormatBytes(size), pkg.FormatBytes(q.MaxPushSize))
+	}
+
+	if q.MaxRepoSize > 0 && repoSize+size > q.MaxRepoSize {
+		return fmt.Errorf("repository would use %s, the limit is %s", pkg.FormatBytes(repoSize+size), pkg.FormatBytes(q.MaxRepoSize))
+	}
+
+	if q.MaxUserSize > 0 && userSize+size > q.MaxUserSize {
+		return fmt.Errorf("repositories of the owner would use %s, the limit is %s", pkg.FormatBytes(userSize+size), pkg.FormatBytes(q.MaxUserSize))
+	}
+
+	return nil
+}
+
+// checkUploadQuota checks whether size more bytes may be stored in a
+// repository, e.g. an LFS object.
+func checkUploadQuota(db *sql.DB, conf *pkg.BaseStruct, reponame string, size int64) error {
+	_, userSize := userStorage(db, conf, models.GetUserIDFromReponame(db, reponame))
+
+	return checkQuota(conf, repoSize(conf, reponame), userSize, size)
+}
+
+// quotaEnv makes receive-pack abort pushes with a pack larger than
+// max_push_size before it's written to disk.
+func quotaEnv(env []string, conf *pkg.BaseStruct) []string {
+	if conf.Quota.MaxPushSize == 0 {
+		return env
+	}
+
+	return append(env, "GIT_CONFIG_PARAMETERS='receive.maxinputsize="+strconv.FormatInt(conf.Quota.MaxPushSize, 10)+"'")
+}
+
+// quotaHook rejects pushes which exceed the quotas. The objects of a push
+// are in the quarantine directory until the push is accepted, so they
+// already count towards the size of the repository.
+func quotaHook(hc *HookContext, updates []RefUpdate) error {
+	q := hc.Conf.Quota
+	if q.MaxPushSize == 0 && q.MaxRepoSize == 0 && q.MaxUserSize == 0 {
+		return nil
+	}
+
+	onlyDeletes := true
+	for _, u := range updates {
+		if !u.IsDelete() {
+			onlyDeletes = false
+		}
+	}
+	if onlyDeletes {
+		return nil
+	}
+
+	var pushSize int64
+	if quarantine := os.Getenv("GIT_QUARANTINE_PATH"); quarantine != "" {
+		pushSize = pkg.DirSize(quarantine)
+	}
+
+	repoSize := pkg.DirSize(hc.RepoDir) - pushSize
+	_, userSize := userStorage(hc.DB, hc.Conf, models.GetUserIDFromReponame(hc.DB, hc.Reponame))
+	userSize -= pushSize
+
+	if err := checkQuota(hc.Conf, repoSize, userSize, pushSize); err != nil {
+		return fmt.Errorf("push rejected, %v", err)
+	}
+
+	for _, qu := range []QuotaUsage{
+		newQuotaUsage(hc.Conf, "repository", repoSize+pushSize, q.MaxRepoSize, pkg.FormatBytes),
+		newQuotaUsage(hc.Conf, "owner", userSize+pushSize, q.MaxUserSize, pkg.FormatBytes),
+	} {
+		if qu.Warning {
+			hc.Message("warning: %s storage is at %d%% of its quota (%s of %s)", qu.Name, qu.Percent, qu.Used, qu.Limit)
+		}
+	}
+
+	return nil
+}
+
+// UserUsage is the storage of a user on the admin usage page.
+type UserUsage struct {
+	Username string
+	Repos    int
+	Size     string
+	Usage    []QuotaUsage
+}
+
+// RepoUsage is the storage of a repository on the admin usage page.
+type RepoUsage struct {
+	Name  string
+	Owner string
+	Size  string
+	// LFSSize is the part of Size used by LFS objects.
+	LFSSize string
+	Usage   QuotaUsage
+}
+
+// byUsage sorts users or repositories by their size, largest first.
+type byUsage struct {
+	users []UserUsage
+	repos []RepoUsage
+	sizes []int64
+}
+
+func (b byUsage) Len() int           { return len(b.sizes) }
+func (b byUsage) Less(i, j int) bool { return b.sizes[i] > b.sizes[j] }
+func (b byUsage) Swap(i, j int) {
+	b.sizes[i], b.sizes[j] = b.sizes[j], b.sizes[i]
+	if b.users != nil {
+		b.users[i], b.users[j] = b.users[j], b.users[i]
+	} else {
+		b.repos[i], b.repos[j] = b.repos[j], b.repos[i]
+	}
+}
+
+// SettingsUsageResponse struct
+type SettingsUsageResponse struct {
+	IsLoggedIn       bool
+	IsAdmin          bool
+	HeaderActiveMenu string
+	SorciaVersion    string
+	CSRFToken        string
+	Username         string
+	Users            []UserUsage
+	Repos            []RepoUsage
+	GitProcesses     GitProcessesUsage
+	SiteSettings     SiteSettings
+}
+
+// GetSettingsUsage shows the storage used by every user and repository,
+// largest first, and the git processes of clients. It's only reachable by
+// admins.
+func GetSettingsUsage(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct) {
+	var repos []RepoUsage
+	var repoSizes []int64
+	sizeByOwner := make(map[int]int64)
+	reposByOwner := make(map[int]int)
+
+	for _, repo := range models.GetAllRepos(db).Repositories {
+		size := repoSize(conf, repo.Name)
+		sizeByOwner[repo.OwnerID] += size
+		reposByOwner[repo.OwnerID]++
+
+		repoSizes = append(repoSizes, size)
+		repos = append(repos, RepoUsage{
+			Name:    repo.Name,
+			Owner:   models.GetUsernameFromUserID(db, repo.OwnerID),
+			Size:    pkg.FormatBytes(size),
+			LFSSize: pkg.FormatBytes(lfsSize(conf, repo.Name)),
+			Usage:   newQuotaUsage(conf, "storage", size, conf.Quota.MaxRepoSize, pkg.FormatBytes),
+		})
+	}
+
+	var users []UserUsage
+	var userSizes []int64
+	for _, user := range models.GetAllUsers(db).Users {
+		userID := models.GetUserIDFromUsername(db, user.Username)
+		uu := UserUsage{
+			Username: user.Username,
+			Repos:    reposByOwner[userID],
+			Size:     pkg.FormatBytes(sizeByOwner[userID]),
+			Usage: []QuotaUsage{
+				newQuotaUsage(conf, "repositories", int64(reposByOwner[userID]), int64(conf.Quota.MaxReposPerUser), formatCount),
+				newQuotaUsage(conf, "storage", sizeByOwner[userID], conf.Quota.MaxUserSize, pkg.FormatBytes),
+			},
+		}
+		userSizes = append(userSizes, sizeByOwner[userID])
+		users = append(users, uu)
+	}
+
+	sort.Sort(byUsage{users: users, sizes: userSizes})
+	sort.Sort(byUsage{repos: repos, sizes: repoSizes})
+
+	layoutPage := filepath.Join(conf.Paths.TemplatePath, "layout.html")
+	headerPage := filepath.Join(conf.Paths.TemplatePath, "header.html")
+	metaPage := filepath.Join(conf.Paths.TemplatePath, "settings-usage.html")
+	footerPage := filepath.Join(conf.Paths.TemplatePath, "footer.html")
+
+	tmpl, err := template.ParseFiles(layoutPage, headerPage, metaPage, footerPage)
+	pkg.CheckError("Error on template parse", err)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	token := w.Header().Get("sorcia-cookie-token")
+
+	data := SettingsUsageResponse{
+		IsLoggedIn:       true,
+		IsAdmin:          true,
+		HeaderActiveMenu: "meta",
+		SorciaVersion:    conf.Version,
+		CSRFToken:        csrfToken(w),
+		Username:         models.GetUsernameFromToken(db, token),
+		Users:            users,
+		Repos:            repos,
+		GitProcesses:     gitLimits.usage(conf),
+		SiteSettings:     GetSiteSettings(db, conf),
+	}
+
+	tmpl.ExecuteTemplate(w, "layout", data)
+}
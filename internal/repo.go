@@ -3,6 +3,7 @@ package internal
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
@@ -25,6 +26,7 @@ type GetCreateRepoResponse struct {
 	HeaderActiveMenu   string
 	ReponameErrMessage string
 	SorciaVersion      string
+	CSRFToken          string
 	SiteSettings       SiteSettings
 }
 
@@ -55,6 +57,7 @@ func GetCreateRepo(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg
 			IsLoggedIn:       true,
 			HeaderActiveMenu: "",
 			SorciaVersion:    conf.Version,
+			CSRFToken:        csrfToken(w),
 			SiteSettings:     GetSiteSettings(db, conf),
 		}
 
@@ -69,6 +72,10 @@ type CreateRepoRequest struct {
 	Name        string `schema:"name"`
 	Description string `schema:"description"`
 	IsPrivate   string `schema:"is_private"`
+	// The repository is a pull mirror if MirrorURL is set.
+	MirrorURL      string `schema:"mirror_url"`
+	MirrorUsername string `schema:"mirror_username"`
+	MirrorPassword string `schema:"mirror_password"`
 }
 
 // PostCreateRepo ...
@@ -102,51 +109,22 @@ func PostCreateRepo(w http.ResponseWriter, r *http.Request, db *sql.DB, decoder
 		err := decoder.Decode(createRepoRequest, r.PostForm)
 		pkg.CheckError("Error on post create repo decoder", err)
 
-		s := createRepoRequest.Name
-		if len(s) > 100 || len(s) < 1 {
-			layoutPage := filepath.Join(conf.Paths.TemplatePath, "layout.html")
-			headerPage := filepath.Join(conf.Paths.TemplatePath, "header.html")
-			createRepoPage := filepath.Join(conf.Paths.TemplatePath, "create-repo.html")
-			footerPage := filepath.Join(conf.Paths.TemplatePath, "footer.html")
-
-			tmpl, err := template.ParseFiles(layoutPage, headerPage, createRepoPage, footerPage)
-			pkg.CheckError("Error on template parse", err)
-
-			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			w.WriteHeader(http.StatusOK)
-
-			data := GetCreateRepoResponse{
-				IsLoggedIn:         true,
-				HeaderActiveMenu:   "",
-				ReponameErrMessage: "Repository name is too long (maximum is 100 characters).",
-				SorciaVersion:      conf.Version,
-				SiteSettings:       GetSiteSettings(db, conf),
-			}
-
-			tmpl.ExecuteTemplate(w, "layout", data)
+		if err := validateReponame(createRepoRequest.Name); err != nil {
+			writeCreateRepoError(w, db, conf, err.Error())
 			return
-		} else if strings.HasPrefix(s, "-") || strings.Contains(s, "--") || strings.HasSuffix(s, "-") || !pkg.IsAlnumOrHyphen(s) {
-			layoutPage := filepath.Join(conf.Paths.TemplatePath, "layout.html")
-			headerPage := filepath.Join(conf.Paths.TemplatePath, "header.html")
-			createRepoPage := filepath.Join(conf.Paths.TemplatePath, "create-repo.html")
-			footerPage := filepath.Join(conf.Paths.TemplatePath, "footer.html")
-
-			tmpl, err := template.ParseFiles(layoutPage, headerPage, createRepoPage, footerPage)
-			pkg.CheckError("Error on template parse", err)
+		}
 
-			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			w.WriteHeader(http.StatusOK)
+		if err := checkCreateRepoQuota(db, conf, userID); err != nil {
+			writeCreateRepoError(w, db, conf, err.Error())
+			return
+		}
 
-			data := GetCreateRepoResponse{
-				IsLoggedIn:         true,
-				HeaderActiveMenu:   "",
-				ReponameErrMessage: "Repository name may only contain alphanumeric characters or single hyphens, and cannot begin or end with a hyphen.",
-				SorciaVersion:      conf.Version,
-				SiteSettings:       GetSiteSettings(db, conf),
+		var pullMirror models.PullMirror
+		if createRepoRequest.MirrorURL != "" {
+			if pullMirror, err = newPullMirror(w, db, createRepoRequest); err != nil {
+				writeCreateRepoError(w, db, conf, err.Error())
+				return
 			}
-
-			tmpl.ExecuteTemplate(w, "layout", data)
-			return
 		}
 
 		var isPrivate int
@@ -161,14 +139,15 @@ func PostCreateRepo(w http.ResponseWriter, r *http.Request, db *sql.DB, decoder
 			UserID:      userID,
 		}
 
-		models.InsertRepo(db, crs)
-
-		// Create Git bare repository
-		bareRepoDir := filepath.Join(conf.Paths.RepoPath, createRepoRequest.Name+".git")
-		gitPath := pkg.GetGitBinPath()
+		createRepo(db, conf, crs)
 
-		args := []string{"init", "--bare", bareRepoDir}
-		_ = pkg.ForkExec(gitPath, args, ".")
+		// The first fetch can take a while, the summary page shows when
+		// it's done.
+		if pullMirror.URL != "" {
+			pullMirror.RepoID = models.GetRepoIDFromReponame(db, createRepoRequest.Name)
+			models.InsertPullMirror(db, pullMirror)
+			go syncPullMirror(db, conf, models.GetPullMirrorFromRepoID(db, pullMirror.RepoID))
+		}
 
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
@@ -177,35 +156,100 @@ func PostCreateRepo(w http.ResponseWriter, r *http.Request, db *sql.DB, decoder
 	http.Redirect(w, r, "/login", http.StatusFound)
 }
 
+// validateReponame checks the name of a new repository.
+func validateReponame(s string) error {
+	if s == "" {
+		return errors.New("Repository name is required.")
+	} else if len(s) > 100 {
+		return errors.New("Repository name is too long (maximum is 100 characters).")
+	} else if strings.HasPrefix(s, "-") || strings.Contains(s, "--") || strings.HasSuffix(s, "-") || !pkg.IsAlnumOrHyphen(s) {
+		return errors.New("Repository name may only contain alphanumeric characters or single hyphens, and cannot begin or end with a hyphen.")
+	}
+
+	return nil
+}
+
+// createRepo adds the repository to the database and creates its bare
+// repository with the hooks of sorcia.
+func createRepo(db *sql.DB, conf *pkg.BaseStruct, crs models.CreateRepoStruct) {
+	models.InsertRepo(db, crs)
+
+	// Create Git bare repository
+	bareRepoDir := repoDirectory(conf, crs.Name+".git")
+	gitPath := pkg.GetGitBinPath()
+
+	args := []string{"init", "--bare", bareRepoDir}
+	_ = pkg.ForkExec(gitPath, args, ".")
+	installGitHooks(bareRepoDir)
+}
+
+// writeCreateRepoError renders the create repository page with an error.
+func writeCreateRepoError(w http.ResponseWriter, db *sql.DB, conf *pkg.BaseStruct, errMessage string) {
+	layoutPage := filepath.Join(conf.Paths.TemplatePath, "layout.html")
+	headerPage := filepath.Join(conf.Paths.TemplatePath, "header.html")
+	createRepoPage := filepath.Join(conf.Paths.TemplatePath, "create-repo.html")
+	footerPage := filepath.Join(conf.Paths.TemplatePath, "footer.html")
+
+	tmpl, err := template.ParseFiles(layoutPage, headerPage, createRepoPage, footerPage)
+	pkg.CheckError("Error on template parse", err)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	data := GetCreateRepoResponse{
+		IsLoggedIn:         true,
+		HeaderActiveMenu:   "",
+		ReponameErrMessage: errMessage,
+		SorciaVersion:      conf.Version,
+		CSRFToken:          csrfToken(w),
+		SiteSettings:       GetSiteSettings(db, conf),
+	}
+
+	tmpl.ExecuteTemplate(w, "layout", data)
+}
+
 // GetRepoResponse struct
 type GetRepoResponse struct {
-	SiteSettings       SiteSettings
-	SiteStyle          string
-	IsLoggedIn         bool
-	ShowLoginMenu      bool
-	HeaderActiveMenu   string
-	SorciaVersion      string
-	Username           string
-	RepoUserAddError   string
-	Reponame           string
-	ReponameErrMessage string
-	RepoDescription    string
-	IsRepoPrivate      bool
-	RepoAccess         bool
-	RepoPermission     string
-	RepoEmpty          bool
-	RepoMembers        models.GetRepoMembersStruct
-	Host               string
-	SSHClone           string
-	TotalCommits       string
-	TotalRefs          int
-	RepoDetail         RepoDetail
-	RepoBranches       []string
-	IsRepoBranch       bool
-	RepoLogs           RepoLogs
-	CommitDetail       CommitDetailStruct
-	RepoRefs           []Refs
-	Contributors       Contributors
+	SiteSettings              SiteSettings
+	SiteStyle                 string
+	IsLoggedIn                bool
+	ShowLoginMenu             bool
+	HeaderActiveMenu          string
+	SorciaVersion             string
+	CSRFToken                 string
+	Username                  string
+	RepoUserAddError          string
+	Reponame                  string
+	ReponameErrMessage        string
+	RepoDescription           string
+	IsRepoPrivate             bool
+	RepoAccess                bool
+	RepoPermission            string
+	RepoEmpty                 bool
+	RepoMembers               models.GetRepoMembersStruct
+	DeployKeys                []models.DeployKey
+	DeployKeyErrMessage       string
+	ProtectedBranches         []models.ProtectedBranch
+	ProtectedBranchErrMessage string
+	PushPolicy                PostPushPolicyRequest
+	PushPolicyErrMessage      string
+	PushMirrors               []PushMirror
+	PushMirrorErrMessage      string
+	PullMirror                PullMirror
+	IsAdmin                   bool
+	CustomHooks               []CustomHook
+	Host                      string
+	SSHClone                  string
+	GitDaemonClone            string
+	TotalCommits              string
+	TotalRefs                 int
+	RepoDetail                RepoDetail
+	RepoBranches              []string
+	IsRepoBranch              bool
+	RepoLogs                  RepoLogs
+	CommitDetail              CommitDetailStruct
+	RepoRefs                  []Refs
+	Contributors              Contributors
 }
 
 // RepoDetail struct
@@ -239,13 +283,14 @@ type RepoFileDetail struct {
 
 // RepoLog struct
 type RepoLog struct {
-	FullHash string
-	Hash     string
-	Author   string
-	Date     string
-	Message  string
-	DP       string
-	Branch   string
+	FullHash  string
+	Hash      string
+	Author    string
+	Date      string
+	Message   string
+	DP        string
+	Branch    string
+	Signature SignatureStatus
 }
 
 func checkUserLoggedIn(w http.ResponseWriter) bool {
@@ -265,49 +310,28 @@ func GetRepo(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseS
 
 	repoDir := filepath.Join(conf.Paths.RepoPath, reponame+".git")
 
-	if repoExists := models.CheckRepoExists(db, reponame); !repoExists {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
-	userPresent := w.Header().Get("user-present")
-	var loggedInUserID int
-	if userPresent == "true" {
-		token := w.Header().Get("sorcia-cookie-token")
-		loggedInUserID = models.GetUserIDFromToken(db, token)
-	}
+	rc := GetRepoContext(r)
 
 	userID := models.GetUserIDFromReponame(db, reponame)
 	username := models.GetUsernameFromUserID(db, userID)
-	repoDescription := models.GetRepoDescriptionFromRepoName(db, reponame)
 	totalCommits := pkg.GetCommitCounts(conf.Paths.RepoPath, reponame)
 
-	var permission string
-	if models.CheckRepoOwnerFromUserIDAndReponame(db, loggedInUserID, reponame) {
-		permission = "read/write"
-	} else {
-		permission = models.GetRepoMemberPermissionFromUserIDAndRepoID(db, loggedInUserID, models.GetRepoIDFromReponame(db, reponame))
-	}
-
 	data := GetRepoResponse{
 		SiteSettings:     GetSiteSettings(db, conf),
 		IsLoggedIn:       checkUserLoggedIn(w),
 		ShowLoginMenu:    true,
 		HeaderActiveMenu: "",
 		SorciaVersion:    conf.Version,
+		CSRFToken:        csrfToken(w),
 		Username:         username,
 		Reponame:         reponame,
-		RepoDescription:  repoDescription,
-		IsRepoPrivate:    models.GetRepoType(db, reponame),
-		RepoAccess:       models.CheckRepoOwnerFromUserIDAndReponame(db, loggedInUserID, reponame),
-		RepoPermission:   permission,
+		RepoDescription:  rc.Description,
+		IsRepoPrivate:    rc.IsPrivate,
+		RepoAccess:       rc.Can(RepoAdmin),
+		RepoPermission:   rc.Permission,
 		Host:             r.Host,
 		TotalCommits:     totalCommits,
-	}
-
-	if !data.IsLoggedIn && data.IsRepoPrivate {
-		http.Redirect(w, r, "/login", http.StatusFound)
-		return
+		PullMirror:       pullMirrorForRepo(db, rc.RepoID),
 	}
 
 	if strings.Contains(r.Host, ":") || conf.Server.SSHPort != "22" {
@@ -318,6 +342,15 @@ func GetRepo(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseS
 		data.SSHClone = fmt.Sprintf("git@%s:%s.git", r.Host, reponame)
 	}
 
+	// The git daemon only serves public repositories.
+	if conf.Server.GitDaemonPort != "" && !rc.IsPrivate {
+		host := strings.Split(r.Host, ":")[0]
+		if conf.Server.GitDaemonPort != "9418" {
+			host += ":" + conf.Server.GitDaemonPort
+		}
+		data.GitDaemonClone = fmt.Sprintf("git://%s/%s.git", host, reponame)
+	}
+
 	if totalCommits == "" {
 		data.RepoEmpty = true
 	}
@@ -354,34 +387,26 @@ func processREADME(repoPath string) template.HTML {
 
 // GetRepoSettings ...
 func GetRepoSettings(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct) {
-	vars := mux.Vars(r)
-	reponame := vars["reponame"]
-
-	if repoExists := models.CheckRepoExists(db, reponame); !repoExists {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
+	writeRepoSettings(w, r, db, conf, repoSettingsErrors{})
+}
 
-	userPresent := w.Header().Get("user-present")
-	var loggedInUserID int
-	var token string
-	if userPresent == "true" {
-		token = w.Header().Get("sorcia-cookie-token")
-		loggedInUserID = models.GetUserIDFromToken(db, token)
-	}
+// repoSettingsErrors are the error messages of the forms on the repository
+// settings page.
+type repoSettingsErrors struct {
+	DeployKey       string
+	ProtectedBranch string
+	PushPolicy      string
+	PushMirror      string
+}
 
-	username := models.GetUsernameFromToken(db, token)
-	repoDescription := models.GetRepoDescriptionFromRepoName(db, reponame)
-	repoID := models.GetRepoIDFromReponame(db, reponame)
+func writeRepoSettings(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct, errs repoSettingsErrors) {
+	vars := mux.Vars(r)
+	reponame := vars["reponame"]
 
-	grms := models.GetRepoMembers(db, repoID)
+	rc := GetRepoContext(r)
 
-	var permission string
-	if models.CheckRepoOwnerFromUserIDAndReponame(db, loggedInUserID, reponame) {
-		permission = "read/write"
-	} else {
-		permission = models.GetRepoMemberPermissionFromUserIDAndRepoID(db, loggedInUserID, models.GetRepoIDFromReponame(db, reponame))
-	}
+	username := models.GetUsernameFromUserID(db, rc.UserID)
+	grms := models.GetRepoMembers(db, rc.RepoID)
 
 	data := GetRepoResponse{
 		SiteSettings:     GetSiteSettings(db, conf),
@@ -389,18 +414,32 @@ func GetRepoSettings(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *p
 		ShowLoginMenu:    true,
 		HeaderActiveMenu: "",
 		SorciaVersion:    conf.Version,
+		CSRFToken:        csrfToken(w),
 		Username:         username,
 		Reponame:         reponame,
-		RepoDescription:  repoDescription,
-		IsRepoPrivate:    models.GetRepoType(db, reponame),
-		RepoAccess:       models.CheckRepoOwnerFromUserIDAndReponame(db, loggedInUserID, reponame),
-		RepoPermission:   permission,
+		RepoDescription:  rc.Description,
+		IsRepoPrivate:    rc.IsPrivate,
+		RepoAccess:       rc.Can(RepoAdmin),
+		RepoPermission:   rc.Permission,
 		RepoMembers:      grms,
+		PullMirror:       pullMirrorForRepo(db, rc.RepoID),
 	}
 
-	if !data.IsLoggedIn && data.IsRepoPrivate {
-		http.Redirect(w, r, "/login", http.StatusFound)
-		return
+	if rc.Can(RepoAdmin) {
+		data.DeployKeys = models.GetDeployKeysFromRepoID(db, rc.RepoID)
+		data.DeployKeyErrMessage = errs.DeployKey
+		data.ProtectedBranches = models.GetProtectedBranchesFromRepoID(db, rc.RepoID)
+		data.ProtectedBranchErrMessage = errs.ProtectedBranch
+		data.PushPolicy = pushPolicyForm(models.GetPushPolicy(db, rc.RepoID))
+		data.PushPolicyErrMessage = errs.PushPolicy
+		data.PushMirrors = pushMirrorsForSettings(db, rc.RepoID)
+		data.PushMirrorErrMessage = errs.PushMirror
+	}
+
+	// Custom hooks run arbitrary code on the server.
+	if IsAdminRequest(w, db) {
+		data.IsAdmin = true
+		data.CustomHooks = readCustomHooks(repoDirectory(conf, reponame+".git"))
 	}
 
 	if pkg.GetCommitCounts(conf.Paths.RepoPath, reponame) == "" {
@@ -418,11 +457,7 @@ func PostRepoSettingsDelete(w http.ResponseWriter, r *http.Request, db *sql.DB,
 	reponame := vars["reponame"]
 
 	if userPresent == "true" {
-		token := w.Header().Get("sorcia-cookie-token")
-		userID := models.GetUserIDFromToken(db, token)
-		// username := models.GetUsernameFromToken(db, token)
-
-		if models.CheckRepoOwnerFromUserIDAndReponame(db, userID, reponame) {
+		if GetRepoContext(r).Can(RepoAdmin) {
 			models.DeleteRepobyReponame(db, reponame)
 			refsPattern := filepath.Join(conf.Paths.RefsPath, reponame+"*")
 
@@ -449,6 +484,10 @@ type PostRepoSettingsStruct struct {
 	Name        string `schema:"name"`
 	Description string `schema:"description"`
 	IsPrivate   string `schema:"is_private"`
+	// The repository is a pull mirror if MirrorURL is set.
+	MirrorURL      string `schema:"mirror_url"`
+	MirrorUsername string `schema:"mirror_username"`
+	MirrorPassword string `schema:"mirror_password"`
 }
 
 // PostRepoSettings ...
@@ -458,8 +497,8 @@ func PostRepoSettings(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *
 	reponame := vars["reponame"]
 
 	if userPresent == "true" {
+		rc := GetRepoContext(r)
 		token := w.Header().Get("sorcia-cookie-token")
-		userID := models.GetUserIDFromToken(db, token)
 		username := models.GetUsernameFromToken(db, token)
 
 		if err := r.ParseForm(); err != nil {
@@ -500,12 +539,13 @@ func PostRepoSettings(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *
 				ShowLoginMenu:      true,
 				HeaderActiveMenu:   "",
 				SorciaVersion:      conf.Version,
+				CSRFToken:          csrfToken(w),
 				Username:           username,
 				Reponame:           reponame,
 				ReponameErrMessage: "Repository name is too long (maximum is 100 characters).",
-				RepoDescription:    models.GetRepoDescriptionFromRepoName(db, reponame),
-				IsRepoPrivate:      models.GetRepoType(db, reponame),
-				RepoAccess:         models.CheckRepoOwnerFromUserIDAndReponame(db, userID, reponame),
+				RepoDescription:    rc.Description,
+				IsRepoPrivate:      rc.IsPrivate,
+				RepoAccess:         rc.Can(RepoAdmin),
 			}
 
 			tmpl.ExecuteTemplate(w, "layout", data)
@@ -528,12 +568,13 @@ func PostRepoSettings(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *
 				ShowLoginMenu:      true,
 				HeaderActiveMenu:   "",
 				SorciaVersion:      conf.Version,
+				CSRFToken:          csrfToken(w),
 				Username:           username,
 				Reponame:           reponame,
 				ReponameErrMessage: "Repository name may only contain alphanumeric characters or single hyphens, and cannot begin or end with a hyphen.",
-				RepoDescription:    models.GetRepoDescriptionFromRepoName(db, reponame),
-				IsRepoPrivate:      models.GetRepoType(db, reponame),
-				RepoAccess:         models.CheckRepoOwnerFromUserIDAndReponame(db, userID, reponame),
+				RepoDescription:    rc.Description,
+				IsRepoPrivate:      rc.IsPrivate,
+				RepoAccess:         rc.Can(RepoAdmin),
 			}
 
 			tmpl.ExecuteTemplate(w, "layout", data)
@@ -545,9 +586,9 @@ func PostRepoSettings(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *
 			isPrivate = 1
 		}
 
-		if models.CheckRepoOwnerFromUserIDAndReponame(db, userID, reponame) == true {
+		if rc.Can(RepoAdmin) {
 			urs := models.UpdateRepoStruct{
-				RepoID:      models.GetRepoIDFromReponame(db, reponame),
+				RepoID:      rc.RepoID,
 				NewName:     postRepoSettingsStruct.Name,
 				Description: postRepoSettingsStruct.Description,
 				IsPrivate:   isPrivate,
@@ -582,13 +623,9 @@ func RemoveRepoSettingsUser(w http.ResponseWriter, r *http.Request, db *sql.DB,
 	username := vars["username"]
 
 	if userPresent == "true" {
-		token := w.Header().Get("sorcia-cookie-token")
-		loggedInUserID := models.GetUserIDFromToken(db, token)
-
-		if models.CheckRepoOwnerFromUserIDAndReponame(db, loggedInUserID, reponame) {
+		if rc := GetRepoContext(r); rc.Can(RepoAdmin) {
 			userIDToRemove := models.GetUserIDFromUsername(db, username)
-			repoID := models.GetRepoIDFromReponame(db, reponame)
-			models.RemoveRepoMember(db, userIDToRemove, repoID)
+			models.RemoveRepoMember(db, userIDToRemove, rc.RepoID)
 
 			http.Redirect(w, r, "/r/"+reponame+"/settings", http.StatusFound)
 			return
@@ -610,6 +647,12 @@ func PostRepoSettingsUser(w http.ResponseWriter, r *http.Request, db *sql.DB, co
 	reponame := vars["reponame"]
 
 	if userPresent == "true" {
+		rc := GetRepoContext(r)
+		if !rc.Can(RepoAdmin) {
+			noRepoAccess(w)
+			return
+		}
+
 		token := w.Header().Get("sorcia-cookie-token")
 		username := models.GetUsernameFromToken(db, token)
 
@@ -642,11 +685,12 @@ func PostRepoSettingsUser(w http.ResponseWriter, r *http.Request, db *sql.DB, co
 			ShowLoginMenu:    true,
 			HeaderActiveMenu: "",
 			SorciaVersion:    conf.Version,
+			CSRFToken:        csrfToken(w),
 			Username:         username,
 			Reponame:         reponame,
-			RepoDescription:  models.GetRepoDescriptionFromRepoName(db, reponame),
-			IsRepoPrivate:    models.GetRepoType(db, reponame),
-			RepoAccess:       models.CheckRepoOwnerFromUserIDAndReponame(db, models.GetUserIDFromUsername(db, username), reponame),
+			RepoDescription:  rc.Description,
+			IsRepoPrivate:    rc.IsPrivate,
+			RepoAccess:       rc.Can(RepoAdmin),
 		}
 
 		var postRepoSettingsMember = &PostRepoSettingsMember{}
@@ -654,9 +698,9 @@ func PostRepoSettingsUser(w http.ResponseWriter, r *http.Request, db *sql.DB, co
 		pkg.CheckError("Error on post repo meta member decoder", err)
 
 		userID := models.GetUserIDFromUsername(db, postRepoSettingsMember.Username)
-		repoID := models.GetRepoIDFromReponame(db, reponame)
+		repoID := rc.RepoID
 		if userID > 0 {
-			if !models.CheckRepoOwnerFromUserIDAndReponame(db, userID, reponame) {
+			if userID != rc.OwnerID {
 				if !models.CheckRepoMemberExistFromUserIDAndRepoID(db, userID, repoID) {
 					crm := models.CreateRepoMember{
 						UserID:     userID,
@@ -700,31 +744,12 @@ func GetRepoBrowse(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg
 
 	repoDir := filepath.Join(conf.Paths.RepoPath, reponame+".git")
 
-	if repoExists := models.CheckRepoExists(db, reponame); !repoExists {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
 	if pkg.GetCommitCounts(conf.Paths.RepoPath, reponame) == "" {
 		http.Redirect(w, r, "/r/"+reponame, http.StatusFound)
 		return
 	}
 
-	userPresent := w.Header().Get("user-present")
-	var loggedInUserID int
-	if userPresent == "true" {
-		token := w.Header().Get("sorcia-cookie-token")
-		loggedInUserID = models.GetUserIDFromToken(db, token)
-	}
-
-	repoDescription := models.GetRepoDescriptionFromRepoName(db, reponame)
-
-	var permission string
-	if models.CheckRepoOwnerFromUserIDAndReponame(db, loggedInUserID, reponame) {
-		permission = "read/write"
-	} else {
-		permission = models.GetRepoMemberPermissionFromUserIDAndRepoID(db, loggedInUserID, models.GetRepoIDFromReponame(db, reponame))
-	}
+	rc := GetRepoContext(r)
 
 	data := GetRepoResponse{
 		SiteSettings:     GetSiteSettings(db, conf),
@@ -732,19 +757,15 @@ func GetRepoBrowse(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg
 		ShowLoginMenu:    true,
 		HeaderActiveMenu: "",
 		SorciaVersion:    conf.Version,
+		CSRFToken:        csrfToken(w),
 		Reponame:         reponame,
-		RepoAccess:       models.CheckRepoOwnerFromUserIDAndReponame(db, loggedInUserID, reponame),
-		RepoPermission:   permission,
-		RepoDescription:  repoDescription,
-		IsRepoPrivate:    models.GetRepoType(db, reponame),
+		RepoAccess:       rc.Can(RepoAdmin),
+		RepoPermission:   rc.Permission,
+		RepoDescription:  rc.Description,
+		IsRepoPrivate:    rc.IsPrivate,
 		RepoBranches:     pkg.GetGitBranches(repoDir),
 	}
 
-	if !data.IsLoggedIn && data.IsRepoPrivate {
-		http.Redirect(w, r, "/login", http.StatusFound)
-		return
-	}
-
 	gitPath := pkg.GetGitBinPath()
 
 	dirs, files := walkThrough(repoDir, gitPath, branch, ".", 0)
@@ -770,32 +791,14 @@ func GetRepoBrowsePath(w http.ResponseWriter, r *http.Request, db *sql.DB, conf
 	reponame := vars["reponame"]
 	branchOrHash := vars["branchorhash"]
 
-	if repoExists := models.CheckRepoExists(db, reponame); !repoExists {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
 	if pkg.GetCommitCounts(conf.Paths.RepoPath, reponame) == "" {
 		http.Redirect(w, r, "/r/"+reponame, http.StatusFound)
 		return
 	}
 
-	userPresent := w.Header().Get("user-present")
-	var loggedInUserID int
-	if userPresent == "true" {
-		token := w.Header().Get("sorcia-cookie-token")
-		loggedInUserID = models.GetUserIDFromToken(db, token)
-	}
+	rc := GetRepoContext(r)
 
 	repoDir := filepath.Join(conf.Paths.RepoPath, reponame+".git")
-	repoDescription := models.GetRepoDescriptionFromRepoName(db, reponame)
-
-	var permission string
-	if models.CheckRepoOwnerFromUserIDAndReponame(db, loggedInUserID, reponame) {
-		permission = "read/write"
-	} else {
-		permission = models.GetRepoMemberPermissionFromUserIDAndRepoID(db, loggedInUserID, models.GetRepoIDFromReponame(db, reponame))
-	}
 
 	data := GetRepoResponse{
 		SiteSettings:     GetSiteSettings(db, conf),
@@ -803,20 +806,16 @@ func GetRepoBrowsePath(w http.ResponseWriter, r *http.Request, db *sql.DB, conf
 		ShowLoginMenu:    true,
 		HeaderActiveMenu: "",
 		SorciaVersion:    conf.Version,
+		CSRFToken:        csrfToken(w),
 		Reponame:         reponame,
-		RepoAccess:       models.CheckRepoOwnerFromUserIDAndReponame(db, loggedInUserID, reponame),
-		RepoPermission:   permission,
-		RepoDescription:  repoDescription,
+		RepoAccess:       rc.Can(RepoAdmin),
+		RepoPermission:   rc.Permission,
+		RepoDescription:  rc.Description,
 		IsRepoBranch:     true,
-		IsRepoPrivate:    models.GetRepoType(db, reponame),
+		IsRepoPrivate:    rc.IsPrivate,
 		RepoBranches:     pkg.GetGitBranches(repoDir),
 	}
 
-	if !data.IsLoggedIn && data.IsRepoPrivate {
-		http.Redirect(w, r, "/login", http.StatusFound)
-		return
-	}
-
 	gitPath := pkg.GetGitBinPath()
 	frdpath := strings.Split(r.URL.Path, "r/"+reponame+"/browse/"+branchOrHash+"/")[1]
 
@@ -1024,31 +1023,12 @@ func GetRepoCommits(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pk
 		fromHash = qFrom[0]
 	}
 
-	if repoExists := models.CheckRepoExists(db, reponame); !repoExists {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
 	if pkg.GetCommitCounts(conf.Paths.RepoPath, reponame) == "" {
 		http.Redirect(w, r, "/r/"+reponame, http.StatusFound)
 		return
 	}
 
-	userPresent := w.Header().Get("user-present")
-	var loggedInUserID int
-	if userPresent == "true" {
-		token := w.Header().Get("sorcia-cookie-token")
-		loggedInUserID = models.GetUserIDFromToken(db, token)
-	}
-
-	repoDescription := models.GetRepoDescriptionFromRepoName(db, reponame)
-
-	var permission string
-	if models.CheckRepoOwnerFromUserIDAndReponame(db, loggedInUserID, reponame) {
-		permission = "read/write"
-	} else {
-		permission = models.GetRepoMemberPermissionFromUserIDAndRepoID(db, loggedInUserID, models.GetRepoIDFromReponame(db, reponame))
-	}
+	rc := GetRepoContext(r)
 
 	data := GetRepoResponse{
 		SiteSettings:     GetSiteSettings(db, conf),
@@ -1056,20 +1036,23 @@ func GetRepoCommits(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pk
 		ShowLoginMenu:    true,
 		HeaderActiveMenu: "",
 		SorciaVersion:    conf.Version,
+		CSRFToken:        csrfToken(w),
 		Reponame:         reponame,
-		RepoAccess:       models.CheckRepoOwnerFromUserIDAndReponame(db, loggedInUserID, reponame),
-		RepoPermission:   permission,
-		RepoDescription:  repoDescription,
-		IsRepoPrivate:    models.GetRepoType(db, reponame),
+		RepoAccess:       rc.Can(RepoAdmin),
+		RepoPermission:   rc.Permission,
+		RepoDescription:  rc.Description,
+		IsRepoPrivate:    rc.IsPrivate,
 		RepoBranches:     pkg.GetGitBranches(repoDir),
 	}
 
-	if !data.IsLoggedIn && data.IsRepoPrivate {
-		http.Redirect(w, r, "/login", http.StatusFound)
-		return
+	commits := getCommitsFromHash(repoDir, branch, fromHash, 11)
+
+	verifier := newSignatureVerifier(db)
+	defer verifier.Close()
+	for i := range commits.History {
+		commits.History[i].Signature = verifier.verifyCommit(repoDir, commits.History[i].FullHash)
 	}
 
-	commits := getCommitsFromHash(repoDir, branch, fromHash, 11)
 	data.RepoLogs = *commits
 
 	writeRepoResponse(w, r, db, reponame, "repo-commits.html", data, conf)
@@ -1084,6 +1067,7 @@ type Refs struct {
 	Zip       string
 	ZipPath   string
 	Message   string
+	Signature SignatureStatus
 }
 
 // GetRepoRefs ...
@@ -1091,31 +1075,12 @@ func GetRepoRefs(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.B
 	vars := mux.Vars(r)
 	reponame := vars["reponame"]
 
-	if repoExists := models.CheckRepoExists(db, reponame); !repoExists {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
 	if pkg.GetCommitCounts(conf.Paths.RepoPath, reponame) == "" {
 		http.Redirect(w, r, "/r/"+reponame, http.StatusFound)
 		return
 	}
 
-	userPresent := w.Header().Get("user-present")
-	var loggedInUserID int
-	if userPresent == "true" {
-		token := w.Header().Get("sorcia-cookie-token")
-		loggedInUserID = models.GetUserIDFromToken(db, token)
-	}
-
-	repoDescription := models.GetRepoDescriptionFromRepoName(db, reponame)
-
-	var permission string
-	if models.CheckRepoOwnerFromUserIDAndReponame(db, loggedInUserID, reponame) {
-		permission = "read/write"
-	} else {
-		permission = models.GetRepoMemberPermissionFromUserIDAndRepoID(db, loggedInUserID, models.GetRepoIDFromReponame(db, reponame))
-	}
+	rc := GetRepoContext(r)
 
 	data := GetRepoResponse{
 		SiteSettings:     GetSiteSettings(db, conf),
@@ -1123,16 +1088,12 @@ func GetRepoRefs(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.B
 		ShowLoginMenu:    true,
 		HeaderActiveMenu: "",
 		SorciaVersion:    conf.Version,
+		CSRFToken:        csrfToken(w),
 		Reponame:         reponame,
-		RepoAccess:       models.CheckRepoOwnerFromUserIDAndReponame(db, loggedInUserID, reponame),
-		RepoPermission:   permission,
-		RepoDescription:  repoDescription,
-		IsRepoPrivate:    models.GetRepoType(db, reponame),
-	}
-
-	if !data.IsLoggedIn && data.IsRepoPrivate {
-		http.Redirect(w, r, "/login", http.StatusFound)
-		return
+		RepoAccess:       rc.Can(RepoAdmin),
+		RepoPermission:   rc.Permission,
+		RepoDescription:  rc.Description,
+		IsRepoPrivate:    rc.IsPrivate,
 	}
 
 	repoDir := filepath.Join(conf.Paths.RepoPath, reponame+".git")
@@ -1146,6 +1107,9 @@ func GetRepoRefs(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.B
 
 	var rfs []Refs
 
+	verifier := newSignatureVerifier(db)
+	defer verifier.Close()
+
 	for _, line := range lines {
 		var rf Refs
 
@@ -1154,6 +1118,7 @@ func GetRepoRefs(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.B
 		rf.Version = strings.Split(refFields[0], "/")[2]
 
 		rf.Message = strings.Join(refFields[1:], " ")
+		rf.Signature = verifier.verifyTag(repoDir, rf.Version)
 
 		tagname := rf.Version
 
@@ -1190,13 +1155,44 @@ func GetRepoRefs(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.B
 }
 
 // ServeReleasesFile ...
-func ServeReleasesFile(w http.ResponseWriter, r *http.Request, conf *pkg.BaseStruct) {
+func ServeReleasesFile(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct) {
 	vars := mux.Vars(r)
 	fileName := vars["file"]
+
+	var userID int
+	if checkUserLoggedIn(w) {
+		token := w.Header().Get("sorcia-cookie-token")
+		userID = models.GetUserIDFromToken(db, token)
+	}
+
+	// Release files are named "<reponame>-<tag>.<ext>" and both parts can
+	// contain hyphens, so every repository the name could belong to has to
+	// be readable.
+	for i := strings.Index(fileName, "-"); i > 0; i = nextHyphen(fileName, i) {
+		reponame := fileName[:i]
+		if rc := LoadRepoContext(db, userID, reponame); rc != nil && !rc.Can(RepoRead) {
+			if userID == 0 {
+				http.Redirect(w, r, "/login", http.StatusFound)
+			} else {
+				noRepoAccess(w)
+			}
+			return
+		}
+	}
+
 	dlPath := filepath.Join(conf.Paths.RefsPath, fileName)
 	http.ServeFile(w, r, dlPath)
 }
 
+func nextHyphen(s string, i int) int {
+	j := strings.Index(s[i+1:], "-")
+	if j < 0 {
+		return -1
+	}
+
+	return i + 1 + j
+}
+
 // GetRepoContributors ...
 func GetRepoContributors(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct) {
 	vars := mux.Vars(r)
@@ -1204,31 +1200,12 @@ func GetRepoContributors(w http.ResponseWriter, r *http.Request, db *sql.DB, con
 
 	repoDir := filepath.Join(conf.Paths.RepoPath, reponame+".git")
 
-	if repoExists := models.CheckRepoExists(db, reponame); !repoExists {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
 	if pkg.GetCommitCounts(conf.Paths.RepoPath, reponame) == "" {
 		http.Redirect(w, r, "/r/"+reponame, http.StatusFound)
 		return
 	}
 
-	userPresent := w.Header().Get("user-present")
-	var loggedInUserID int
-	if userPresent == "true" {
-		token := w.Header().Get("sorcia-cookie-token")
-		loggedInUserID = models.GetUserIDFromToken(db, token)
-	}
-
-	repoDescription := models.GetRepoDescriptionFromRepoName(db, reponame)
-
-	var permission string
-	if models.CheckRepoOwnerFromUserIDAndReponame(db, loggedInUserID, reponame) {
-		permission = "read/write"
-	} else {
-		permission = models.GetRepoMemberPermissionFromUserIDAndRepoID(db, loggedInUserID, models.GetRepoIDFromReponame(db, reponame))
-	}
+	rc := GetRepoContext(r)
 
 	data := GetRepoResponse{
 		SiteSettings:     GetSiteSettings(db, conf),
@@ -1236,16 +1213,12 @@ func GetRepoContributors(w http.ResponseWriter, r *http.Request, db *sql.DB, con
 		ShowLoginMenu:    true,
 		HeaderActiveMenu: "",
 		SorciaVersion:    conf.Version,
+		CSRFToken:        csrfToken(w),
 		Reponame:         reponame,
-		RepoAccess:       models.CheckRepoOwnerFromUserIDAndReponame(db, loggedInUserID, reponame),
-		RepoPermission:   permission,
-		RepoDescription:  repoDescription,
-		IsRepoPrivate:    models.GetRepoType(db, reponame),
-	}
-
-	if !data.IsLoggedIn && data.IsRepoPrivate {
-		http.Redirect(w, r, "/login", http.StatusFound)
-		return
+		RepoAccess:       rc.Can(RepoAdmin),
+		RepoPermission:   rc.Permission,
+		RepoDescription:  rc.Description,
+		IsRepoPrivate:    rc.IsPrivate,
 	}
 
 	contributors := getContributors(repoDir, true)
@@ -1264,6 +1237,7 @@ type CommitDetailStruct struct {
 	Branch       string
 	Date         string
 	CommitStatus string
+	Signature    SignatureStatus
 	Files        []CommitFile
 }
 
@@ -1291,31 +1265,12 @@ func GetCommitDetail(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *p
 
 	repoDir := filepath.Join(conf.Paths.RepoPath, reponame+".git")
 
-	if repoExists := models.CheckRepoExists(db, reponame); !repoExists {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
 	if pkg.GetCommitCounts(conf.Paths.RepoPath, reponame) == "" {
 		http.Redirect(w, r, "/r/"+reponame, http.StatusFound)
 		return
 	}
 
-	userPresent := w.Header().Get("user-present")
-	var loggedInUserID int
-	if userPresent == "true" {
-		token := w.Header().Get("sorcia-cookie-token")
-		loggedInUserID = models.GetUserIDFromToken(db, token)
-	}
-
-	repoDescription := models.GetRepoDescriptionFromRepoName(db, reponame)
-
-	var permission string
-	if models.CheckRepoOwnerFromUserIDAndReponame(db, loggedInUserID, reponame) {
-		permission = "read/write"
-	} else {
-		permission = models.GetRepoMemberPermissionFromUserIDAndRepoID(db, loggedInUserID, models.GetRepoIDFromReponame(db, reponame))
-	}
+	rc := GetRepoContext(r)
 
 	data := GetRepoResponse{
 		SiteSettings:     GetSiteSettings(db, conf),
@@ -1324,16 +1279,12 @@ func GetCommitDetail(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *p
 		ShowLoginMenu:    true,
 		HeaderActiveMenu: "",
 		SorciaVersion:    conf.Version,
+		CSRFToken:        csrfToken(w),
 		Reponame:         reponame,
-		RepoAccess:       models.CheckRepoOwnerFromUserIDAndReponame(db, loggedInUserID, reponame),
-		RepoPermission:   permission,
-		RepoDescription:  repoDescription,
-		IsRepoPrivate:    models.GetRepoType(db, reponame),
-	}
-
-	if !data.IsLoggedIn && data.IsRepoPrivate {
-		http.Redirect(w, r, "/login", http.StatusFound)
-		return
+		RepoAccess:       rc.Can(RepoAdmin),
+		RepoPermission:   rc.Permission,
+		RepoDescription:  rc.Description,
+		IsRepoPrivate:    rc.IsPrivate,
 	}
 
 	gitPath := pkg.GetGitBinPath()
@@ -1355,6 +1306,10 @@ func GetCommitDetail(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *p
 		cds.Name = ss[0]
 		cds.Message = ss[1]
 		cds.Date = ss[2]
+
+		verifier := newSignatureVerifier(db)
+		cds.Signature = verifier.verifyCommit(repoDir, commitHash)
+		verifier.Close()
 	}
 
 	for _, file := range lines[1:] {
@@ -1497,34 +1452,16 @@ func noRepoAccess(w http.ResponseWriter) {
 }
 
 func writeRepoResponse(w http.ResponseWriter, r *http.Request, db *sql.DB, reponame string, mainPage string, data GetRepoResponse, conf *pkg.BaseStruct) {
-	// Check if repository is not private
-	if isRepoPrivate := models.GetRepoType(db, reponame); !isRepoPrivate {
-		tmpl := parseTemplates(w, mainPage, conf)
-		tmpl.ExecuteTemplate(w, "layout", data)
-	} else {
-		userPresent := w.Header().Get("user-present")
-
-		if userPresent != "" {
-			token := w.Header().Get("sorcia-cookie-token")
-			userIDFromToken := models.GetUserIDFromToken(db, token)
-
-			// Check if the logged in user has access to view the repository.
-			hasRepoAccess := models.CheckRepoOwnerFromUserIDAndReponame(db, userIDFromToken, reponame)
-			if !hasRepoAccess {
-				repoID := models.GetRepoIDFromReponame(db, reponame)
-				hasRepoAccess = models.CheckRepoMemberExistFromUserIDAndRepoID(db, userIDFromToken, repoID)
-			}
-			if hasRepoAccess {
-				data.IsRepoPrivate = true
-				tmpl := parseTemplates(w, mainPage, conf)
-				tmpl.ExecuteTemplate(w, "layout", data)
-			} else {
-				noRepoAccess(w)
-			}
-		} else {
-			http.Redirect(w, r, "/login", http.StatusFound)
-		}
+	// RepoRequest has already turned away readers without access, this is
+	// a last check in case a handler is reached without the repo context.
+	rc := GetRepoContext(r)
+	if rc == nil || !rc.Can(RepoRead) {
+		noRepoAccess(w)
+		return
 	}
+
+	tmpl := parseTemplates(w, mainPage, conf)
+	tmpl.ExecuteTemplate(w, "layout", data)
 }
 
 func parseTemplates(w http.ResponseWriter, mainPage string, conf *pkg.BaseStruct) *template.Template {
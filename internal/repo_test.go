@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateReponame(t *testing.T) {
+	tests := []struct {
+		reponame string
+		err      string
+	}{
+		{"sorcia", ""},
+		{"my-repo2", ""},
+		{strings.Repeat("a", 100), ""},
+		{"", "Repository name is required."},
+		{strings.Repeat("a", 101), "Repository name is too long (maximum is 100 characters)."},
+		{"-repo", "Repository name may only contain"},
+		{"my--repo", "Repository name may only contain"},
+		{"my_repo", "Repository name may only contain"},
+	}
+
+	for _, tt := range tests {
+		err := validateReponame(tt.reponame)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("validateReponame(%q) = %v, want no error", tt.reponame, err)
+		case tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)):
+			t.Errorf("validateReponame(%q) = %v, want %q", tt.reponame, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"sorcia/models"
+	"sorcia/pkg"
+)
+
+func init() {
+	RegisterPreReceiveHandler(secretScanHook)
+}
+
+// secretScanHook scans the blobs of a push for secrets. Depending on the
+// repository policy findings reject the push or are only reported.
+func secretScanHook(hc *HookContext, updates []RefUpdate) error {
+	repo := models.GetRepoFromReponame(hc.DB, hc.Reponame)
+	if repo.ID == 0 {
+		return nil
+	}
+
+	mode := models.GetPushPolicy(hc.DB, repo.ID).SecretScanning
+	if mode == pkg.SecretScanOff {
+		return nil
+	}
+
+	commits, err := pushedCommits(hc.RepoDir, updates)
+	if err != nil {
+		return err
+	}
+
+	files, err := pushedFiles(hc.RepoDir, commits)
+	if err != nil {
+		return err
+	}
+
+	// The same blob can be added by several commits, it's reported with
+	// the first one.
+	filesByBlob := make(map[string]pushedFile)
+	var blobs []string
+	for _, f := range files {
+		if _, ok := filesByBlob[f.Blob]; ok || f.Size > pkg.MaxSecretScanBlobSize {
+			continue
+		}
+		filesByBlob[f.Blob] = f
+		blobs = append(blobs, f.Blob)
+	}
+
+	var findings []string
+	err = pkg.ReadGitBlobs(hc.RepoDir, blobs, func(blob string, content []byte) {
+		f := filesByBlob[blob]
+		for _, finding := range pkg.ScanSecrets(content) {
+			findings = append(findings, fmt.Sprintf("%.7s: %s:%d: %s (%s)", f.Commit, f.Path, finding.Line, finding.Rule.Description, finding.Redacted()))
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(findings) == 0 {
+		return nil
+	}
+
+	prefix := "warning: possible secret in "
+	if mode == pkg.SecretScanReject {
+		prefix = "possible secret in "
+	}
+
+	for i, finding := range findings {
+		if i == maxPolicyViolations {
+			hc.Message("... and %d more", len(findings)-i)
+			break
+		}
+		hc.Message("%s%s", prefix, finding)
+	}
+
+	if mode == pkg.SecretScanReject {
+		return fmt.Errorf("push rejected, %d possible secret(s) found. Remove them from the history and rotate them", len(findings))
+	}
+
+	return nil
+}
+
+// ScanRepositoryHistory scans every blob reachable from the refs of all
+// repositories in repo_path and writes a report of the findings to out. It
+// returns the number of findings.
+func ScanRepositoryHistory(conf *pkg.BaseStruct, out io.Writer) (int, error) {
+	repoDirs, err := filepath.Glob(repoDirectory(conf, "*.git"))
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(repoDirs)
+
+	total := 0
+	for _, repoDir := range repoDirs {
+		n, err := scanRepositoryHistory(repoDir, out)
+		if err != nil {
+			fmt.Fprintf(out, "%s: scan failed: %v\n", filepath.Base(repoDir), err)
+			continue
+		}
+		total += n
+	}
+
+	return total, nil
+}
+
+func scanRepositoryHistory(repoDir string, out io.Writer) (int, error) {
+	reponame := strings.TrimSuffix(filepath.Base(repoDir), ".git")
+
+	// rev-list prints "<object> <path>" for every blob and tree, with the
+	// first path the object was seen at.
+	objects, err := gitOutput(repoDir, nil, "rev-list", "--objects", "--all")
+	if err != nil {
+		return 0, err
+	}
+
+	paths := make(map[string]string)
+	var candidates []string
+	var input strings.Builder
+	for _, line := range strings.Split(objects, "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		paths[fields[0]] = fields[1]
+		candidates = append(candidates, fields[0])
+		input.WriteString(fields[0] + "\n")
+	}
+
+	if len(candidates) == 0 {
+		return 0, nil
+	}
+
+	checks, err := gitOutput(repoDir, []byte(input.String()), "cat-file", "--batch-check=%(objectname) %(objecttype) %(objectsize)")
+	if err != nil {
+		return 0, err
+	}
+
+	var blobs []string
+	for _, line := range strings.Split(checks, "\n") {
+		var object, objectType string
+		var size int64
+		if _, err := fmt.Sscanf(line, "%s %s %d", &object, &objectType, &size); err != nil {
+			continue
+		}
+		if objectType == "blob" && size <= pkg.MaxSecretScanBlobSize {
+			blobs = append(blobs, object)
+		}
+	}
+
+	findings := 0
+	err = pkg.ReadGitBlobs(repoDir, blobs, func(blob string, content []byte) {
+		results := pkg.ScanSecrets(content)
+		if len(results) == 0 {
+			return
+		}
+
+		// The oldest commit which added the blob.
+		commit, _ := gitOutput(repoDir, nil, "log", "--all", "--reverse", "--format=%h", "--find-object="+blob)
+		if fields := strings.Fields(commit); len(fields) > 0 {
+			commit = fields[0]
+		}
+
+		for _, finding := range results {
+			fmt.Fprintf(out, "%s: %s: %s:%d: %s (%s)\n", reponame, commit, paths[blob], finding.Line, finding.Rule.Description, finding.Redacted())
+			findings++
+		}
+	})
+
+	return findings, err
+}
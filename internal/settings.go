@@ -18,6 +18,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"sorcia/models"
 	"sorcia/pkg"
@@ -32,13 +33,34 @@ type SettingsResponse struct {
 	IsAdmin            bool
 	HeaderActiveMenu   string
 	SorciaVersion      string
+	CSRFToken          string
 	Username           string
 	Email              string
 	Users              models.Users
+	Invites            []InviteLink
+	PasswordResets     []PasswordResetLink
 	RegisterErrMessage string
+	AdminErrMessage    string
+	Quota              []QuotaUsage
 	SiteSettings       SiteSettings
 }
 
+// InviteLink struct
+type InviteLink struct {
+	ID            int
+	Link          string
+	CanCreateRepo bool
+	IsAdmin       bool
+	Expires       string
+}
+
+// PasswordResetLink struct
+type PasswordResetLink struct {
+	Username string
+	Link     string
+	Expires  string
+}
+
 // GetSettings ...
 func GetSettings(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct) {
 	userPresent := w.Header().Get("user-present")
@@ -65,7 +87,9 @@ func GetSettings(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.B
 			IsAdmin:          models.CheckifUserIsAnAdmin(db, userID),
 			HeaderActiveMenu: "meta",
 			SorciaVersion:    conf.Version,
+			CSRFToken:        csrfToken(w),
 			Username:         username,
+			Quota:            userQuotaUsage(db, conf, userID),
 			SiteSettings:     GetSiteSettings(db, conf),
 		}
 
@@ -77,12 +101,27 @@ func GetSettings(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.B
 
 // SettingsKeysResponse struct
 type SettingsKeysResponse struct {
-	IsLoggedIn       bool
-	IsAdmin          bool
-	HeaderActiveMenu string
-	SorciaVersion    string
-	SSHKeys          *models.SSHKeysResponse
-	SiteSettings     SiteSettings
+	IsLoggedIn           bool
+	IsAdmin              bool
+	HeaderActiveMenu     string
+	SorciaVersion        string
+	CSRFToken            string
+	SSHKeys              []SSHKey
+	KeyErrMessage        string
+	SigningKeys          []models.SigningKey
+	SigningKeyErrMessage string
+	SiteSettings         SiteSettings
+}
+
+// SSHKey struct
+type SSHKey struct {
+	ID                int
+	Title             string
+	Fingerprint       string
+	FingerprintSHA256 string
+	Expires           string
+	IsExpired         bool
+	LastUsed          string
 }
 
 // GetSettingsKeys ...
@@ -90,35 +129,67 @@ func GetSettingsKeys(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *p
 	userPresent := w.Header().Get("user-present")
 
 	if userPresent == "true" {
-		token := w.Header().Get("sorcia-cookie-token")
-		userID := models.GetUserIDFromToken(db, token)
-
-		sshKeys := models.GetSSHKeysFromUserID(db, userID)
-
-		layoutPage := filepath.Join(conf.Paths.TemplatePath, "layout.html")
-		headerPage := filepath.Join(conf.Paths.TemplatePath, "header.html")
-		metaPage := filepath.Join(conf.Paths.TemplatePath, "settings-keys.html")
-		footerPage := filepath.Join(conf.Paths.TemplatePath, "footer.html")
+		writeSettingsKeys(w, db, conf, "", "")
+	} else {
+		http.Redirect(w, r, "/login", http.StatusFound)
+	}
+}
 
-		tmpl, err := template.ParseFiles(layoutPage, headerPage, metaPage, footerPage)
-		pkg.CheckError("Error on template parse", err)
+func writeSettingsKeys(w http.ResponseWriter, db *sql.DB, conf *pkg.BaseStruct, keyErrMessage, signingKeyErrMessage string) {
+	token := w.Header().Get("sorcia-cookie-token")
+	userID := models.GetUserIDFromToken(db, token)
+
+	now := time.Now().Unix()
+
+	var sshKeys []SSHKey
+	for _, key := range models.GetSSHKeysFromUserID(db, userID).SSHKeys {
+		sshKey := SSHKey{
+			ID:                key.ID,
+			Title:             key.Title,
+			Fingerprint:       key.Fingerprint,
+			FingerprintSHA256: key.FingerprintSHA256,
+			Expires:           "Never",
+			IsExpired:         key.ExpiresAt != 0 && key.ExpiresAt <= now,
+			LastUsed:          "Never",
+		}
 
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
+		if key.ExpiresAt != 0 {
+			// Keys expire at the end of the day they were set to.
+			sshKey.Expires = time.Unix(key.ExpiresAt-1, 0).Format("2006-01-02")
+		}
 
-		data := SettingsKeysResponse{
-			IsLoggedIn:       true,
-			IsAdmin:          models.CheckifUserIsAnAdmin(db, userID),
-			HeaderActiveMenu: "meta",
-			SorciaVersion:    conf.Version,
-			SSHKeys:          sshKeys,
-			SiteSettings:     GetSiteSettings(db, conf),
+		if key.LastUsedAt != 0 {
+			sshKey.LastUsed = time.Unix(key.LastUsedAt, 0).Format("2006-01-02 15:04 MST")
 		}
 
-		tmpl.ExecuteTemplate(w, "layout", data)
-	} else {
-		http.Redirect(w, r, "/login", http.StatusFound)
+		sshKeys = append(sshKeys, sshKey)
 	}
+
+	layoutPage := filepath.Join(conf.Paths.TemplatePath, "layout.html")
+	headerPage := filepath.Join(conf.Paths.TemplatePath, "header.html")
+	metaPage := filepath.Join(conf.Paths.TemplatePath, "settings-keys.html")
+	footerPage := filepath.Join(conf.Paths.TemplatePath, "footer.html")
+
+	tmpl, err := template.ParseFiles(layoutPage, headerPage, metaPage, footerPage)
+	pkg.CheckError("Error on template parse", err)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	data := SettingsKeysResponse{
+		IsLoggedIn:           true,
+		IsAdmin:              models.CheckifUserIsAnAdmin(db, userID),
+		HeaderActiveMenu:     "meta",
+		SorciaVersion:        conf.Version,
+		CSRFToken:            csrfToken(w),
+		SSHKeys:              sshKeys,
+		KeyErrMessage:        keyErrMessage,
+		SigningKeys:          models.GetSigningKeysFromUserID(db, userID),
+		SigningKeyErrMessage: signingKeyErrMessage,
+		SiteSettings:         GetSiteSettings(db, conf),
+	}
+
+	tmpl.ExecuteTemplate(w, "layout", data)
 }
 
 // DeleteSettingsKey ...
@@ -132,7 +203,10 @@ func DeleteSettingsKey(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		i, err := strconv.Atoi(keyID)
 		pkg.CheckError("Error on converting SSH key id(string) to int on delete settings keys", err)
 
-		models.DeleteSettingsKeyByID(db, i)
+		token := w.Header().Get("sorcia-cookie-token")
+		userID := models.GetUserIDFromToken(db, token)
+
+		models.DeleteSettingsKeyByID(db, i, userID)
 		http.Redirect(w, r, "/settings/keys", http.StatusFound)
 	} else {
 		http.Redirect(w, r, "/login", http.StatusFound)
@@ -143,6 +217,7 @@ func DeleteSettingsKey(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 type CreateAuthKeyRequest struct {
 	Title   string `schema:"sshtitle"`
 	AuthKey string `schema:"sshkey"`
+	Expires string `schema:"expires"`
 }
 
 // PostAuthKey ...
@@ -174,14 +249,46 @@ func PostAuthKey(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.B
 
 		userID := models.GetUserIDFromToken(db, token)
 
-		authKey := strings.TrimSpace(createAuthKeyRequest.AuthKey)
-		fingerPrint := pkg.SSHFingerPrint(authKey)
+		key, err := pkg.ParseSSHKey(createAuthKeyRequest.AuthKey, conf.SSH.MinRSAKeySize)
+		if err != nil {
+			writeSettingsKeys(w, db, conf, err.Error(), "")
+			return
+		}
+
+		if ownerID := models.GetSSHKeyOwnerFromFingerprint(db, key.Fingerprint); ownerID == userID {
+			writeSettingsKeys(w, db, conf, "You have already added this key.", "")
+			return
+		} else if ownerID != 0 {
+			writeSettingsKeys(w, db, conf, "This key is already registered to another user. Each key can only belong to one user.", "")
+			return
+		} else if models.CheckSSHFingerprintExists(db, key.Fingerprint) {
+			writeSettingsKeys(w, db, conf, "This key is already used as a deploy key of a repository.", "")
+			return
+		}
+
+		var expiresAt int64
+		if expires := strings.TrimSpace(createAuthKeyRequest.Expires); expires != "" {
+			t, err := time.ParseInLocation("2006-01-02", expires, time.Local)
+			if err != nil {
+				writeSettingsKeys(w, db, conf, "The expiry date must be in the format YYYY-MM-DD.", "")
+				return
+			}
+
+			// The key is valid until the end of the day.
+			expiresAt = t.AddDate(0, 0, 1).Unix()
+			if expiresAt <= time.Now().Unix() {
+				writeSettingsKeys(w, db, conf, "The expiry date has to be in the future.", "")
+				return
+			}
+		}
 
 		ispk := models.InsertSSHPubKeyStruct{
-			AuthKey:     authKey,
-			Title:       strings.TrimSpace(createAuthKeyRequest.Title),
-			Fingerprint: fingerPrint,
-			UserID:      userID,
+			AuthKey:           key.AuthorizedKey,
+			Title:             strings.TrimSpace(createAuthKeyRequest.Title),
+			Fingerprint:       key.Fingerprint,
+			FingerprintSHA256: key.FingerprintSHA256,
+			ExpiresAt:         expiresAt,
+			UserID:            userID,
 		}
 
 		models.InsertSSHPubKey(db, ispk)
@@ -293,6 +400,7 @@ func PostUser(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.Base
 				ShowLoginMenu:      false,
 				HeaderActiveMenu:   "",
 				SorciaVersion:      conf.Version,
+				CSRFToken:          csrfToken(w),
 				IsShowSignUp:       !models.CheckIfFirstUserExists(db),
 				LoginErrMessage:    "",
 				RegisterErrMessage: "Username is too long (maximum is 39 characters).",
@@ -318,6 +426,7 @@ func PostUser(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.Base
 				ShowLoginMenu:      false,
 				HeaderActiveMenu:   "",
 				SorciaVersion:      conf.Version,
+				CSRFToken:          csrfToken(w),
 				IsShowSignUp:       !models.CheckIfFirstUserExists(db),
 				LoginErrMessage:    "",
 				RegisterErrMessage: "Username may only contain alphanumeric characters or single hyphens, and cannot begin or end with a hyphen.",
@@ -343,7 +452,7 @@ func PostUser(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.Base
 
 		models.InsertAccount(db, rr)
 
-		http.Redirect(w, r, "/meta/users", http.StatusFound)
+		http.Redirect(w, r, "/settings/users", http.StatusFound)
 		return
 	}
 
@@ -352,38 +461,205 @@ func PostUser(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.Base
 
 // GetSettingsUsers ...
 func GetSettingsUsers(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct) {
+	writeSettingsUsers(w, r, db, conf, "")
+}
+
+// writeSettingsUsers renders the users page. It's only reachable by admins.
+func writeSettingsUsers(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct, adminErrMessage string) {
+	users := models.GetAllUsers(db)
+
+	var invites []InviteLink
+	var passwordResets []PasswordResetLink
+
+	baseURL := getBaseURL(r)
+	now := time.Now().Unix()
+
+	for _, invite := range models.GetActiveInvites(db, now) {
+		invites = append(invites, InviteLink{
+			ID:            invite.ID,
+			Link:          fmt.Sprintf("%s/invite/%s", baseURL, invite.Token),
+			CanCreateRepo: invite.CanCreateRepo,
+			IsAdmin:       invite.IsAdmin,
+			Expires:       time.Unix(invite.ExpiresAt, 0).Format("2006-01-02 15:04 MST"),
+		})
+	}
+
+	for _, pr := range models.GetActivePasswordResets(db, now) {
+		passwordResets = append(passwordResets, PasswordResetLink{
+			Username: pr.Username,
+			Link:     fmt.Sprintf("%s/reset-password/%s", baseURL, pr.Token),
+			Expires:  time.Unix(pr.ExpiresAt, 0).Format("2006-01-02 15:04 MST"),
+		})
+	}
+
+	layoutPage := filepath.Join(conf.Paths.TemplatePath, "layout.html")
+	headerPage := filepath.Join(conf.Paths.TemplatePath, "header.html")
+	metaPage := filepath.Join(conf.Paths.TemplatePath, "settings-users.html")
+	footerPage := filepath.Join(conf.Paths.TemplatePath, "footer.html")
+
+	tmpl, err := template.ParseFiles(layoutPage, headerPage, metaPage, footerPage)
+	pkg.CheckError("Error on template parse", err)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	token := w.Header().Get("sorcia-cookie-token")
+
+	data := SettingsResponse{
+		IsLoggedIn:         true,
+		IsAdmin:            true,
+		HeaderActiveMenu:   "meta",
+		SorciaVersion:      conf.Version,
+		CSRFToken:          csrfToken(w),
+		Username:           models.GetUsernameFromToken(db, token),
+		Users:              users,
+		Invites:            invites,
+		PasswordResets:     passwordResets,
+		RegisterErrMessage: "",
+		AdminErrMessage:    adminErrMessage,
+		SiteSettings:       GetSiteSettings(db, conf),
+	}
+
+	tmpl.ExecuteTemplate(w, "layout", data)
+}
+
+// PostPromoteAdmin ...
+func PostPromoteAdmin(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	username := mux.Vars(r)["username"]
+
+	models.PromoteAdmin(db, username)
+
+	http.Redirect(w, r, "/settings/users", http.StatusFound)
+}
+
+// PostDemoteAdmin ...
+func PostDemoteAdmin(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct) {
+	username := mux.Vars(r)["username"]
+	userID := models.GetUserIDFromUsername(db, username)
+
+	if models.CheckifUserIsAnAdmin(db, userID) && !models.DemoteAdmin(db, username) {
+		writeSettingsUsers(w, r, db, conf, fmt.Sprintf("%s can't be demoted, an instance needs at least one admin.", username))
+		return
+	}
+
+	// Admins demoting themselves can't see the users page anymore.
+	token := w.Header().Get("sorcia-cookie-token")
+	if models.GetUsernameFromToken(db, token) == username {
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/users", http.StatusFound)
+}
+
+func getBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
+
+// PostInviteRequest struct
+type PostInviteRequest struct {
+	ExpiryDays    int    `schema:"expiry"`
+	CanCreateRepo string `schema:"createrepo"`
+	IsAdmin       string `schema:"isadmin"`
+}
+
+// PostCreateInvite ...
+func PostCreateInvite(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct, decoder *schema.Decoder) {
 	userPresent := w.Header().Get("user-present")
 
 	if userPresent == "true" {
 		token := w.Header().Get("sorcia-cookie-token")
 		userID := models.GetUserIDFromToken(db, token)
 
-		users := models.GetAllUsers(db)
+		if !models.CheckifUserIsAnAdmin(db, userID) {
+			http.Redirect(w, r, "/settings/users", http.StatusFound)
+			return
+		}
 
-		layoutPage := filepath.Join(conf.Paths.TemplatePath, "layout.html")
-		headerPage := filepath.Join(conf.Paths.TemplatePath, "header.html")
-		metaPage := filepath.Join(conf.Paths.TemplatePath, "settings-users.html")
-		footerPage := filepath.Join(conf.Paths.TemplatePath, "footer.html")
+		if err := r.ParseForm(); err != nil {
+			writeHdr(w, http.StatusBadRequest, fmt.Sprintf("ParseForm() err: %v", err))
+			return
+		}
 
-		tmpl, err := template.ParseFiles(layoutPage, headerPage, metaPage, footerPage)
-		pkg.CheckError("Error on template parse", err)
+		var postInviteRequest = &PostInviteRequest{}
+		err := decoder.Decode(postInviteRequest, r.PostForm)
+		pkg.CheckError("Error on settings post invite decoder", err)
 
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
+		expiryDays := postInviteRequest.ExpiryDays
+		if expiryDays < 1 || expiryDays > 30 {
+			expiryDays = 7
+		}
 
-		data := SettingsResponse{
-			IsLoggedIn:         true,
-			IsAdmin:            models.CheckifUserIsAnAdmin(db, userID),
-			RegisterErrMessage: "",
-			HeaderActiveMenu:   "meta",
-			SorciaVersion:      conf.Version,
-			Users:              users,
-			SiteSettings:       GetSiteSettings(db, conf),
+		iis := models.InsertInviteStruct{
+			Token:     pkg.RandomString(20),
+			CreatedBy: userID,
+			ExpiresAt: time.Now().Add(time.Duration(expiryDays) * 24 * time.Hour).Unix(),
 		}
 
-		tmpl.ExecuteTemplate(w, "layout", data)
+		if postInviteRequest.CanCreateRepo != "" {
+			iis.CanCreateRepo = 1
+		}
+
+		if postInviteRequest.IsAdmin != "" {
+			iis.IsAdmin = 1
+		}
+
+		models.InsertInvite(db, iis)
+
+		http.Redirect(w, r, "/settings/users", http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+// DeleteInvite ...
+func DeleteInvite(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userPresent := w.Header().Get("user-present")
+
+	if userPresent == "true" {
+		token := w.Header().Get("sorcia-cookie-token")
+		userID := models.GetUserIDFromToken(db, token)
+
+		if models.CheckifUserIsAnAdmin(db, userID) {
+			inviteID, err := strconv.Atoi(mux.Vars(r)["inviteID"])
+			if err == nil {
+				models.DeleteInviteByID(db, inviteID)
+			}
+		}
+
+		http.Redirect(w, r, "/settings/users", http.StatusFound)
 		return
 	}
+
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+// PostPasswordResetLink ...
+func PostPasswordResetLink(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userPresent := w.Header().Get("user-present")
+
+	if userPresent == "true" {
+		token := w.Header().Get("sorcia-cookie-token")
+		userID := models.GetUserIDFromToken(db, token)
+
+		if models.CheckifUserIsAnAdmin(db, userID) {
+			resetUserID := models.GetUserIDFromUsername(db, mux.Vars(r)["username"])
+			if resetUserID > 0 {
+				expiresAt := time.Now().Add(24 * time.Hour).Unix()
+				models.InsertPasswordReset(db, resetUserID, pkg.RandomString(20), expiresAt)
+			}
+		}
+
+		http.Redirect(w, r, "/settings/users", http.StatusFound)
+		return
+	}
+
 	http.Redirect(w, r, "/login", http.StatusFound)
 }
 
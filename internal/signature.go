@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"sorcia/models"
+	"sorcia/pkg"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/schema"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Badges shown for signed commits and tags.
+const (
+	SignatureVerified   = "Verified"
+	SignatureUnverified = "Unverified"
+	SignatureUnknownKey = "Unknown key"
+)
+
+// SignatureStatus is the verification result of a signed commit or tag. The
+// status is empty if the object isn't signed.
+type SignatureStatus struct {
+	Status string
+	Signer string
+	Kind   string
+}
+
+// signatureVerifier checks signatures against the signing keys of all
+// users. It's meant to be used for a single request and has to be closed.
+type signatureVerifier struct {
+	gpgKeyring *pkg.GPGKeyring
+	gpgOwners  map[string]string
+	sshOwners  map[string]string
+}
+
+func newSignatureVerifier(db *sql.DB) *signatureVerifier {
+	v := &signatureVerifier{
+		gpgOwners: make(map[string]string),
+		sshOwners: make(map[string]string),
+	}
+
+	for _, sk := range models.GetAllSigningKeys(db) {
+		switch sk.KeyType {
+		case pkg.SignatureGPG:
+			if v.gpgKeyring == nil {
+				keyring, err := pkg.NewGPGKeyring()
+				if err != nil {
+					pkg.CheckError("Error on creating gpg keyring", err)
+					continue
+				}
+				v.gpgKeyring = keyring
+			}
+
+			err := v.gpgKeyring.Import(sk.PublicKey)
+			pkg.CheckError("Error on importing gpg key "+sk.Fingerprint, err)
+			v.gpgOwners[sk.Fingerprint] = sk.Username
+		case pkg.SignatureSSH:
+			v.sshOwners[sk.Fingerprint] = sk.Username
+		}
+	}
+
+	return v
+}
+
+func (v *signatureVerifier) Close() {
+	if v.gpgKeyring != nil {
+		v.gpgKeyring.Close()
+	}
+}
+
+func (v *signatureVerifier) verify(payload, signature string) SignatureStatus {
+	if signature == "" {
+		return SignatureStatus{}
+	}
+
+	ss := SignatureStatus{Kind: pkg.SignatureKind(signature)}
+
+	switch ss.Kind {
+	case pkg.SignatureGPG:
+		if v.gpgKeyring == nil {
+			ss.Status = SignatureUnknownKey
+			return ss
+		}
+
+		result := v.gpgKeyring.Verify([]byte(payload), signature)
+		signer, ok := v.gpgOwners[result.PrimaryFingerprint]
+
+		switch {
+		case !result.KnownKey:
+			ss.Status = SignatureUnknownKey
+		case result.Good && ok:
+			ss.Status = SignatureVerified
+			ss.Signer = signer
+		default:
+			ss.Status = SignatureUnverified
+		}
+	case pkg.SignatureSSH:
+		pub, err := pkg.ParseSSHSignature(signature)
+		if err != nil {
+			ss.Status = SignatureUnverified
+			return ss
+		}
+
+		signer, ok := v.sshOwners[gossh.FingerprintSHA256(pub)]
+		if !ok {
+			ss.Status = SignatureUnknownKey
+			return ss
+		}
+
+		if err := pkg.VerifySSHSignature(signature, []byte(payload), "git"); err != nil {
+			ss.Status = SignatureUnverified
+			return ss
+		}
+
+		ss.Status = SignatureVerified
+		ss.Signer = signer
+	default:
+		ss.Status = SignatureUnverified
+	}
+
+	return ss
+}
+
+// verifyCommit checks the signature of a commit.
+func (v *signatureVerifier) verifyCommit(repoDir, hash string) SignatureStatus {
+	gitPath := pkg.GetGitBinPath()
+	raw := pkg.ForkExec(gitPath, []string{"cat-file", "commit", hash}, repoDir)
+
+	return v.verify(pkg.SplitCommitSignature(raw))
+}
+
+// verifyTag checks the signature of an annotated tag. Lightweight tags
+// can't be signed.
+func (v *signatureVerifier) verifyTag(repoDir, tag string) SignatureStatus {
+	gitPath := pkg.GetGitBinPath()
+	objectType := strings.TrimSpace(pkg.ForkExec(gitPath, []string{"cat-file", "-t", "refs/tags/" + tag}, repoDir))
+	if objectType != "tag" {
+		return SignatureStatus{}
+	}
+
+	raw := pkg.ForkExec(gitPath, []string{"cat-file", "tag", "refs/tags/" + tag}, repoDir)
+
+	return v.verify(pkg.SplitTagSignature(raw))
+}
+
+// PostSigningKeyRequest struct
+type PostSigningKeyRequest struct {
+	Title     string `schema:"title"`
+	KeyType   string `schema:"key_type"`
+	PublicKey string `schema:"key"`
+}
+
+// PostSigningKey adds a GPG or SSH key which the user signs commits and
+// tags with.
+func PostSigningKey(w http.ResponseWriter, r *http.Request, db *sql.DB, conf *pkg.BaseStruct, decoder *schema.Decoder) {
+	userPresent := w.Header().Get("user-present")
+
+	if userPresent == "true" {
+		token := w.Header().Get("sorcia-cookie-token")
+		userID := models.GetUserIDFromToken(db, token)
+
+		if err := r.ParseForm(); err != nil {
+			writeHdr(w, http.StatusBadRequest, "ParseForm() err: "+err.Error())
+			return
+		}
+
+		var postSigningKeyRequest = &PostSigningKeyRequest{}
+		err := decoder.Decode(postSigningKeyRequest, r.PostForm)
+		pkg.CheckError("Error on post signing key decoder", err)
+
+		isk := models.InsertSigningKeyStruct{
+			UserID:  userID,
+			KeyType: postSigningKeyRequest.KeyType,
+			Title:   strings.TrimSpace(postSigningKeyRequest.Title),
+		}
+
+		switch isk.KeyType {
+		case pkg.SignatureGPG:
+			fingerprint, err := pkg.GPGKeyFingerprint(postSigningKeyRequest.PublicKey)
+			if err != nil {
+				writeSettingsKeys(w, db, conf, "", err.Error())
+				return
+			}
+			isk.PublicKey = strings.TrimSpace(postSigningKeyRequest.PublicKey)
+			isk.Fingerprint = fingerprint
+		case pkg.SignatureSSH:
+			key, err := pkg.ParseSSHKey(postSigningKeyRequest.PublicKey, conf.SSH.MinRSAKeySize)
+			if err != nil {
+				writeSettingsKeys(w, db, conf, "", err.Error())
+				return
+			}
+			isk.PublicKey = key.AuthorizedKey
+			isk.Fingerprint = key.FingerprintSHA256
+		default:
+			writeSettingsKeys(w, db, conf, "", "Please choose whether this is a GPG or an SSH key.")
+			return
+		}
+
+		if models.CheckSigningKeyFingerprintExists(db, isk.Fingerprint) {
+			writeSettingsKeys(w, db, conf, "", "This signing key has already been added.")
+			return
+		}
+
+		models.InsertSigningKey(db, isk)
+
+		http.Redirect(w, r, "/settings/keys", http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+// DeleteSigningKey ...
+func DeleteSigningKey(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userPresent := w.Header().Get("user-present")
+
+	if userPresent == "true" {
+		token := w.Header().Get("sorcia-cookie-token")
+		userID := models.GetUserIDFromToken(db, token)
+
+		keyID, err := strconv.Atoi(mux.Vars(r)["keyID"])
+		if err == nil {
+			models.DeleteSigningKeyByID(db, keyID, userID)
+		}
+
+		http.Redirect(w, r, "/settings/keys", http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"sorcia/models"
+	"sorcia/pkg"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// sourceAddressOption is the critical option of OpenSSH certificates which
+// limits the addresses a certificate can be used from.
+const sourceAddressOption = "source-address"
+
+// loadTrustedUserCAKeys reads the CA public keys from the files configured
+// in trusted_user_ca_keys. Files which can't be read are logged and skipped.
+func loadTrustedUserCAKeys(files []string) []gossh.PublicKey {
+	var caKeys []gossh.PublicKey
+
+	for _, file := range files {
+		file = strings.TrimSpace(file)
+		if file == "" {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(file)
+		pkg.CheckError("Error on reading trusted user CA keys file", err)
+		if err != nil {
+			continue
+		}
+
+		for len(bytes.TrimSpace(data)) > 0 {
+			caKey, _, _, rest, err := gossh.ParseAuthorizedKey(data)
+			if err != nil {
+				pkg.CheckError("Error on parsing trusted user CA key in "+file, err)
+				break
+			}
+
+			caKeys = append(caKeys, caKey)
+			data = rest
+		}
+	}
+
+	return caKeys
+}
+
+// certUserID checks an OpenSSH user certificate and returns the ID of the
+// sorcia user it was issued for. The first principal of the certificate
+// which is a sorcia username is used.
+func certUserID(db *sql.DB, cert *gossh.Certificate, remoteAddr net.Addr, caKeys []gossh.PublicKey) (int, error) {
+	checker := &gossh.CertChecker{
+		IsUserAuthority: func(auth gossh.PublicKey) bool {
+			for _, caKey := range caKeys {
+				if bytes.Equal(caKey.Marshal(), auth.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+		Clock: time.Now,
+	}
+
+	// CheckCert only verifies the signature with the key the certificate
+	// names itself, anyone can sign one. The signer has to be a trusted CA.
+	if cert.CertType != gossh.UserCert {
+		return 0, errors.New("not a user certificate")
+	}
+
+	if !checker.IsUserAuthority(cert.SignatureKey) {
+		return 0, errors.New("certificate is not signed by a trusted CA")
+	}
+
+	if err := checkSourceAddress(remoteAddr, cert.CriticalOptions[sourceAddressOption]); err != nil {
+		return 0, err
+	}
+
+	for _, principal := range cert.ValidPrincipals {
+		userID := models.GetUserIDFromUsername(db, principal)
+		if userID == 0 {
+			continue
+		}
+
+		// CheckCert verifies the signature, the validity window and
+		// rejects unknown critical options.
+		if err := checker.CheckCert(principal, cert); err != nil {
+			return 0, err
+		}
+
+		return userID, nil
+	}
+
+	return 0, errors.New("no principal of the certificate is a sorcia user")
+}
+
+// checkSourceAddress enforces the source-address critical option, a comma
+// separated list of addresses and CIDRs.
+func checkSourceAddress(remoteAddr net.Addr, sourceAddress string) error {
+	if sourceAddress == "" {
+		return nil
+	}
+
+	tcpAddr, ok := remoteAddr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("cannot check source-address for %s", remoteAddr)
+	}
+
+	for _, source := range strings.Split(sourceAddress, ",") {
+		source = strings.TrimSpace(source)
+
+		if ip := net.ParseIP(source); ip != nil && ip.Equal(tcpAddr.IP) {
+			return nil
+		}
+
+		if _, ipNet, err := net.ParseCIDR(source); err == nil && ipNet.Contains(tcpAddr.IP) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("certificate can't be used from %s", tcpAddr.IP)
+}
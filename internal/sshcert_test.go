@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) gossh.Signer {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+// newTestCert returns a user certificate for the principals signed by ca,
+// valid for an hour. change can adjust it before it's signed.
+func newTestCert(t *testing.T, ca gossh.Signer, principals []string, change func(*gossh.Certificate)) *gossh.Certificate {
+	t.Helper()
+
+	now := time.Now()
+	cert := &gossh.Certificate{
+		Key:             newTestSigner(t).PublicKey(),
+		CertType:        gossh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+	}
+	if change != nil {
+		change(cert)
+	}
+
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestCertUserID(t *testing.T) {
+	db := newTestDB(t)
+	aliceID := insertTestUser(t, db, "alice", false)
+	insertTestUser(t, db, "admin", true)
+
+	trustedCA := newTestSigner(t)
+	untrustedCA := newTestSigner(t)
+	caKeys := []gossh.PublicKey{newTestSigner(t).PublicKey(), trustedCA.PublicKey()}
+
+	remoteAddr := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 50000}
+
+	tests := []struct {
+		name string
+		cert *gossh.Certificate
+		want int
+	}{
+		{"trusted CA", newTestCert(t, trustedCA, []string{"alice"}, nil), aliceID},
+		{"first known principal", newTestCert(t, trustedCA, []string{"nobody", "alice"}, nil), aliceID},
+		{"untrusted CA", newTestCert(t, untrustedCA, []string{"admin"}, nil), 0},
+		{"self-signed", func() *gossh.Certificate {
+			userKey := newTestSigner(t)
+			return newTestCert(t, userKey, []string{"admin"}, func(c *gossh.Certificate) { c.Key = userKey.PublicKey() })
+		}(), 0},
+		{"host certificate", newTestCert(t, trustedCA, []string{"alice"}, func(c *gossh.Certificate) { c.CertType = gossh.HostCert }), 0},
+		{"unknown principal", newTestCert(t, trustedCA, []string{"nobody"}, nil), 0},
+		{"no principals", newTestCert(t, trustedCA, nil, nil), 0},
+		{"expired", newTestCert(t, trustedCA, []string{"alice"}, func(c *gossh.Certificate) {
+			c.ValidBefore = uint64(time.Now().Add(-time.Minute).Unix())
+		}), 0},
+		{"not yet valid", newTestCert(t, trustedCA, []string{"alice"}, func(c *gossh.Certificate) {
+			c.ValidAfter = uint64(time.Now().Add(time.Hour).Unix())
+		}), 0},
+		{"allowed source address", newTestCert(t, trustedCA, []string{"alice"}, func(c *gossh.Certificate) {
+			c.CriticalOptions = map[string]string{sourceAddressOption: "10.0.0.1,192.0.2.0/24"}
+		}), aliceID},
+		{"other source address", newTestCert(t, trustedCA, []string{"alice"}, func(c *gossh.Certificate) {
+			c.CriticalOptions = map[string]string{sourceAddressOption: "10.0.0.0/8"}
+		}), 0},
+		{"unknown critical option", newTestCert(t, trustedCA, []string{"alice"}, func(c *gossh.Certificate) {
+			c.CriticalOptions = map[string]string{"verify-required": ""}
+		}), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := certUserID(db, tt.cert, remoteAddr, caKeys)
+			if got != tt.want {
+				t.Fatalf("certUserID = %d (%v), want %d", got, err, tt.want)
+			}
+			if tt.want == 0 && err == nil {
+				t.Error("rejected certificate without an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"sorcia/models"
+	"sorcia/pkg"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// sshCommandContext is what a management command runs with.
+type sshCommandContext struct {
+	s        ssh.Session
+	db       *sql.DB
+	conf     *pkg.BaseStruct
+	identity sshIdentity
+	args     []string
+}
+
+// sshCommand is a command for managing repositories over SSH, e.g.
+// "ssh git@example.com create project --private".
+type sshCommand struct {
+	usage       string
+	description string
+	// deployKeys is set for the commands deploy keys may run.
+	deployKeys bool
+	run        func(c *sshCommandContext) error
+}
+
+// sshManagementCommands are run for SSH commands which aren't git. They
+// use the same checks and models as the web UI.
+var sshManagementCommands map[string]sshCommand
+
+func init() {
+	sshManagementCommands = map[string]sshCommand{
+		"help":            {"help", "show this help", true, sshHelp},
+		"whoami":          {"whoami", "show who the key belongs to", true, sshWhoami},
+		"info":            {"info", "list the repositories you can access", true, sshInfo},
+		"create":          {"create <name> [--private]", "create a repository", false, sshCreate},
+		"set-description": {"set-description <repo> <description>", "change the description of a repository", false, sshSetDescription},
+		"set-private":     {"set-private <repo> yes|no", "make a repository private or public", false, sshSetPrivate},
+		"add-member":      {"add-member <repo> <username> [read|read/write]", "give a user access to a repository", false, sshAddMember},
+		"keys":            {"keys list", "list your SSH keys", false, sshKeys},
+	}
+}
+
+// runSSHManagementCommand runs a management command and ends the session.
+func runSSHManagementCommand(s ssh.Session, db *sql.DB, conf *pkg.BaseStruct, identity sshIdentity, command []string) {
+	// A plain "ssh git@example.com" shows the help.
+	if len(command) == 0 {
+		command = []string{"help"}
+	}
+
+	cmd := sshManagementCommands[command[0]]
+	if !cmd.deployKeys && identity.DeployKey != nil {
+		sshReject(s, "deploy keys can only run git commands, whoami and info")
+		return
+	}
+
+	c := &sshCommandContext{s: s, db: db, conf: conf, identity: identity, args: command[1:]}
+	if err := cmd.run(c); err != nil {
+		sshReject(s, err.Error())
+		return
+	}
+
+	s.Exit(0)
+}
+
+// isSSHManagementCommand reports whether the SSH command is a management
+// command instead of git.
+func isSSHManagementCommand(command []string) bool {
+	if len(command) == 0 {
+		return true
+	}
+
+	_, ok := sshManagementCommands[command[0]]
+	return ok
+}
+
+func (c *sshCommandContext) username() string {
+	return models.GetUsernameFromUserID(c.db, c.identity.UserID)
+}
+
+// repoAdmin loads a repository the user has to own.
+func (c *sshCommandContext) repoAdmin(reponame string) (*RepoContext, error) {
+	reponame = strings.TrimSuffix(reponame, ".git")
+
+	rc := LoadRepoContext(c.db, c.identity.UserID, reponame)
+	if !rc.Can(RepoAdmin) {
+		return nil, errors.New(sshNoRepoAccess)
+	}
+
+	return rc, nil
+}
+
+func sshHelp(c *sshCommandContext) error {
+	names := make([]string, 0, len(sshManagementCommands))
+	for name := range sshManagementCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(c.s, "sorcia commands:")
+
+	tw := tabwriter.NewWriter(c.s, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		cmd := sshManagementCommands[name]
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.usage, cmd.description)
+	}
+
+	return tw.Flush()
+}
+
+func sshWhoami(c *sshCommandContext) error {
+	if dk := c.identity.DeployKey; dk != nil {
+		permission := "read"
+		if dk.ReadWrite {
+			permission = "read/write"
+		}
+		fmt.Fprintf(c.s, "deploy key %q of %s (%s)\n", dk.Title, dk.Reponame, permission)
+		return nil
+	}
+
+	fmt.Fprintln(c.s, c.username())
+	return nil
+}
+
+func sshInfo(c *sshCommandContext) error {
+	tw := tabwriter.NewWriter(c.s, 0, 4, 2, ' ', 0)
+
+	for _, repo := range models.GetAllRepos(c.db).Repositories {
+		var permission string
+
+		if dk := c.identity.DeployKey; dk != nil {
+			if dk.RepoID != repo.ID {
+				continue
+			}
+
+			permission = "read"
+			if dk.ReadWrite {
+				permission = "read/write"
+			}
+		} else {
+			rc := LoadRepoContext(c.db, c.identity.UserID, repo.Name)
+
+			switch {
+			case rc.IsOwner:
+				permission = "owner"
+			case rc.Can(RepoWrite):
+				permission = "read/write"
+			case rc.Can(RepoRead):
+				permission = "read"
+			default:
+				continue
+			}
+		}
+
+		visibility := "public"
+		if repo.IsPrivate {
+			visibility = "private"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", permission, repo.Name, visibility, repo.Description)
+	}
+
+	return tw.Flush()
+}
+
+func sshCreate(c *sshCommandContext) error {
+	if len(c.args) == 0 || len(c.args) > 2 || (len(c.args) == 2 && c.args[1] != "--private") {
+		return errors.New("usage: create <name> [--private]")
+	}
+
+	userID := c.identity.UserID
+	reponame := strings.TrimSuffix(c.args[0], ".git")
+
+	if !models.CheckifUserCanCreateRepo(c.db, userID) {
+		return errors.New("You are not allowed to create repositories.")
+	}
+
+	if err := validateReponame(reponame); err != nil {
+		return err
+	}
+
+	if models.CheckRepoExists(c.db, reponame) {
+		return errors.New("Repository already exists.")
+	}
+
+	if err := checkCreateRepoQuota(c.db, c.conf, userID); err != nil {
+		return err
+	}
+
+	crs := models.CreateRepoStruct{
+		Name:   reponame,
+		UserID: userID,
+	}
+	if len(c.args) == 2 {
+		crs.IsPrivate = 1
+	}
+
+	createRepo(c.db, c.conf, crs)
+
+	fmt.Fprintf(c.s, "created %s/r/%s\n", c.conf.Server.BaseURL, reponame)
+	return nil
+}
+
+func sshSetDescription(c *sshCommandContext) error {
+	if len(c.args) < 1 {
+		return errors.New("usage: set-description <repo> <description>")
+	}
+
+	rc, err := c.repoAdmin(c.args[0])
+	if err != nil {
+		return err
+	}
+
+	urs := models.UpdateRepoStruct{
+		RepoID:      rc.RepoID,
+		NewName:     rc.Reponame,
+		Description: strings.Join(c.args[1:], " "),
+	}
+	if rc.IsPrivate {
+		urs.IsPrivate = 1
+	}
+
+	models.UpdateRepo(c.db, urs)
+	return nil
+}
+
+func sshSetPrivate(c *sshCommandContext) error {
+	if len(c.args) != 2 || (c.args[1] != "yes" && c.args[1] != "no") {
+		return errors.New("usage: set-private <repo> yes|no")
+	}
+
+	rc, err := c.repoAdmin(c.args[0])
+	if err != nil {
+		return err
+	}
+
+	urs := models.UpdateRepoStruct{
+		RepoID:      rc.RepoID,
+		NewName:     rc.Reponame,
+		Description: rc.Description,
+	}
+	if c.args[1] == "yes" {
+		urs.IsPrivate = 1
+	}
+
+	models.UpdateRepo(c.db, urs)
+	return nil
+}
+
+func sshAddMember(c *sshCommandContext) error {
+	if len(c.args) < 2 || len(c.args) > 3 {
+		return errors.New("usage: add-member <repo> <username> [read|read/write]")
+	}
+
+	permission := "read"
+	if len(c.args) == 3 {
+		permission = c.args[2]
+	}
+	if permission != "read" && permission != "read/write" {
+		return errors.New("Permission has to be read or read/write.")
+	}
+
+	rc, err := c.repoAdmin(c.args[0])
+	if err != nil {
+		return err
+	}
+
+	userID := models.GetUserIDFromUsername(c.db, c.args[1])
+	if userID <= 0 {
+		return errors.New("User does not exist. Check if the username is correct or ask the server/sys admin to add this user.")
+	}
+
+	if userID == rc.OwnerID {
+		return errors.New("User is the owner of this repository.")
+	}
+
+	if models.CheckRepoMemberExistFromUserIDAndRepoID(c.db, userID, rc.RepoID) {
+		return errors.New("User is already a member of this repository.")
+	}
+
+	models.InsertRepoMember(c.db, models.CreateRepoMember{
+		UserID:     userID,
+		RepoID:     rc.RepoID,
+		Permission: permission,
+	})
+	return nil
+}
+
+func sshKeys(c *sshCommandContext) error {
+	if len(c.args) != 1 || c.args[0] != "list" {
+		return errors.New("usage: keys list")
+	}
+
+	now := time.Now().Unix()
+	tw := tabwriter.NewWriter(c.s, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "TITLE\tFINGERPRINT\tEXPIRES\tLAST USED")
+	for _, key := range models.GetSSHKeysFromUserID(c.db, c.identity.UserID).SSHKeys {
+		expires := "never"
+		if key.ExpiresAt != 0 {
+			// Keys expire at the end of the day they were set to.
+			expires = time.Unix(key.ExpiresAt-1, 0).Format("2006-01-02")
+			if key.ExpiresAt <= now {
+				expires += " (expired)"
+			}
+		}
+
+		lastUsed := "never"
+		if key.LastUsedAt != 0 {
+			lastUsed = time.Unix(key.LastUsedAt, 0).Format("2006-01-02 15:04 MST")
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", key.Title, key.FingerprintSHA256, expires, lastUsed)
+	}
+
+	return tw.Flush()
+}
@@ -1,17 +1,26 @@
 package middleware
 
 import (
+	"crypto/subtle"
 	"database/sql"
+	"log"
 	"net/http"
+	"strings"
 
+	"sorcia/internal"
 	"sorcia/models"
 	"sorcia/pkg"
 
+	"github.com/gorilla/mux"
+
 	// SQLite3 driver
 	_ "github.com/mattn/go-sqlite3"
 )
 
 var middlewareDB *sql.DB
+var middlewareConf *pkg.BaseStruct
+
+const csrfCookieName = "sorcia-csrf"
 
 func init() {
 	// Get config values
@@ -20,6 +29,7 @@ func init() {
 	db := conf.DBConn
 
 	middlewareDB = db
+	middlewareConf = conf
 }
 
 // Middleware ...
@@ -44,8 +54,152 @@ func userMiddleware(w http.ResponseWriter, r *http.Request, db *sql.DB) http.Res
 		}
 	}
 
+	if middlewareConf.ProxyAuth.Enabled {
+		if token := proxyAuthToken(r, db); token != "" {
+			cookieValue = token
+			userPresent = "true"
+		}
+	}
+
 	w.Header().Set("sorcia-cookie-token", cookieValue)
 	w.Header().Set("user-present", userPresent)
 
 	return w
 }
+
+// proxyAuthToken returns the token of the account named in the configured
+// proxy header, or an empty string if the request can't be trusted.
+func proxyAuthToken(r *http.Request, db *sql.DB) string {
+	username := strings.TrimSpace(r.Header.Get(middlewareConf.ProxyAuth.Header))
+	if username == "" || !pkg.IsTrustedProxy(r.RemoteAddr) {
+		return ""
+	}
+
+	sphjwt := models.SelectPasswordHashAndJWTTokenStruct{
+		Username: username,
+	}
+	sphjwtr := models.SelectPasswordHashAndJWTToken(db, sphjwt)
+	if sphjwtr.Token != "" {
+		return sphjwtr.Token
+	}
+
+	if !middlewareConf.ProxyAuth.AutoCreate {
+		return ""
+	}
+
+	if len(username) > 39 || strings.HasPrefix(username, "-") || strings.Contains(username, "--") || strings.HasSuffix(username, "-") || !pkg.IsAlnumOrHyphen(username) {
+		log.Printf("proxy auth: invalid username %q", username)
+		return ""
+	}
+
+	// The account never logs in with a password, so it gets a random one.
+	passwordHash, err := internal.HashPassword(pkg.RandomString(32))
+	pkg.CheckError("Error on proxy auth hash password", err)
+
+	token, err := internal.GenerateJWTToken(passwordHash)
+	pkg.CheckError("Error on proxy auth generate jwt token", err)
+
+	canCreateRepo := 0
+	if middlewareConf.ProxyAuth.CanCreateRepo {
+		canCreateRepo = 1
+	}
+
+	// The first account of the instance becomes the admin, same as
+	// the register form on the login page.
+	isAdmin := 0
+	if !models.CheckIfFirstUserExists(db) {
+		canCreateRepo = 1
+		isAdmin = 1
+	}
+
+	cas := models.CreateAccountStruct{
+		Username:      username,
+		PasswordHash:  passwordHash,
+		Token:         token,
+		CanCreateRepo: canCreateRepo,
+		IsAdmin:       isAdmin,
+	}
+	models.InsertAccount(db, cas)
+
+	return token
+}
+
+// CSRF hands out a per-browser token in the "sorcia-csrf" cookie and rejects
+// POST requests whose csrf_token form field (or X-CSRF-Token header) doesn't
+// match it. Git smart HTTP requests are exempt since they never carry
+// cookies.
+func CSRF(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil && route.GetName() == "git-http" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		var token string
+		if cookie, err := r.Cookie(csrfCookieName); err == nil && cookie.Value != "" {
+			token = cookie.Value
+		} else {
+			token = pkg.RandomString(32)
+			c := &http.Cookie{Name: csrfCookieName, Value: token, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode}
+			http.SetCookie(w, c)
+		}
+
+		w.Header().Set("sorcia-csrf-token", token)
+
+		if r.Method == http.MethodPost {
+			formToken := r.Header.Get("X-CSRF-Token")
+			if formToken == "" {
+				formToken = r.PostFormValue("csrf_token")
+			}
+
+			if subtle.ConstantTimeCompare([]byte(formToken), []byte(token)) != 1 {
+				http.Error(w, "Invalid or missing CSRF token. Please reload the page and try again.", http.StatusForbidden)
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// RepoContext loads the repository of routes with a {reponame} variable and
+// what the logged in user may do with it. Requests for repositories the user
+// can't read are answered here.
+func RepoContext(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := mux.Vars(r)["reponame"]; !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if route := mux.CurrentRoute(r); route != nil && route.GetName() == "git-http" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		r, ok := internal.RepoRequest(w, r, middlewareDB)
+		if !ok {
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Admin only lets logged in admins through to h. Anonymous users are sent to
+// the login page and everyone else gets a 403 page.
+func Admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if w.Header().Get("user-present") != "true" {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		if !internal.IsAdminRequest(w, middlewareDB) {
+			internal.Forbidden(w, middlewareDB, middlewareConf, "Only admins of this instance can do that.")
+			return
+		}
+
+		h(w, r)
+	}
+}
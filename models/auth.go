@@ -115,6 +115,34 @@ func CheckifUserIsAnAdmin(db *sql.DB, userID int) bool {
 	return isAdmin
 }
 
+// PromoteAdmin makes the user an admin. Admins can always create
+// repositories.
+func PromoteAdmin(db *sql.DB, username string) {
+	stmt, err := db.Prepare("UPDATE account SET is_admin = 1, can_create_repo = 1 WHERE username = ?")
+	pkg.CheckError("Error on model promote admin", err)
+
+	_, err = stmt.Exec(username)
+	pkg.CheckError("Error on model promote admin exec", err)
+}
+
+// DemoteAdmin takes the admin role away from the user unless they are the
+// last admin of the instance. It reports whether the user was demoted.
+func DemoteAdmin(db *sql.DB, username string) bool {
+	stmt, err := db.Prepare("UPDATE account SET is_admin = 0 WHERE username = ? AND is_admin = 1 AND (SELECT COUNT(*) FROM account WHERE is_admin = 1) > 1")
+	pkg.CheckError("Error on model demote admin", err)
+
+	res, err := stmt.Exec(username)
+	pkg.CheckError("Error on model demote admin exec", err)
+	if err != nil {
+		return false
+	}
+
+	n, err := res.RowsAffected()
+	pkg.CheckError("Error on model demote admin rows affected", err)
+
+	return n == 1
+}
+
 // GetUserIDFromToken ...
 func GetUserIDFromToken(db *sql.DB, token string) int {
 	rows, err := db.Query("SELECT id FROM account WHERE jwt_token = ?", token)
@@ -264,36 +292,44 @@ func DeleteUserbyUsername(db *sql.DB, username string) {
 
 // CreateSSHPubKey ...
 func CreateSSHPubKey(db *sql.DB) {
-	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS ssh (id INTEGER PRIMARY KEY, user_id INTEGER NOT NULL, title TEXT NOT NULL, authorized_key TEXT UNIQUE NOT NULL, fingerprint TEXT UNIQUE NOT NULL, FOREIGN KEY (user_id) REFERENCES account (id) ON DELETE CASCADE)")
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS ssh (id INTEGER PRIMARY KEY, user_id INTEGER NOT NULL, title TEXT NOT NULL, authorized_key TEXT UNIQUE NOT NULL, fingerprint TEXT UNIQUE NOT NULL, fingerprint_sha256 TEXT NOT NULL DEFAULT '', expires_at INTEGER NOT NULL DEFAULT 0, last_used_at INTEGER NOT NULL DEFAULT 0, FOREIGN KEY (user_id) REFERENCES account (id) ON DELETE CASCADE)")
 	pkg.CheckError("Error on model create ssh pub key", err)
 
 	_, err = stmt.Exec()
 	pkg.CheckError("Error on model create ssh pub key exec", err)
+
+	addColumnIfNotExists(db, "ssh", "fingerprint_sha256", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfNotExists(db, "ssh", "expires_at", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfNotExists(db, "ssh", "last_used_at", "INTEGER NOT NULL DEFAULT 0")
+
+	backfillSSHFingerprintSHA256(db)
 }
 
 // InsertSSHPubKeyStruct struct
 type InsertSSHPubKeyStruct struct {
-	AuthKey     string
-	Title       string
-	Fingerprint string
-	UserID      int
+	AuthKey           string
+	Title             string
+	Fingerprint       string
+	FingerprintSHA256 string
+	ExpiresAt         int64
+	UserID            int
 }
 
 // InsertSSHPubKey ...
 func InsertSSHPubKey(db *sql.DB, ispk InsertSSHPubKeyStruct) {
-	stmt, err := db.Prepare("INSERT INTO ssh (user_id, title, authorized_key, fingerprint) VALUES (?, ?, ?, ?)")
+	stmt, err := db.Prepare("INSERT INTO ssh (user_id, title, authorized_key, fingerprint, fingerprint_sha256, expires_at) VALUES (?, ?, ?, ?, ?, ?)")
 	pkg.CheckError("Error on model insert ssh pub key", err)
 
-	_, err = stmt.Exec(ispk.UserID, ispk.Title, ispk.AuthKey, ispk.Fingerprint)
+	_, err = stmt.Exec(ispk.UserID, ispk.Title, ispk.AuthKey, ispk.Fingerprint, ispk.FingerprintSHA256, ispk.ExpiresAt)
 	pkg.CheckError("Error on model insert ssh pub key exec", err)
 }
 
-// DeleteSettingsKeyByID ...
-func DeleteSettingsKeyByID(db *sql.DB, id int) {
-	stmt, err := db.Prepare("DELETE FROM ssh WHERE id = ?")
+// DeleteSettingsKeyByID deletes the key if it belongs to the user.
+func DeleteSettingsKeyByID(db *sql.DB, id, userID int) {
+	stmt, err := db.Prepare("DELETE FROM ssh WHERE id = ? AND user_id = ?")
 	pkg.CheckError("Error on model delete settings key by id", err)
 
-	_, err = stmt.Exec(id)
+	_, err = stmt.Exec(id, userID)
 	pkg.CheckError("Error on model delete settings key by id exec", err)
 }
 
@@ -304,21 +340,24 @@ type SSHKeysResponse struct {
 
 // SSHDetail struct
 type SSHDetail struct {
-	ID          int
-	Title       string
-	Fingerprint string
+	ID                int
+	Title             string
+	Fingerprint       string
+	FingerprintSHA256 string
+	ExpiresAt         int64
+	LastUsedAt        int64
 }
 
 // GetSSHKeysFromUserID ...
 func GetSSHKeysFromUserID(db *sql.DB, userID int) *SSHKeysResponse {
-	rows, err := db.Query("SELECT id, title, fingerprint FROM ssh WHERE user_id = ?", userID)
+	rows, err := db.Query("SELECT id, title, fingerprint, fingerprint_sha256, expires_at, last_used_at FROM ssh WHERE user_id = ?", userID)
 	pkg.CheckError("Error on model get ssh key from userid", err)
 
 	var sdr SSHDetail
 	var skr SSHKeysResponse
 
 	for rows.Next() {
-		err = rows.Scan(&sdr.ID, &sdr.Title, &sdr.Fingerprint)
+		err = rows.Scan(&sdr.ID, &sdr.Title, &sdr.Fingerprint, &sdr.FingerprintSHA256, &sdr.ExpiresAt, &sdr.LastUsedAt)
 		pkg.CheckError("Error on model get ssh key from userid rows scan", err)
 
 		skr.SSHKeys = append(skr.SSHKeys, sdr)
@@ -328,30 +367,61 @@ func GetSSHKeysFromUserID(db *sql.DB, userID int) *SSHKeysResponse {
 	return &skr
 }
 
+// GetSSHKeyOwnerFromFingerprint returns the ID of the user the key with the
+// fingerprint belongs to, 0 if no user has it.
+func GetSSHKeyOwnerFromFingerprint(db *sql.DB, fingerprint string) int {
+	rows, err := db.Query("SELECT user_id FROM ssh WHERE fingerprint = ?", fingerprint)
+	pkg.CheckError("Error on model get ssh key owner from fingerprint", err)
+
+	var userID int
+
+	if rows.Next() {
+		err = rows.Scan(&userID)
+		pkg.CheckError("Error on model get ssh key owner from fingerprint rows scan", err)
+	}
+	rows.Close()
+
+	return userID
+}
+
+// UpdateSSHKeyLastUsed ...
+func UpdateSSHKeyLastUsed(db *sql.DB, id int, lastUsedAt int64) {
+	stmt, err := db.Prepare("UPDATE ssh SET last_used_at = ? WHERE id = ?")
+	pkg.CheckError("Error on model update ssh key last used", err)
+
+	_, err = stmt.Exec(lastUsedAt, id)
+	pkg.CheckError("Error on model update ssh key last used exec", err)
+}
+
 // SSHAllAuthKeysResponse struct
 type SSHAllAuthKeysResponse struct {
+	KeyIDs   []int
 	UserIDs  []string
 	AuthKeys []string
 }
 
-// GetSSHAllAuthKeys ...
-func GetSSHAllAuthKeys(db *sql.DB) *SSHAllAuthKeysResponse {
-	rows, err := db.Query("SELECT user_id, authorized_key FROM ssh")
+// GetSSHAllAuthKeys returns all keys of users which haven't expired at now.
+func GetSSHAllAuthKeys(db *sql.DB, now int64) *SSHAllAuthKeysResponse {
+	rows, err := db.Query("SELECT id, user_id, authorized_key FROM ssh WHERE expires_at = 0 OR expires_at > ?", now)
 	pkg.CheckError("Error on model get ssh all auth keys", err)
 
+	var keyID int
 	var userID, authKey string
+	var keyIDs []int
 	var userIDs, authKeys []string
 
 	for rows.Next() {
-		err = rows.Scan(&userID, &authKey)
+		err = rows.Scan(&keyID, &userID, &authKey)
 		pkg.CheckError("Error on model get ssh all auth keys rows scan", err)
 
+		keyIDs = append(keyIDs, keyID)
 		userIDs = append(userIDs, userID)
 		authKeys = append(authKeys, authKey)
 	}
 	rows.Close()
 
 	saks := &SSHAllAuthKeysResponse{
+		keyIDs,
 		userIDs,
 		authKeys,
 	}
@@ -359,6 +429,32 @@ func GetSSHAllAuthKeys(db *sql.DB) *SSHAllAuthKeysResponse {
 	return saks
 }
 
+// backfillSSHFingerprintSHA256 computes the SHA256 fingerprints of keys
+// which were added before they were stored.
+func backfillSSHFingerprintSHA256(db *sql.DB) {
+	rows, err := db.Query("SELECT id, authorized_key FROM ssh WHERE fingerprint_sha256 = ''")
+	pkg.CheckError("Error on model backfill ssh fingerprint sha256", err)
+
+	var id int
+	var authKey string
+	fingerprints := make(map[int]string)
+
+	for rows.Next() {
+		err = rows.Scan(&id, &authKey)
+		pkg.CheckError("Error on model backfill ssh fingerprint sha256 rows scan", err)
+
+		if key, err := pkg.ParseSSHKey(authKey, 0); err == nil {
+			fingerprints[id] = key.FingerprintSHA256
+		}
+	}
+	rows.Close()
+
+	for id, fingerprint := range fingerprints {
+		_, err = db.Exec("UPDATE ssh SET fingerprint_sha256 = ? WHERE id = ?", fingerprint, id)
+		pkg.CheckError("Error on model backfill ssh fingerprint sha256 update", err)
+	}
+}
+
 // CreateSiteSettings ...
 func CreateSiteSettings(db *sql.DB) {
 	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS site_settings (id INTEGER PRIMARY KEY, title TEXT NOT NULL, favicon TEXT, logo TEXT, logo_width TEXT, logo_height TEXT, style TEXT DEFAULT 'default')")
@@ -0,0 +1,104 @@
+package models
+
+import (
+	"database/sql"
+
+	"sorcia/pkg"
+)
+
+// CreateDeployKey ...
+func CreateDeployKey(db *sql.DB) {
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS deploy_key (id INTEGER PRIMARY KEY, repo_id INTEGER NOT NULL, title TEXT NOT NULL, authorized_key TEXT NOT NULL, fingerprint TEXT UNIQUE NOT NULL, read_write BOOLEAN DEFAULT 0, FOREIGN KEY (repo_id) REFERENCES repository (id) ON DELETE CASCADE)")
+	pkg.CheckError("Error on model create deploy key", err)
+
+	_, err = stmt.Exec()
+	pkg.CheckError("Error on model create deploy key exec", err)
+}
+
+// InsertDeployKeyStruct struct
+type InsertDeployKeyStruct struct {
+	RepoID      int
+	Title       string
+	AuthKey     string
+	Fingerprint string
+	ReadWrite   bool
+}
+
+// InsertDeployKey ...
+func InsertDeployKey(db *sql.DB, idk InsertDeployKeyStruct) {
+	stmt, err := db.Prepare("INSERT INTO deploy_key (repo_id, title, authorized_key, fingerprint, read_write) VALUES (?, ?, ?, ?, ?)")
+	pkg.CheckError("Error on model insert deploy key", err)
+
+	_, err = stmt.Exec(idk.RepoID, idk.Title, idk.AuthKey, idk.Fingerprint, idk.ReadWrite)
+	pkg.CheckError("Error on model insert deploy key exec", err)
+}
+
+// DeployKey struct
+type DeployKey struct {
+	ID          int
+	RepoID      int
+	Reponame    string
+	Title       string
+	AuthKey     string
+	Fingerprint string
+	ReadWrite   bool
+}
+
+// GetDeployKeysFromRepoID ...
+func GetDeployKeysFromRepoID(db *sql.DB, repoID int) []DeployKey {
+	rows, err := db.Query("SELECT deploy_key.id, deploy_key.repo_id, repository.name, deploy_key.title, deploy_key.authorized_key, deploy_key.fingerprint, deploy_key.read_write FROM deploy_key INNER JOIN repository ON repository.id = deploy_key.repo_id WHERE deploy_key.repo_id = ?", repoID)
+	pkg.CheckError("Error on model get deploy keys from repo id", err)
+
+	var dk DeployKey
+	var dks []DeployKey
+
+	for rows.Next() {
+		err = rows.Scan(&dk.ID, &dk.RepoID, &dk.Reponame, &dk.Title, &dk.AuthKey, &dk.Fingerprint, &dk.ReadWrite)
+		pkg.CheckError("Error on model get deploy keys from repo id rows scan", err)
+
+		dks = append(dks, dk)
+	}
+	rows.Close()
+
+	return dks
+}
+
+// GetAllDeployKeys ...
+func GetAllDeployKeys(db *sql.DB) []DeployKey {
+	rows, err := db.Query("SELECT deploy_key.id, deploy_key.repo_id, repository.name, deploy_key.title, deploy_key.authorized_key, deploy_key.fingerprint, deploy_key.read_write FROM deploy_key INNER JOIN repository ON repository.id = deploy_key.repo_id")
+	pkg.CheckError("Error on model get all deploy keys", err)
+
+	var dk DeployKey
+	var dks []DeployKey
+
+	for rows.Next() {
+		err = rows.Scan(&dk.ID, &dk.RepoID, &dk.Reponame, &dk.Title, &dk.AuthKey, &dk.Fingerprint, &dk.ReadWrite)
+		pkg.CheckError("Error on model get all deploy keys rows scan", err)
+
+		dks = append(dks, dk)
+	}
+	rows.Close()
+
+	return dks
+}
+
+// DeleteDeployKeyByID deletes the deploy key if it belongs to the repository.
+func DeleteDeployKeyByID(db *sql.DB, id, repoID int) {
+	stmt, err := db.Prepare("DELETE FROM deploy_key WHERE id = ? AND repo_id = ?")
+	pkg.CheckError("Error on model delete deploy key by id", err)
+
+	_, err = stmt.Exec(id, repoID)
+	pkg.CheckError("Error on model delete deploy key by id exec", err)
+}
+
+// CheckSSHFingerprintExists reports whether a user key or a deploy key with
+// the fingerprint exists. A key can only ever identify one of them.
+func CheckSSHFingerprintExists(db *sql.DB, fingerprint string) bool {
+	rows, err := db.Query("SELECT fingerprint FROM ssh WHERE fingerprint = ? UNION SELECT fingerprint FROM deploy_key WHERE fingerprint = ?", fingerprint, fingerprint)
+	pkg.CheckError("Error on model check ssh fingerprint exists", err)
+
+	exists := rows.Next()
+	rows.Close()
+
+	return exists
+}
@@ -0,0 +1,206 @@
+package models
+
+import (
+	"database/sql"
+
+	"sorcia/pkg"
+)
+
+// CreateInvite ...
+func CreateInvite(db *sql.DB) {
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS invite (id INTEGER PRIMARY KEY, token TEXT UNIQUE NOT NULL, created_by INTEGER NOT NULL, can_create_repo BOOLEAN DEFAULT 0, is_admin BOOLEAN DEFAULT 0, expires_at INTEGER NOT NULL, used BOOLEAN DEFAULT 0, FOREIGN KEY (created_by) REFERENCES account (id) ON DELETE CASCADE)")
+	pkg.CheckError("Error on model create invite", err)
+
+	_, err = stmt.Exec()
+	pkg.CheckError("Error on model create invite exec", err)
+}
+
+// InsertInviteStruct struct
+type InsertInviteStruct struct {
+	Token         string
+	CreatedBy     int
+	CanCreateRepo int
+	IsAdmin       int
+	ExpiresAt     int64
+}
+
+// InsertInvite ...
+func InsertInvite(db *sql.DB, iis InsertInviteStruct) {
+	stmt, err := db.Prepare("INSERT INTO invite (token, created_by, can_create_repo, is_admin, expires_at) VALUES (?, ?, ?, ?, ?)")
+	pkg.CheckError("Error on model insert invite", err)
+
+	_, err = stmt.Exec(iis.Token, iis.CreatedBy, iis.CanCreateRepo, iis.IsAdmin, iis.ExpiresAt)
+	pkg.CheckError("Error on model insert invite exec", err)
+}
+
+// Invite struct
+type Invite struct {
+	ID            int
+	Token         string
+	CanCreateRepo bool
+	IsAdmin       bool
+	ExpiresAt     int64
+}
+
+// GetInviteFromToken returns the invite with the given token if it's unused
+// and not expired. The ID of the returned invite is 0 otherwise.
+func GetInviteFromToken(db *sql.DB, token string, now int64) Invite {
+	rows, err := db.Query("SELECT id, token, can_create_repo, is_admin, expires_at FROM invite WHERE token = ? AND used = 0 AND expires_at > ?", token, now)
+	pkg.CheckError("Error on model get invite from token", err)
+
+	var invite Invite
+
+	if rows.Next() {
+		err = rows.Scan(&invite.ID, &invite.Token, &invite.CanCreateRepo, &invite.IsAdmin, &invite.ExpiresAt)
+		pkg.CheckError("Error on model get invite from token rows scan", err)
+	}
+	rows.Close()
+
+	return invite
+}
+
+// GetActiveInvites ...
+func GetActiveInvites(db *sql.DB, now int64) []Invite {
+	rows, err := db.Query("SELECT id, token, can_create_repo, is_admin, expires_at FROM invite WHERE used = 0 AND expires_at > ? ORDER BY expires_at", now)
+	pkg.CheckError("Error on model get active invites", err)
+
+	var invite Invite
+	var invites []Invite
+
+	for rows.Next() {
+		err = rows.Scan(&invite.ID, &invite.Token, &invite.CanCreateRepo, &invite.IsAdmin, &invite.ExpiresAt)
+		pkg.CheckError("Error on model get active invites rows scan", err)
+
+		invites = append(invites, invite)
+	}
+	rows.Close()
+
+	return invites
+}
+
+// InsertAccountFromInvite creates the account of an invite and marks the
+// invite as used in one transaction, so that two concurrent sign ups can't
+// share one invite and a failed insert doesn't use it up. It reports whether
+// the invite was still unused.
+func InsertAccountFromInvite(db *sql.DB, inviteID int, cas CreateAccountStruct) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE invite SET used = 1 WHERE id = ? AND used = 0", inviteID)
+	if err != nil {
+		return false, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return false, err
+	}
+
+	_, err = tx.Exec("INSERT INTO account (username, password_hash, jwt_token, can_create_repo, is_admin) VALUES (?, ?, ?, ?, ?)", cas.Username, cas.PasswordHash, cas.Token, cas.CanCreateRepo, cas.IsAdmin)
+	if err != nil {
+		return true, err
+	}
+
+	return true, tx.Commit()
+}
+
+// DeleteInviteByID ...
+func DeleteInviteByID(db *sql.DB, id int) {
+	stmt, err := db.Prepare("DELETE FROM invite WHERE id = ?")
+	pkg.CheckError("Error on model delete invite by id", err)
+
+	_, err = stmt.Exec(id)
+	pkg.CheckError("Error on model delete invite by id exec", err)
+}
+
+// CreatePasswordReset ...
+func CreatePasswordReset(db *sql.DB) {
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS password_reset (id INTEGER PRIMARY KEY, user_id INTEGER NOT NULL, token TEXT UNIQUE NOT NULL, expires_at INTEGER NOT NULL, used BOOLEAN DEFAULT 0, FOREIGN KEY (user_id) REFERENCES account (id) ON DELETE CASCADE)")
+	pkg.CheckError("Error on model create password reset", err)
+
+	_, err = stmt.Exec()
+	pkg.CheckError("Error on model create password reset exec", err)
+}
+
+// InsertPasswordReset ...
+func InsertPasswordReset(db *sql.DB, userID int, token string, expiresAt int64) {
+	stmt, err := db.Prepare("INSERT INTO password_reset (user_id, token, expires_at) VALUES (?, ?, ?)")
+	pkg.CheckError("Error on model insert password reset", err)
+
+	_, err = stmt.Exec(userID, token, expiresAt)
+	pkg.CheckError("Error on model insert password reset exec", err)
+}
+
+// PasswordReset struct
+type PasswordReset struct {
+	ID        int
+	UserID    int
+	Username  string
+	Token     string
+	ExpiresAt int64
+}
+
+// GetPasswordResetFromToken returns the password reset with the given token
+// if it's unused and not expired. The ID is 0 otherwise.
+func GetPasswordResetFromToken(db *sql.DB, token string, now int64) PasswordReset {
+	rows, err := db.Query("SELECT password_reset.id, password_reset.user_id, account.username, password_reset.token, password_reset.expires_at FROM password_reset INNER JOIN account ON account.id = password_reset.user_id WHERE password_reset.token = ? AND password_reset.used = 0 AND password_reset.expires_at > ?", token, now)
+	pkg.CheckError("Error on model get password reset from token", err)
+
+	var pr PasswordReset
+
+	if rows.Next() {
+		err = rows.Scan(&pr.ID, &pr.UserID, &pr.Username, &pr.Token, &pr.ExpiresAt)
+		pkg.CheckError("Error on model get password reset from token rows scan", err)
+	}
+	rows.Close()
+
+	return pr
+}
+
+// GetActivePasswordResets ...
+func GetActivePasswordResets(db *sql.DB, now int64) []PasswordReset {
+	rows, err := db.Query("SELECT password_reset.id, password_reset.user_id, account.username, password_reset.token, password_reset.expires_at FROM password_reset INNER JOIN account ON account.id = password_reset.user_id WHERE password_reset.used = 0 AND password_reset.expires_at > ? ORDER BY password_reset.expires_at", now)
+	pkg.CheckError("Error on model get active password resets", err)
+
+	var pr PasswordReset
+	var prs []PasswordReset
+
+	for rows.Next() {
+		err = rows.Scan(&pr.ID, &pr.UserID, &pr.Username, &pr.Token, &pr.ExpiresAt)
+		pkg.CheckError("Error on model get active password resets rows scan", err)
+
+		prs = append(prs, pr)
+	}
+	rows.Close()
+
+	return prs
+}
+
+// ResetPasswordFromReset sets the new password of a password reset and
+// marks the reset as used in one transaction. It reports whether the reset
+// was still unused.
+func ResetPasswordFromReset(db *sql.DB, resetID int, resetPass ResetUserPasswordbyUsernameStruct) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE password_reset SET used = 1 WHERE id = ? AND used = 0", resetID)
+	if err != nil {
+		return false, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return false, err
+	}
+
+	_, err = tx.Exec("UPDATE account SET password_hash = ?, jwt_token = ? WHERE username = ?", resetPass.PasswordHash, resetPass.JwtToken, resetPass.Username)
+	if err != nil {
+		return true, err
+	}
+
+	return true, tx.Commit()
+}
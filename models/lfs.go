@@ -0,0 +1,135 @@
+package models
+
+import (
+	"database/sql"
+
+	"sorcia/pkg"
+)
+
+// CreateLFS ...
+func CreateLFS(db *sql.DB) {
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS lfs_token (id INTEGER PRIMARY KEY, token TEXT UNIQUE NOT NULL, repo_id INTEGER NOT NULL, user_id INTEGER NOT NULL DEFAULT 0, deploy_key_id INTEGER NOT NULL DEFAULT 0, can_write BOOLEAN DEFAULT 0, expires_at INTEGER NOT NULL, FOREIGN KEY (repo_id) REFERENCES repository (id) ON DELETE CASCADE)")
+	pkg.CheckError("Error on model create lfs token", err)
+
+	_, err = stmt.Exec()
+	pkg.CheckError("Error on model create lfs token exec", err)
+
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS lfs_lock (id INTEGER PRIMARY KEY, repo_id INTEGER NOT NULL, path TEXT NOT NULL, user_id INTEGER NOT NULL, locked_at INTEGER NOT NULL, UNIQUE (repo_id, path), FOREIGN KEY (repo_id) REFERENCES repository (id) ON DELETE CASCADE, FOREIGN KEY (user_id) REFERENCES account (id) ON DELETE CASCADE)")
+	pkg.CheckError("Error on model create lfs lock", err)
+
+	_, err = stmt.Exec()
+	pkg.CheckError("Error on model create lfs lock exec", err)
+}
+
+// LFSToken is handed out by git-lfs-authenticate over SSH and used instead
+// of a password for the LFS API of one repository.
+type LFSToken struct {
+	Token       string
+	RepoID      int
+	UserID      int
+	DeployKeyID int
+	CanWrite    bool
+	ExpiresAt   int64
+}
+
+// InsertLFSToken stores a token and removes the expired ones.
+func InsertLFSToken(db *sql.DB, lt LFSToken, now int64) {
+	stmt, err := db.Prepare("DELETE FROM lfs_token WHERE expires_at <= ?")
+	pkg.CheckError("Error on model delete expired lfs tokens", err)
+
+	_, err = stmt.Exec(now)
+	pkg.CheckError("Error on model delete expired lfs tokens exec", err)
+
+	stmt, err = db.Prepare("INSERT INTO lfs_token (token, repo_id, user_id, deploy_key_id, can_write, expires_at) VALUES (?, ?, ?, ?, ?, ?)")
+	pkg.CheckError("Error on model insert lfs token", err)
+
+	_, err = stmt.Exec(lt.Token, lt.RepoID, lt.UserID, lt.DeployKeyID, lt.CanWrite, lt.ExpiresAt)
+	pkg.CheckError("Error on model insert lfs token exec", err)
+}
+
+// GetLFSToken returns the token if it isn't expired. The RepoID of the
+// returned token is 0 otherwise.
+func GetLFSToken(db *sql.DB, token string, now int64) LFSToken {
+	rows, err := db.Query("SELECT token, repo_id, user_id, deploy_key_id, can_write, expires_at FROM lfs_token WHERE token = ? AND expires_at > ?", token, now)
+	pkg.CheckError("Error on model get lfs token", err)
+
+	var lt LFSToken
+
+	if rows.Next() {
+		err = rows.Scan(&lt.Token, &lt.RepoID, &lt.UserID, &lt.DeployKeyID, &lt.CanWrite, &lt.ExpiresAt)
+		pkg.CheckError("Error on model get lfs token rows scan", err)
+	}
+	rows.Close()
+
+	return lt
+}
+
+// LFSLock is a file locked with the LFS locking API.
+type LFSLock struct {
+	ID       int
+	RepoID   int
+	Path     string
+	UserID   int
+	Username string
+	LockedAt int64
+}
+
+// InsertLFSLock locks a path and returns the ID of the lock. It's 0 if the
+// path is already locked.
+func InsertLFSLock(db *sql.DB, lock LFSLock) int {
+	stmt, err := db.Prepare("INSERT OR IGNORE INTO lfs_lock (repo_id, path, user_id, locked_at) VALUES (?, ?, ?, ?)")
+	pkg.CheckError("Error on model insert lfs lock", err)
+
+	res, err := stmt.Exec(lock.RepoID, lock.Path, lock.UserID, lock.LockedAt)
+	pkg.CheckError("Error on model insert lfs lock exec", err)
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return 0
+	}
+
+	id, err := res.LastInsertId()
+	pkg.CheckError("Error on model insert lfs lock last insert id", err)
+
+	return int(id)
+}
+
+// GetLFSLocks returns the locks of a repository, optionally only the one
+// with the path or the ID.
+func GetLFSLocks(db *sql.DB, repoID int, path string, id int) []LFSLock {
+	query := "SELECT lfs_lock.id, lfs_lock.repo_id, lfs_lock.path, lfs_lock.user_id, account.username, lfs_lock.locked_at FROM lfs_lock INNER JOIN account ON account.id = lfs_lock.user_id WHERE lfs_lock.repo_id = ?"
+	args := []interface{}{repoID}
+
+	if path != "" {
+		query += " AND lfs_lock.path = ?"
+		args = append(args, path)
+	}
+	if id != 0 {
+		query += " AND lfs_lock.id = ?"
+		args = append(args, id)
+	}
+
+	rows, err := db.Query(query+" ORDER BY lfs_lock.id", args...)
+	pkg.CheckError("Error on model get lfs locks", err)
+
+	var lock LFSLock
+	var locks []LFSLock
+
+	for rows.Next() {
+		err = rows.Scan(&lock.ID, &lock.RepoID, &lock.Path, &lock.UserID, &lock.Username, &lock.LockedAt)
+		pkg.CheckError("Error on model get lfs locks rows scan", err)
+
+		locks = append(locks, lock)
+	}
+	rows.Close()
+
+	return locks
+}
+
+// DeleteLFSLockByID ...
+func DeleteLFSLockByID(db *sql.DB, id, repoID int) {
+	stmt, err := db.Prepare("DELETE FROM lfs_lock WHERE id = ? AND repo_id = ?")
+	pkg.CheckError("Error on model delete lfs lock", err)
+
+	_, err = stmt.Exec(id, repoID)
+	pkg.CheckError("Error on model delete lfs lock exec", err)
+}
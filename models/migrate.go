@@ -0,0 +1,40 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+
+	"sorcia/pkg"
+)
+
+// addColumnIfNotExists adds a column to a table created by an older version
+// of sorcia. CREATE TABLE IF NOT EXISTS leaves existing tables untouched.
+func addColumnIfNotExists(db *sql.DB, table, column, definition string) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	pkg.CheckError("Error on model table info", err)
+
+	var exists bool
+	cols, _ := rows.Columns()
+	values := make([]interface{}, len(cols))
+	for i := range values {
+		values[i] = new(sql.RawBytes)
+	}
+
+	for rows.Next() {
+		err = rows.Scan(values...)
+		pkg.CheckError("Error on model table info rows scan", err)
+
+		// The second column of table_info is the name of the column.
+		if string(*values[1].(*sql.RawBytes)) == column {
+			exists = true
+		}
+	}
+	rows.Close()
+
+	if exists {
+		return
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	pkg.CheckError("Error on model add column "+table+"."+column, err)
+}
@@ -0,0 +1,202 @@
+package models
+
+import (
+	"database/sql"
+
+	"sorcia/pkg"
+)
+
+// Authentication of mirrors.
+const (
+	MirrorAuthNone     = "none"
+	MirrorAuthPassword = "password"
+	MirrorAuthKey      = "key"
+)
+
+// CreatePushMirror ...
+func CreatePushMirror(db *sql.DB) {
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS push_mirror (id INTEGER PRIMARY KEY, repo_id INTEGER NOT NULL, url TEXT NOT NULL, auth_type TEXT NOT NULL DEFAULT 'none', username TEXT NOT NULL DEFAULT '', password TEXT NOT NULL DEFAULT '', private_key TEXT NOT NULL DEFAULT '', public_key TEXT NOT NULL DEFAULT '', last_sync_at INTEGER NOT NULL DEFAULT 0, last_error TEXT NOT NULL DEFAULT '', UNIQUE (repo_id, url), FOREIGN KEY (repo_id) REFERENCES repository (id) ON DELETE CASCADE)")
+	pkg.CheckError("Error on model create push mirror", err)
+
+	_, err = stmt.Exec()
+	pkg.CheckError("Error on model create push mirror exec", err)
+}
+
+// PushMirror is a remote every push to a repository is replicated to. The
+// password or the private key are stored as they have to be handed to git.
+type PushMirror struct {
+	ID         int
+	RepoID     int
+	Reponame   string
+	URL        string
+	AuthType   string
+	Username   string
+	Password   string
+	PrivateKey string
+	PublicKey  string
+	LastSyncAt int64
+	LastError  string
+}
+
+// InsertPushMirror ...
+func InsertPushMirror(db *sql.DB, pm PushMirror) {
+	stmt, err := db.Prepare("INSERT INTO push_mirror (repo_id, url, auth_type, username, password, private_key, public_key) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	pkg.CheckError("Error on model insert push mirror", err)
+
+	_, err = stmt.Exec(pm.RepoID, pm.URL, pm.AuthType, pm.Username, pm.Password, pm.PrivateKey, pm.PublicKey)
+	pkg.CheckError("Error on model insert push mirror exec", err)
+}
+
+const pushMirrorColumns = "push_mirror.id, push_mirror.repo_id, repository.name, push_mirror.url, push_mirror.auth_type, push_mirror.username, push_mirror.password, push_mirror.private_key, push_mirror.public_key, push_mirror.last_sync_at, push_mirror.last_error FROM push_mirror INNER JOIN repository ON repository.id = push_mirror.repo_id"
+
+func getPushMirrors(db *sql.DB, where string, args ...interface{}) []PushMirror {
+	rows, err := db.Query("SELECT "+pushMirrorColumns+where+" ORDER BY push_mirror.id", args...)
+	pkg.CheckError("Error on model get push mirrors", err)
+
+	var pm PushMirror
+	var mirrors []PushMirror
+
+	for rows.Next() {
+		err = rows.Scan(&pm.ID, &pm.RepoID, &pm.Reponame, &pm.URL, &pm.AuthType, &pm.Username, &pm.Password, &pm.PrivateKey, &pm.PublicKey, &pm.LastSyncAt, &pm.LastError)
+		pkg.CheckError("Error on model get push mirrors rows scan", err)
+
+		mirrors = append(mirrors, pm)
+	}
+	rows.Close()
+
+	return mirrors
+}
+
+// GetPushMirrorsFromRepoID ...
+func GetPushMirrorsFromRepoID(db *sql.DB, repoID int) []PushMirror {
+	return getPushMirrors(db, " WHERE push_mirror.repo_id = ?", repoID)
+}
+
+// GetAllPushMirrors ...
+func GetAllPushMirrors(db *sql.DB) []PushMirror {
+	return getPushMirrors(db, "")
+}
+
+// GetPushMirrorByID returns the mirror of the repository with the ID. The
+// ID of the returned mirror is 0 if there is none.
+func GetPushMirrorByID(db *sql.DB, id, repoID int) PushMirror {
+	for _, pm := range getPushMirrors(db, " WHERE push_mirror.id = ? AND push_mirror.repo_id = ?", id, repoID) {
+		return pm
+	}
+
+	return PushMirror{}
+}
+
+// CheckPushMirrorExists ...
+func CheckPushMirrorExists(db *sql.DB, repoID int, url string) bool {
+	rows, err := db.Query("SELECT id FROM push_mirror WHERE repo_id = ? AND url = ?", repoID, url)
+	pkg.CheckError("Error on model check push mirror exists", err)
+
+	exists := rows.Next()
+	rows.Close()
+
+	return exists
+}
+
+// UpdatePushMirrorStatus records the result of a sync, lastError is empty
+// if it succeeded.
+func UpdatePushMirrorStatus(db *sql.DB, id int, syncedAt int64, lastError string) {
+	stmt, err := db.Prepare("UPDATE push_mirror SET last_sync_at = ?, last_error = ? WHERE id = ?")
+	pkg.CheckError("Error on model update push mirror status", err)
+
+	_, err = stmt.Exec(syncedAt, lastError, id)
+	pkg.CheckError("Error on model update push mirror status exec", err)
+}
+
+// DeletePushMirrorByID ...
+func DeletePushMirrorByID(db *sql.DB, id, repoID int) {
+	stmt, err := db.Prepare("DELETE FROM push_mirror WHERE id = ? AND repo_id = ?")
+	pkg.CheckError("Error on model delete push mirror", err)
+
+	_, err = stmt.Exec(id, repoID)
+	pkg.CheckError("Error on model delete push mirror exec", err)
+}
+
+// CreatePullMirror ...
+func CreatePullMirror(db *sql.DB) {
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS pull_mirror (id INTEGER PRIMARY KEY, repo_id INTEGER UNIQUE NOT NULL, url TEXT NOT NULL, auth_type TEXT NOT NULL DEFAULT 'none', username TEXT NOT NULL DEFAULT '', password TEXT NOT NULL DEFAULT '', last_sync_at INTEGER NOT NULL DEFAULT 0, last_error TEXT NOT NULL DEFAULT '', FOREIGN KEY (repo_id) REFERENCES repository (id) ON DELETE CASCADE)")
+	pkg.CheckError("Error on model create pull mirror", err)
+
+	_, err = stmt.Exec()
+	pkg.CheckError("Error on model create pull mirror exec", err)
+}
+
+// PullMirror is a remote a repository is fetched from. Repositories with a
+// pull mirror can't be pushed to.
+type PullMirror struct {
+	ID         int
+	RepoID     int
+	Reponame   string
+	URL        string
+	AuthType   string
+	Username   string
+	Password   string
+	LastSyncAt int64
+	LastError  string
+}
+
+// InsertPullMirror ...
+func InsertPullMirror(db *sql.DB, pm PullMirror) {
+	stmt, err := db.Prepare("INSERT INTO pull_mirror (repo_id, url, auth_type, username, password) VALUES (?, ?, ?, ?, ?)")
+	pkg.CheckError("Error on model insert pull mirror", err)
+
+	_, err = stmt.Exec(pm.RepoID, pm.URL, pm.AuthType, pm.Username, pm.Password)
+	pkg.CheckError("Error on model insert pull mirror exec", err)
+}
+
+func getPullMirrors(db *sql.DB, where string, args ...interface{}) []PullMirror {
+	rows, err := db.Query("SELECT pull_mirror.id, pull_mirror.repo_id, repository.name, pull_mirror.url, pull_mirror.auth_type, pull_mirror.username, pull_mirror.password, pull_mirror.last_sync_at, pull_mirror.last_error FROM pull_mirror INNER JOIN repository ON repository.id = pull_mirror.repo_id"+where+" ORDER BY pull_mirror.id", args...)
+	pkg.CheckError("Error on model get pull mirrors", err)
+
+	var pm PullMirror
+	var mirrors []PullMirror
+
+	for rows.Next() {
+		err = rows.Scan(&pm.ID, &pm.RepoID, &pm.Reponame, &pm.URL, &pm.AuthType, &pm.Username, &pm.Password, &pm.LastSyncAt, &pm.LastError)
+		pkg.CheckError("Error on model get pull mirrors rows scan", err)
+
+		mirrors = append(mirrors, pm)
+	}
+	rows.Close()
+
+	return mirrors
+}
+
+// GetPullMirrorFromRepoID returns the pull mirror of the repository. Its ID
+// is 0 if the repository isn't a mirror.
+func GetPullMirrorFromRepoID(db *sql.DB, repoID int) PullMirror {
+	for _, pm := range getPullMirrors(db, " WHERE pull_mirror.repo_id = ?", repoID) {
+		return pm
+	}
+
+	return PullMirror{}
+}
+
+// GetAllPullMirrors ...
+func GetAllPullMirrors(db *sql.DB) []PullMirror {
+	return getPullMirrors(db, "")
+}
+
+// UpdatePullMirrorStatus records the result of a sync, lastError is empty
+// if it succeeded.
+func UpdatePullMirrorStatus(db *sql.DB, id int, syncedAt int64, lastError string) {
+	stmt, err := db.Prepare("UPDATE pull_mirror SET last_sync_at = ?, last_error = ? WHERE id = ?")
+	pkg.CheckError("Error on model update pull mirror status", err)
+
+	_, err = stmt.Exec(syncedAt, lastError, id)
+	pkg.CheckError("Error on model update pull mirror status exec", err)
+}
+
+// DeletePullMirrorFromRepoID turns the mirror into a normal repository.
+func DeletePullMirrorFromRepoID(db *sql.DB, repoID int) {
+	stmt, err := db.Prepare("DELETE FROM pull_mirror WHERE repo_id = ?")
+	pkg.CheckError("Error on model delete pull mirror", err)
+
+	_, err = stmt.Exec(repoID)
+	pkg.CheckError("Error on model delete pull mirror exec", err)
+}
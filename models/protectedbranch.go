@@ -0,0 +1,120 @@
+package models
+
+import (
+	"database/sql"
+
+	"sorcia/pkg"
+)
+
+// CreateProtectedBranch ...
+func CreateProtectedBranch(db *sql.DB) {
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS protected_branch (id INTEGER PRIMARY KEY, repo_id INTEGER NOT NULL, pattern TEXT NOT NULL, no_force_push BOOLEAN DEFAULT 0, no_deletion BOOLEAN DEFAULT 0, UNIQUE (repo_id, pattern), FOREIGN KEY (repo_id) REFERENCES repository (id) ON DELETE CASCADE)")
+	pkg.CheckError("Error on model create protected branch", err)
+
+	_, err = stmt.Exec()
+	pkg.CheckError("Error on model create protected branch exec", err)
+
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS protected_branch_pusher (id INTEGER PRIMARY KEY, protected_branch_id INTEGER NOT NULL, user_id INTEGER NOT NULL, FOREIGN KEY (protected_branch_id) REFERENCES protected_branch (id) ON DELETE CASCADE, FOREIGN KEY (user_id) REFERENCES account (id) ON DELETE CASCADE)")
+	pkg.CheckError("Error on model create protected branch pusher", err)
+
+	_, err = stmt.Exec()
+	pkg.CheckError("Error on model create protected branch pusher exec", err)
+}
+
+// InsertProtectedBranchStruct struct
+type InsertProtectedBranchStruct struct {
+	RepoID         int
+	Pattern        string
+	NoForcePush    bool
+	NoDeletion     bool
+	AllowedUserIDs []int
+}
+
+// InsertProtectedBranch ...
+func InsertProtectedBranch(db *sql.DB, ipb InsertProtectedBranchStruct) {
+	stmt, err := db.Prepare("INSERT INTO protected_branch (repo_id, pattern, no_force_push, no_deletion) VALUES (?, ?, ?, ?)")
+	pkg.CheckError("Error on model insert protected branch", err)
+
+	res, err := stmt.Exec(ipb.RepoID, ipb.Pattern, ipb.NoForcePush, ipb.NoDeletion)
+	pkg.CheckError("Error on model insert protected branch exec", err)
+	if err != nil {
+		return
+	}
+
+	branchID, err := res.LastInsertId()
+	pkg.CheckError("Error on model insert protected branch last insert id", err)
+
+	stmt, err = db.Prepare("INSERT INTO protected_branch_pusher (protected_branch_id, user_id) VALUES (?, ?)")
+	pkg.CheckError("Error on model insert protected branch pusher", err)
+
+	for _, userID := range ipb.AllowedUserIDs {
+		_, err = stmt.Exec(branchID, userID)
+		pkg.CheckError("Error on model insert protected branch pusher exec", err)
+	}
+}
+
+// ProtectedBranch struct
+type ProtectedBranch struct {
+	ID               int
+	RepoID           int
+	Pattern          string
+	NoForcePush      bool
+	NoDeletion       bool
+	AllowedUserIDs   []int
+	AllowedUsernames []string
+}
+
+// GetProtectedBranchesFromRepoID ...
+func GetProtectedBranchesFromRepoID(db *sql.DB, repoID int) []ProtectedBranch {
+	rows, err := db.Query("SELECT id, repo_id, pattern, no_force_push, no_deletion FROM protected_branch WHERE repo_id = ? ORDER BY pattern", repoID)
+	pkg.CheckError("Error on model get protected branches from repo id", err)
+
+	var pb ProtectedBranch
+	var pbs []ProtectedBranch
+
+	for rows.Next() {
+		err = rows.Scan(&pb.ID, &pb.RepoID, &pb.Pattern, &pb.NoForcePush, &pb.NoDeletion)
+		pkg.CheckError("Error on model get protected branches from repo id rows scan", err)
+
+		pbs = append(pbs, pb)
+	}
+	rows.Close()
+
+	for i := range pbs {
+		rows, err := db.Query("SELECT account.id, account.username FROM protected_branch_pusher INNER JOIN account ON account.id = protected_branch_pusher.user_id WHERE protected_branch_pusher.protected_branch_id = ? ORDER BY account.username", pbs[i].ID)
+		pkg.CheckError("Error on model get protected branch pushers", err)
+
+		for rows.Next() {
+			var userID int
+			var username string
+			err = rows.Scan(&userID, &username)
+			pkg.CheckError("Error on model get protected branch pushers rows scan", err)
+
+			pbs[i].AllowedUserIDs = append(pbs[i].AllowedUserIDs, userID)
+			pbs[i].AllowedUsernames = append(pbs[i].AllowedUsernames, username)
+		}
+		rows.Close()
+	}
+
+	return pbs
+}
+
+// CheckProtectedBranchExists ...
+func CheckProtectedBranchExists(db *sql.DB, repoID int, pattern string) bool {
+	rows, err := db.Query("SELECT id FROM protected_branch WHERE repo_id = ? AND pattern = ?", repoID, pattern)
+	pkg.CheckError("Error on model check protected branch exists", err)
+
+	exists := rows.Next()
+	rows.Close()
+
+	return exists
+}
+
+// DeleteProtectedBranchByID deletes the rule if it belongs to the repository.
+func DeleteProtectedBranchByID(db *sql.DB, id, repoID int) {
+	stmt, err := db.Prepare("DELETE FROM protected_branch WHERE id = ? AND repo_id = ?")
+	pkg.CheckError("Error on model delete protected branch by id", err)
+
+	_, err = stmt.Exec(id, repoID)
+	pkg.CheckError("Error on model delete protected branch by id exec", err)
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"database/sql"
+
+	"sorcia/pkg"
+)
+
+// CreatePushPolicy ...
+func CreatePushPolicy(db *sql.DB) {
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS push_policy (repo_id INTEGER PRIMARY KEY, commit_message_regex TEXT NOT NULL DEFAULT '', max_blob_size INTEGER NOT NULL DEFAULT 0, forbidden_paths TEXT NOT NULL DEFAULT '', require_signoff BOOLEAN DEFAULT 0, secret_scanning TEXT NOT NULL DEFAULT 'warn', FOREIGN KEY (repo_id) REFERENCES repository (id) ON DELETE CASCADE)")
+	pkg.CheckError("Error on model create push policy", err)
+
+	_, err = stmt.Exec()
+	pkg.CheckError("Error on model create push policy exec", err)
+
+	addColumnIfNotExists(db, "push_policy", "secret_scanning", "TEXT NOT NULL DEFAULT 'warn'")
+}
+
+// PushPolicy struct
+type PushPolicy struct {
+	RepoID             int
+	CommitMessageRegex string
+	// MaxBlobSize is in bytes, 0 means no limit.
+	MaxBlobSize int64
+	// ForbiddenPaths are globs separated by newlines.
+	ForbiddenPaths string
+	RequireSignoff bool
+	// SecretScanning is one of the pkg.SecretScan modes.
+	SecretScanning string
+}
+
+// GetPushPolicy returns the push policy of the repository. Repositories
+// without a policy get the defaults, no restrictions and warnings about
+// secrets.
+func GetPushPolicy(db *sql.DB, repoID int) PushPolicy {
+	rows, err := db.Query("SELECT repo_id, commit_message_regex, max_blob_size, forbidden_paths, require_signoff, secret_scanning FROM push_policy WHERE repo_id = ?", repoID)
+	pkg.CheckError("Error on model get push policy", err)
+
+	pp := PushPolicy{RepoID: repoID, SecretScanning: pkg.SecretScanWarn}
+
+	if rows.Next() {
+		err = rows.Scan(&pp.RepoID, &pp.CommitMessageRegex, &pp.MaxBlobSize, &pp.ForbiddenPaths, &pp.RequireSignoff, &pp.SecretScanning)
+		pkg.CheckError("Error on model get push policy rows scan", err)
+	}
+	rows.Close()
+
+	return pp
+}
+
+// UpdatePushPolicy creates or replaces the push policy of a repository.
+func UpdatePushPolicy(db *sql.DB, pp PushPolicy) {
+	stmt, err := db.Prepare("INSERT OR REPLACE INTO push_policy (repo_id, commit_message_regex, max_blob_size, forbidden_paths, require_signoff, secret_scanning) VALUES (?, ?, ?, ?, ?, ?)")
+	pkg.CheckError("Error on model update push policy", err)
+
+	_, err = stmt.Exec(pp.RepoID, pp.CommitMessageRegex, pp.MaxBlobSize, pp.ForbiddenPaths, pp.RequireSignoff, pp.SecretScanning)
+	pkg.CheckError("Error on model update push policy exec", err)
+}
@@ -198,6 +198,7 @@ type RepoDetailStruct struct {
 	Description string
 	IsPrivate   bool
 	Permission  string
+	OwnerID     int
 }
 
 // GetReposFromUserID ...
@@ -237,6 +238,22 @@ func GetRepoFromRepoID(db *sql.DB, repoID int) RepoDetailStruct {
 	return rds
 }
 
+// GetRepoFromReponame ...
+func GetRepoFromReponame(db *sql.DB, reponame string) RepoDetailStruct {
+	rows, err := db.Query("SELECT id, name, description, is_private, user_id FROM repository WHERE name = ?", reponame)
+	pkg.CheckError("Error on model get repo from reponame", err)
+
+	var rds RepoDetailStruct
+
+	if rows.Next() {
+		err = rows.Scan(&rds.ID, &rds.Name, &rds.Description, &rds.IsPrivate, &rds.OwnerID)
+		pkg.CheckError("Error on model get repo from reponame rows scan", err)
+	}
+	rows.Close()
+
+	return rds
+}
+
 // GetAllPublicRepos ...
 func GetAllPublicRepos(db *sql.DB) GetReposStruct {
 	rows, err := db.Query("SELECT id, name, description FROM repository WHERE is_private = ?", false)
@@ -256,6 +273,25 @@ func GetAllPublicRepos(db *sql.DB) GetReposStruct {
 	return grfur
 }
 
+// GetAllRepos returns all repositories with their owners.
+func GetAllRepos(db *sql.DB) GetReposStruct {
+	rows, err := db.Query("SELECT id, name, description, is_private, user_id FROM repository ORDER BY name")
+	pkg.CheckError("Error on model get all repos", err)
+
+	var grs GetReposStruct
+	var rds RepoDetailStruct
+
+	for rows.Next() {
+		err = rows.Scan(&rds.ID, &rds.Name, &rds.Description, &rds.IsPrivate, &rds.OwnerID)
+		pkg.CheckError("Error on model get all repos rows scan", err)
+
+		grs.Repositories = append(grs.Repositories, rds)
+	}
+	rows.Close()
+
+	return grs
+}
+
 // GetRepoDescriptionFromRepoName ...
 func GetRepoDescriptionFromRepoName(db *sql.DB, reponame string) string {
 	rows, err := db.Query("SELECT description FROM repository WHERE name = ?", reponame)
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"database/sql"
+
+	"sorcia/pkg"
+)
+
+// CreateSigningKey ...
+func CreateSigningKey(db *sql.DB) {
+	stmt, err := db.Prepare("CREATE TABLE IF NOT EXISTS signing_key (id INTEGER PRIMARY KEY, user_id INTEGER NOT NULL, key_type TEXT NOT NULL, title TEXT NOT NULL, public_key TEXT NOT NULL, fingerprint TEXT UNIQUE NOT NULL, FOREIGN KEY (user_id) REFERENCES account (id) ON DELETE CASCADE)")
+	pkg.CheckError("Error on model create signing key", err)
+
+	_, err = stmt.Exec()
+	pkg.CheckError("Error on model create signing key exec", err)
+}
+
+// InsertSigningKeyStruct struct
+type InsertSigningKeyStruct struct {
+	UserID      int
+	KeyType     string
+	Title       string
+	PublicKey   string
+	Fingerprint string
+}
+
+// InsertSigningKey ...
+func InsertSigningKey(db *sql.DB, isk InsertSigningKeyStruct) {
+	stmt, err := db.Prepare("INSERT INTO signing_key (user_id, key_type, title, public_key, fingerprint) VALUES (?, ?, ?, ?, ?)")
+	pkg.CheckError("Error on model insert signing key", err)
+
+	_, err = stmt.Exec(isk.UserID, isk.KeyType, isk.Title, isk.PublicKey, isk.Fingerprint)
+	pkg.CheckError("Error on model insert signing key exec", err)
+}
+
+// SigningKey struct
+type SigningKey struct {
+	ID          int
+	UserID      int
+	Username    string
+	KeyType     string
+	Title       string
+	PublicKey   string
+	Fingerprint string
+}
+
+const signingKeyColumns = "signing_key.id, signing_key.user_id, account.username, signing_key.key_type, signing_key.title, signing_key.public_key, signing_key.fingerprint FROM signing_key INNER JOIN account ON account.id = signing_key.user_id"
+
+func scanSigningKeys(rows *sql.Rows, errMessage string) []SigningKey {
+	var sk SigningKey
+	var sks []SigningKey
+
+	for rows.Next() {
+		err := rows.Scan(&sk.ID, &sk.UserID, &sk.Username, &sk.KeyType, &sk.Title, &sk.PublicKey, &sk.Fingerprint)
+		pkg.CheckError(errMessage+" rows scan", err)
+
+		sks = append(sks, sk)
+	}
+	rows.Close()
+
+	return sks
+}
+
+// GetSigningKeysFromUserID ...
+func GetSigningKeysFromUserID(db *sql.DB, userID int) []SigningKey {
+	rows, err := db.Query("SELECT "+signingKeyColumns+" WHERE signing_key.user_id = ?", userID)
+	pkg.CheckError("Error on model get signing keys from user id", err)
+
+	return scanSigningKeys(rows, "Error on model get signing keys from user id")
+}
+
+// GetAllSigningKeys ...
+func GetAllSigningKeys(db *sql.DB) []SigningKey {
+	rows, err := db.Query("SELECT " + signingKeyColumns)
+	pkg.CheckError("Error on model get all signing keys", err)
+
+	return scanSigningKeys(rows, "Error on model get all signing keys")
+}
+
+// CheckSigningKeyFingerprintExists ...
+func CheckSigningKeyFingerprintExists(db *sql.DB, fingerprint string) bool {
+	rows, err := db.Query("SELECT id FROM signing_key WHERE fingerprint = ?", fingerprint)
+	pkg.CheckError("Error on model check signing key fingerprint exists", err)
+
+	exists := rows.Next()
+	rows.Close()
+
+	return exists
+}
+
+// DeleteSigningKeyByID deletes the signing key if it belongs to the user.
+func DeleteSigningKeyByID(db *sql.DB, id, userID int) {
+	stmt, err := db.Prepare("DELETE FROM signing_key WHERE id = ? AND user_id = ?")
+	pkg.CheckError("Error on model delete signing key by id", err)
+
+	_, err = stmt.Exec(id, userID)
+	pkg.CheckError("Error on model delete signing key by id exec", err)
+}
@@ -0,0 +1,50 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GitHookNames are the server-side hooks sorcia installs into every bare
+// repository.
+var GitHookNames = []string{"pre-receive", "update", "post-receive"}
+
+// CustomHooksDir is the directory of a bare repository which holds the
+// custom hook scripts added by admins.
+const CustomHooksDir = "custom_hooks"
+
+// InstallGitHooks writes the sorcia hooks into the bare repository. The
+// hooks run "sorcia hook <name>" from workDir, where the config is found.
+// Existing hooks with the same names are overwritten.
+func InstallGitHooks(repoDir, binPath, workDir string) error {
+	hooksDir := filepath.Join(repoDir, "hooks")
+	if err := os.MkdirAll(hooksDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	for _, name := range GitHookNames {
+		// git runs hooks of bare repositories with GIT_DIR=".", it has to
+		// be made absolute before changing the directory.
+		script := fmt.Sprintf("#!/bin/sh\n# Installed by sorcia, changes are overwritten.\nGIT_DIR=\"$(cd \"${GIT_DIR:-.}\" && pwd)\"\nexport GIT_DIR\ncd %s && exec %s hook %s \"$@\"\n", ShellQuote(workDir), ShellQuote(binPath), name)
+
+		hookPath := filepath.Join(hooksDir, name)
+		if err := ioutil.WriteFile(hookPath, []byte(script), 0755); err != nil {
+			return err
+		}
+
+		// WriteFile keeps the mode of an existing file.
+		if err := os.Chmod(hookPath, 0755); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ShellQuote quotes s for a POSIX shell.
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,175 @@
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// HostKeyTypes are the types of the SSH host keys, all of them are offered
+// to clients.
+var HostKeyTypes = []string{"ed25519", "ecdsa"}
+
+// legacyHostKeyFile is the RSA host key of older versions. It's still
+// offered, clients may only know it, until the first rotation.
+const legacyHostKeyFile = "id_rsa"
+
+// nextHostKeySuffix marks the keys of a rotation which don't replace the
+// current ones before the grace period is over.
+const nextHostKeySuffix = ".next"
+
+// HostKeyPath returns the file of the current host key of a type.
+func HostKeyPath(sshPath, keyType string) string {
+	return filepath.Join(sshPath, "ssh_host_"+keyType+"_key")
+}
+
+// HostKeyFiles returns the files of the host keys which are offered.
+func HostKeyFiles(sshPath string) []string {
+	var files []string
+
+	for _, keyType := range HostKeyTypes {
+		files = append(files, HostKeyPath(sshPath, keyType))
+	}
+
+	legacyPath := filepath.Join(sshPath, legacyHostKeyFile)
+	if _, err := os.Stat(legacyPath); err == nil {
+		files = append(files, legacyPath)
+	}
+
+	return files
+}
+
+// NextHostKeyFiles returns the files of the keys of a pending rotation and
+// when it was started. There are no files if no rotation is pending.
+func NextHostKeyFiles(sshPath string) ([]string, time.Time) {
+	var files []string
+	var startedAt time.Time
+
+	for _, keyType := range HostKeyTypes {
+		path := HostKeyPath(sshPath, keyType) + nextHostKeySuffix
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		files = append(files, path)
+		if startedAt.IsZero() || fi.ModTime().Before(startedAt) {
+			startedAt = fi.ModTime()
+		}
+	}
+
+	return files, startedAt
+}
+
+// GenerateHostKey creates a private key of a type of HostKeyTypes in PEM
+// format. ECDSA keys use P-256.
+func GenerateHostKey(keyType string) ([]byte, error) {
+	var block *pem.Block
+
+	switch keyType {
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	case "ecdsa":
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	default:
+		return nil, fmt.Errorf("unknown host key type %q", keyType)
+	}
+
+	return pem.EncodeToMemory(block), nil
+}
+
+func writeHostKey(path, keyType string) error {
+	key, err := GenerateHostKey(keyType)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, key, 0600)
+}
+
+// CreateSSHDirAndGenerateKey creates the SSH directory and the host keys
+// which don't exist yet.
+func CreateSSHDirAndGenerateKey(sshPath string) {
+	if _, err := os.Stat(sshPath); os.IsNotExist(err) {
+		err := os.MkdirAll(sshPath, os.ModePerm)
+		CheckError("Error on util create ssh dir and generate ssh key", err)
+	}
+
+	for _, keyType := range HostKeyTypes {
+		keyPath := HostKeyPath(sshPath, keyType)
+		if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+			err = writeHostKey(keyPath, keyType)
+			CheckError("Error on util generate "+keyType+" host key", err)
+		}
+	}
+}
+
+// RotateHostKeys starts a rotation by creating new host keys. They replace
+// the current ones when PromoteHostKeys is called after the grace period,
+// so users can add them to their known hosts before.
+func RotateHostKeys(sshPath string) error {
+	if files, _ := NextHostKeyFiles(sshPath); len(files) > 0 {
+		return errors.New("A rotation of the host keys is already pending.")
+	}
+
+	for _, keyType := range HostKeyTypes {
+		if err := writeHostKey(HostKeyPath(sshPath, keyType)+nextHostKeySuffix, keyType); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PromoteHostKeys replaces the current host keys with the keys of a
+// rotation which was started at least grace ago. The legacy RSA key is
+// removed with them. It reports whether the keys were replaced.
+func PromoteHostKeys(sshPath string, grace time.Duration) (bool, error) {
+	files, startedAt := NextHostKeyFiles(sshPath)
+	if len(files) == 0 || time.Since(startedAt) < grace {
+		return false, nil
+	}
+
+	for _, file := range files {
+		if err := os.Rename(file, strings.TrimSuffix(file, nextHostKeySuffix)); err != nil {
+			return false, err
+		}
+	}
+
+	for _, file := range []string{legacyHostKeyFile, legacyHostKeyFile + ".pub"} {
+		if err := os.Remove(filepath.Join(sshPath, file)); err != nil && !os.IsNotExist(err) {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,91 @@
+package pkg
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Kinds of mirror URLs.
+const (
+	MirrorURLSSH  = "ssh"
+	MirrorURLHTTP = "http"
+	MirrorURLFile = "file"
+)
+
+// MirrorGitProtocols are the only transports git may use for mirrors, which
+// rules out helpers like "ext::" that run commands.
+const MirrorGitProtocols = "ssh:http:https:file"
+
+var scpLikeURL = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[^:]`)
+
+// MirrorURLKind checks a mirror URL and returns its kind. URLs with a
+// password in them are refused, credentials are stored separately.
+func MirrorURLKind(rawURL string) (string, error) {
+	if scpLikeURL.MatchString(rawURL) {
+		return MirrorURLSSH, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" {
+		return "", errors.New("URL has to start with ssh://, http://, https:// or file://, or be like git@example.com:repo.git.")
+	}
+
+	if _, ok := u.User.Password(); ok {
+		return "", errors.New("Please don't put the password into the URL.")
+	}
+
+	switch u.Scheme {
+	case "ssh":
+		if u.Host == "" {
+			break
+		}
+		return MirrorURLSSH, nil
+	case "http", "https":
+		if u.Host == "" {
+			break
+		}
+		return MirrorURLHTTP, nil
+	case "file":
+		if u.Path == "" {
+			break
+		}
+		return MirrorURLFile, nil
+	}
+
+	return "", errors.New("URL has to start with ssh://, http://, https:// or file://, or be like git@example.com:repo.git.")
+}
+
+// GenerateSSHKeyPair creates an ed25519 key with ssh-keygen and returns the
+// private key in OpenSSH format and the public key in authorized_keys
+// format.
+func GenerateSSHKeyPair(comment string) (string, string, error) {
+	dir, err := ioutil.TempDir("", "sorcia-key")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.RemoveAll(dir)
+
+	keyPath := filepath.Join(dir, "id_ed25519")
+	out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", comment, "-f", keyPath).CombinedOutput()
+	if err != nil {
+		return "", "", errors.New("ssh-keygen: " + strings.TrimSpace(string(out)))
+	}
+
+	privateKey, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	publicKey, err := ioutil.ReadFile(keyPath + ".pub")
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(privateKey), strings.TrimSpace(string(publicKey)), nil
+}
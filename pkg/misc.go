@@ -1,13 +1,11 @@
 package pkg
 
 import (
-	"crypto/md5"
-	"encoding/base64"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
-	"strings"
 )
 
 // IsAlnumOrHyphen ...
@@ -20,28 +18,6 @@ func IsAlnumOrHyphen(s string) bool {
 	return true
 }
 
-// SSHFingerPrint ...
-func SSHFingerPrint(authKey string) string {
-	parts := strings.Fields(string(authKey))
-	if len(parts) < 2 {
-		log.Printf("bad key")
-	}
-
-	k, err := base64.StdEncoding.DecodeString(parts[1])
-	CheckError("Error on util ssh fingerprint decode string", err)
-
-	fp := md5.Sum([]byte(k))
-	var fingerPrint string
-	for i, b := range fp {
-		fingerPrint = fmt.Sprintf("%s%02x", fingerPrint, b)
-		if i < len(fp)-1 {
-			fingerPrint = fmt.Sprintf("%s:", fingerPrint)
-		}
-	}
-
-	return fingerPrint
-}
-
 // CreateDir ...
 func CreateDir(dir string) {
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
@@ -50,20 +26,6 @@ func CreateDir(dir string) {
 	}
 }
 
-// CreateSSHDirAndGenerateKey ...
-func CreateSSHDirAndGenerateKey(sshPath string) {
-	if _, err := os.Stat(sshPath); os.IsNotExist(err) {
-		err := os.MkdirAll(sshPath, os.ModePerm)
-		CheckError("Error on util create ssh dir and generate ssh key", err)
-	}
-
-	keyPath := filepath.Join(sshPath, "id_rsa")
-	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
-		args := []string{"-f", keyPath, "-t", "rsa", "-m", "PEM", "-N", ""}
-		_ = ForkExec("ssh-keygen", args, ".")
-	}
-}
-
 // LimitCharLengthInString ...
 func LimitCharLengthInString(limitString string) string {
 	if len(limitString) > 50 {
@@ -83,3 +45,43 @@ func ContainsValueInArr(a []string, x string) bool {
 	}
 	return false
 }
+
+// RandomString returns a hex encoded string of n random bytes.
+func RandomString(n int) string {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	CheckError("Error on util random string", err)
+
+	return hex.EncodeToString(b)
+}
+
+// FormatBytes formats a size in bytes for humans, e.g. "1.5 MB".
+func FormatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// DirSize returns the size of the files in a directory and its
+// subdirectories. Files which vanish while walking are skipped.
+func DirSize(dir string) int64 {
+	var size int64
+
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size
+}
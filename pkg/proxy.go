@@ -0,0 +1,57 @@
+package pkg
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+var trustedProxies []*net.IPNet
+
+func parseTrustedProxies(cidrs []string) {
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			CheckError("Error on parsing proxy_auth trusted_proxies", err)
+			continue
+		}
+		trustedProxies = append(trustedProxies, ipNet)
+	}
+}
+
+// IsTrustedProxy reports whether remoteAddr is one of the trusted_proxies
+// of the [proxy_auth] section.
+func IsTrustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientIP returns the IP address of the client of r. The X-Real-IP header
+// is only used when the request comes from a trusted proxy.
+func ClientIP(r *http.Request) string {
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" && IsTrustedProxy(r.RemoteAddr) {
+		return realIP
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
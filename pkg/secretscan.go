@@ -0,0 +1,218 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Secret scanning modes of a repository.
+const (
+	SecretScanOff    = "off"
+	SecretScanWarn   = "warn"
+	SecretScanReject = "reject"
+)
+
+// MaxSecretScanBlobSize is the size above which blobs aren't scanned.
+const MaxSecretScanBlobSize = 1024 * 1024
+
+// SecretRule finds one kind of secret. If the regex has a capture group,
+// the first group is the secret, otherwise the whole match. Matches whose
+// secret has a lower Shannon entropy than MinEntropy are ignored, which
+// filters out placeholders like "xxxx" or "changeme".
+type SecretRule struct {
+	ID          string
+	Description string
+	Regex       *regexp.Regexp
+	MinEntropy  float64
+}
+
+// SecretRules are the rules blobs are scanned with. More rules can be added
+// with AddSecretRule or the rules_file of [secret_scanning].
+var SecretRules = []SecretRule{
+	{"aws-access-key-id", "AWS access key ID", regexp.MustCompile(`\b((?:AKIA|ASIA)[0-9A-Z]{16})\b`), 3.0},
+	{"aws-secret-access-key", "AWS secret access key", regexp.MustCompile(`(?i)aws.{0,20}secret.{0,20}['"=:\s]\s*([0-9a-zA-Z/+]{40})\b`), 4.0},
+	{"private-key", "Private key", regexp.MustCompile(`-----BEGIN (?:RSA |EC |DSA |OPENSSH |PGP |ENCRYPTED )?PRIVATE KEY(?: BLOCK)?-----`), 0},
+	{"github-token", "GitHub token", regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,})\b`), 3.5},
+	{"gitlab-token", "GitLab personal access token", regexp.MustCompile(`\b(glpat-[A-Za-z0-9_\-]{20})\b`), 3.5},
+	{"slack-token", "Slack token", regexp.MustCompile(`\b(xox[baprs]-[0-9A-Za-z\-]{10,})\b`), 3.5},
+	{"google-api-key", "Google API key", regexp.MustCompile(`\b(AIza[0-9A-Za-z_\-]{35})\b`), 3.5},
+	{"stripe-secret-key", "Stripe secret key", regexp.MustCompile(`\b((?:sk|rk)_live_[0-9a-zA-Z]{24,})\b`), 3.5},
+	{"generic-secret", "Hard-coded secret", regexp.MustCompile(`(?i)(?:api[_-]?key|secret|token|passw(?:or)?d)["']?\s*[:=]\s*["']([A-Za-z0-9/+=_\-.]{16,})["']`), 4.0},
+}
+
+// AddSecretRule adds a rule to SecretRules.
+func AddSecretRule(rule SecretRule) {
+	SecretRules = append(SecretRules, rule)
+}
+
+// LoadSecretRules adds the rules of a rules file. Every non-empty line
+// which doesn't start with "#" is "<id> <min entropy> <regex>".
+func LoadSecretRules(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: expected \"<id> <min entropy> <regex>\"", file, i+1)
+		}
+
+		minEntropy, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid entropy %q", file, i+1, fields[1])
+		}
+
+		regex, err := regexp.Compile(strings.TrimSpace(fields[2]))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", file, i+1, err)
+		}
+
+		AddSecretRule(SecretRule{ID: fields[0], Description: fields[0], Regex: regex, MinEntropy: minEntropy})
+	}
+
+	return nil
+}
+
+// ShannonEntropy returns the entropy of s in bits per character.
+func ShannonEntropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+
+	counts := make(map[rune]int)
+	for _, r := range s {
+		counts[r]++
+	}
+
+	var entropy float64
+	n := float64(len([]rune(s)))
+	for _, count := range counts {
+		p := float64(count) / n
+		entropy -= p * math.Log2(p)
+	}
+
+	return entropy
+}
+
+// SecretFinding is a secret found in a file.
+type SecretFinding struct {
+	Rule   SecretRule
+	Line   int
+	Secret string
+}
+
+// Redacted returns the secret with most of it hidden, for reports.
+func (f SecretFinding) Redacted() string {
+	if len(f.Secret) <= 8 {
+		return strings.Repeat("*", len(f.Secret))
+	}
+
+	return f.Secret[:4] + strings.Repeat("*", 4) + f.Secret[len(f.Secret)-4:]
+}
+
+// ScanSecrets scans the content of a file with SecretRules. Binary content
+// isn't scanned.
+func ScanSecrets(content []byte) []SecretFinding {
+	sniff := content
+	if len(sniff) > 8000 {
+		sniff = sniff[:8000]
+	}
+	if bytes.IndexByte(sniff, 0) >= 0 {
+		return nil
+	}
+
+	var findings []SecretFinding
+
+	for lineNumber, line := range strings.Split(string(content), "\n") {
+		for _, rule := range SecretRules {
+			for _, match := range rule.Regex.FindAllStringSubmatch(line, -1) {
+				secret := match[0]
+				if len(match) > 1 && match[1] != "" {
+					secret = match[1]
+				}
+
+				if ShannonEntropy(secret) < rule.MinEntropy {
+					continue
+				}
+
+				findings = append(findings, SecretFinding{Rule: rule, Line: lineNumber + 1, Secret: secret})
+			}
+		}
+	}
+
+	return findings
+}
+
+// ReadGitBlobs streams the content of blobs out of a repository with
+// "git cat-file --batch". Missing objects are skipped.
+func ReadGitBlobs(repoDir string, blobs []string, fn func(blob string, content []byte)) error {
+	var input bytes.Buffer
+	for _, blob := range blobs {
+		input.WriteString(blob + "\n")
+	}
+
+	cmd := exec.Command(GetGitBinPath(), "cat-file", "--batch")
+	cmd.Dir = repoDir
+	cmd.Stdin = &input
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(stdout)
+	for {
+		header, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cmd.Wait()
+			return err
+		}
+
+		// "<object> <type> <size>" or "<object> missing"
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			continue
+		}
+
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			cmd.Wait()
+			return errors.New("unexpected cat-file output: " + header)
+		}
+
+		content := make([]byte, size+1)
+		if _, err := io.ReadFull(reader, content); err != nil {
+			cmd.Wait()
+			return err
+		}
+
+		if fields[1] == "blob" {
+			fn(fields[0], content[:size])
+		}
+	}
+
+	return cmd.Wait()
+}
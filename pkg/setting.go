@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	// SQLite3 driver
 	_ "github.com/mattn/go-sqlite3"
@@ -12,15 +15,24 @@ import (
 	"gopkg.in/ini.v1"
 )
 
-var conf BaseStruct
+var (
+	conf     BaseStruct
+	confOnce sync.Once
+)
 
 // BaseStruct struct
 type BaseStruct struct {
-	AppMode string
-	Version string
-	Paths   PathsStruct
-	Server  ServerStruct
-	DBConn  *sql.DB
+	AppMode   string
+	Version   string
+	Paths     PathsStruct
+	Server    ServerStruct
+	ProxyAuth ProxyAuthStruct
+	SSH       SSHStruct
+	Secrets   SecretScanningStruct
+	Quota     QuotaStruct
+	Mirror    MirrorStruct
+	Limits    LimitsStruct
+	DBConn    *sql.DB
 }
 
 // PathsStruct struct
@@ -36,11 +48,62 @@ type PathsStruct struct {
 
 // ServerStruct struct
 type ServerStruct struct {
-	HTTPPort string
-	SSHPort  string
+	HTTPPort           string
+	SSHPort            string
+	GitDaemonPort      string
+	BaseURL            string
+	CORSAllowedOrigins []string
+}
+
+// ProxyAuthStruct struct
+type ProxyAuthStruct struct {
+	Enabled        bool
+	Header         string
+	TrustedProxies []string
+	AutoCreate     bool
+	CanCreateRepo  bool
+}
+
+// SSHStruct struct
+type SSHStruct struct {
+	MinRSAKeySize     int
+	TrustedUserCAKeys []string
+	HostKeyGrace      time.Duration
+}
+
+// SecretScanningStruct struct
+type SecretScanningStruct struct {
+	RulesFile string
+}
+
+// QuotaStruct struct. Sizes are in bytes, 0 means no limit.
+type QuotaStruct struct {
+	MaxReposPerUser int
+	MaxRepoSize     int64
+	MaxUserSize     int64
+	MaxPushSize     int64
+	WarnPercent     int
+}
+
+// MirrorStruct struct
+type MirrorStruct struct {
+	PushInterval time.Duration
+	PullInterval time.Duration
+	Timeout      time.Duration
+}
+
+// LimitsStruct struct. Counts of 0 and durations of 0 mean no limit.
+type LimitsStruct struct {
+	MaxGitProcesses          int
+	MaxGitProcessesPerClient int
+	QueueTimeout             time.Duration
+	IdleTimeout              time.Duration
+	MaxDuration              time.Duration
 }
 
-func init() {
+// loadConf reads config/app.ini, or /home/git/sorcia/config/app.ini if it
+// doesn't exist, and opens the database.
+func loadConf() {
 	cfg, err := ini.Load("config/app.ini")
 	if err != nil {
 		cfg, err = ini.Load("/home/git/sorcia/config/app.ini")
@@ -63,19 +126,68 @@ func init() {
 			UploadAssetPath: cfg.Section("paths").Key("upload_asset_path").String(),
 		},
 		Server: ServerStruct{
-			HTTPPort: cfg.Section("server").Key("http_port").String(),
-			SSHPort:  cfg.Section("server").Key("ssh_port").String(),
+			HTTPPort:           cfg.Section("server").Key("http_port").String(),
+			SSHPort:            cfg.Section("server").Key("ssh_port").String(),
+			GitDaemonPort:      cfg.Section("server").Key("git_daemon_port").String(),
+			BaseURL:            strings.TrimSuffix(cfg.Section("server").Key("base_url").String(), "/"),
+			CORSAllowedOrigins: cfg.Section("server").Key("cors_allowed_origins").Strings(","),
+		},
+		ProxyAuth: ProxyAuthStruct{
+			Enabled:        cfg.Section("proxy_auth").Key("enabled").MustBool(false),
+			Header:         cfg.Section("proxy_auth").Key("header").MustString("X-Remote-User"),
+			TrustedProxies: cfg.Section("proxy_auth").Key("trusted_proxies").Strings(","),
+			AutoCreate:     cfg.Section("proxy_auth").Key("auto_create").MustBool(false),
+			CanCreateRepo:  cfg.Section("proxy_auth").Key("can_create_repo").MustBool(false),
+		},
+		SSH: SSHStruct{
+			MinRSAKeySize:     cfg.Section("ssh").Key("min_rsa_key_size").MustInt(2048),
+			TrustedUserCAKeys: cfg.Section("ssh").Key("trusted_user_ca_keys").Strings(","),
+			HostKeyGrace:      cfg.Section("ssh").Key("host_key_grace").MustDuration(7 * 24 * time.Hour),
+		},
+		Secrets: SecretScanningStruct{
+			RulesFile: cfg.Section("secret_scanning").Key("rules_file").String(),
+		},
+		Quota: QuotaStruct{
+			MaxReposPerUser: cfg.Section("quota").Key("max_repos_per_user").MustInt(0),
+			MaxRepoSize:     cfg.Section("quota").Key("max_repo_size_mb").MustInt64(0) * 1024 * 1024,
+			MaxUserSize:     cfg.Section("quota").Key("max_user_size_mb").MustInt64(0) * 1024 * 1024,
+			MaxPushSize:     cfg.Section("quota").Key("max_push_size_mb").MustInt64(0) * 1024 * 1024,
+			WarnPercent:     cfg.Section("quota").Key("warn_percent").MustInt(90),
+		},
+		Mirror: MirrorStruct{
+			PushInterval: cfg.Section("mirror").Key("push_interval").MustDuration(8 * time.Hour),
+			PullInterval: cfg.Section("mirror").Key("pull_interval").MustDuration(time.Hour),
+			Timeout:      cfg.Section("mirror").Key("timeout").MustDuration(10 * time.Minute),
+		},
+		Limits: LimitsStruct{
+			MaxGitProcesses:          cfg.Section("limits").Key("max_git_processes").MustInt(0),
+			MaxGitProcessesPerClient: cfg.Section("limits").Key("max_git_processes_per_client").MustInt(0),
+			QueueTimeout:             cfg.Section("limits").Key("queue_timeout").MustDuration(30 * time.Second),
+			IdleTimeout:              cfg.Section("limits").Key("idle_timeout").MustDuration(10 * time.Minute),
+			MaxDuration:              cfg.Section("limits").Key("max_duration").MustDuration(0),
 		},
 		DBConn: nil,
 	}
 
+	if conf.Server.BaseURL == "" {
+		conf.Server.BaseURL = "http://localhost:" + conf.Server.HTTPPort
+	}
+
+	parseTrustedProxies(conf.ProxyAuth.TrustedProxies)
+
+	if conf.Secrets.RulesFile != "" {
+		err := LoadSecretRules(conf.Secrets.RulesFile)
+		CheckError("Error on loading secret scanning rules", err)
+	}
+
 	db, err := sql.Open("sqlite3", filepath.Join(conf.Paths.DBPath, "sorcia.db?_foreign_keys=on"))
 	CheckError("Error on opening sqlite3", err)
 
 	conf.DBConn = db
 }
 
-// GetConf ...
+// GetConf returns the configuration, which is loaded on the first call.
 func GetConf() *BaseStruct {
+	confOnce.Do(loadConf)
 	return &conf
 }
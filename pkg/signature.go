@@ -0,0 +1,314 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Kinds of signatures found on git objects.
+const (
+	SignatureGPG = "gpg"
+	SignatureSSH = "ssh"
+)
+
+const sshSignatureArmorStart = "-----BEGIN SSH SIGNATURE-----"
+const sshSignatureArmorEnd = "-----END SSH SIGNATURE-----"
+const gpgSignatureArmorStart = "-----BEGIN PGP SIGNATURE-----"
+
+// SplitCommitSignature splits a raw commit object as printed by
+// "git cat-file commit" into the signed payload and the signature. The
+// signature is empty for unsigned commits.
+func SplitCommitSignature(raw string) (string, string) {
+	headerEnd := strings.Index(raw, "\n\n")
+	if headerEnd < 0 {
+		return raw, ""
+	}
+
+	var payload, signature strings.Builder
+	inSignature := false
+
+	for _, line := range strings.SplitAfter(raw[:headerEnd+1], "\n") {
+		switch {
+		case strings.HasPrefix(line, "gpgsig "):
+			inSignature = true
+			signature.WriteString(strings.TrimPrefix(line, "gpgsig "))
+		case inSignature && strings.HasPrefix(line, " "):
+			// Continuation lines of a header start with a space.
+			signature.WriteString(strings.TrimPrefix(line, " "))
+		default:
+			inSignature = false
+			payload.WriteString(line)
+		}
+	}
+
+	payload.WriteString(raw[headerEnd+1:])
+
+	return payload.String(), signature.String()
+}
+
+// SplitTagSignature splits a raw annotated tag object as printed by
+// "git cat-file tag" into the signed payload and the signature, which is
+// appended to the tag message.
+func SplitTagSignature(raw string) (string, string) {
+	for _, start := range []string{gpgSignatureArmorStart, sshSignatureArmorStart} {
+		if i := strings.LastIndex(raw, "\n"+start); i >= 0 {
+			return raw[:i+1], raw[i+1:]
+		}
+	}
+
+	return raw, ""
+}
+
+// SignatureKind tells whether an armored signature is a GPG or an SSH one.
+func SignatureKind(signature string) string {
+	switch {
+	case strings.HasPrefix(signature, gpgSignatureArmorStart):
+		return SignatureGPG
+	case strings.HasPrefix(signature, sshSignatureArmorStart):
+		return SignatureSSH
+	}
+
+	return ""
+}
+
+type sshSignature struct {
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// ParseSSHSignature decodes an armored SSH signature, see PROTOCOL.sshsig of
+// OpenSSH. It returns the public key which made the signature, the
+// signature has to be checked with VerifySSHSignature.
+func ParseSSHSignature(armored string) (gossh.PublicKey, error) {
+	sig, err := decodeSSHSignature(armored)
+	if err != nil {
+		return nil, err
+	}
+
+	return gossh.ParsePublicKey(sig.PublicKey)
+}
+
+// VerifySSHSignature checks that the armored SSH signature was made over
+// message in the given namespace, "git" for commits and tags.
+func VerifySSHSignature(armored string, message []byte, namespace string) error {
+	sig, err := decodeSSHSignature(armored)
+	if err != nil {
+		return err
+	}
+
+	if sig.Namespace != namespace {
+		return fmt.Errorf("signature namespace is %q, expected %q", sig.Namespace, namespace)
+	}
+
+	pub, err := gossh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unsupported signature hash algorithm %q", sig.HashAlgorithm)
+	}
+	h.Write(message)
+
+	signedData := struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{sig.Namespace, sig.Reserved, sig.HashAlgorithm, h.Sum(nil)}
+
+	var s gossh.Signature
+	if err := gossh.Unmarshal(sig.Signature, &s); err != nil {
+		return err
+	}
+
+	return pub.Verify(append([]byte("SSHSIG"), gossh.Marshal(signedData)...), &s)
+}
+
+func decodeSSHSignature(armored string) (*sshSignature, error) {
+	armored = strings.TrimSpace(armored)
+	if !strings.HasPrefix(armored, sshSignatureArmorStart) || !strings.HasSuffix(armored, sshSignatureArmorEnd) {
+		return nil, errors.New("not an armored SSH signature")
+	}
+
+	body := strings.TrimSuffix(strings.TrimPrefix(armored, sshSignatureArmorStart), sshSignatureArmorEnd)
+	blob, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(blob) < 10 || string(blob[:6]) != "SSHSIG" {
+		return nil, errors.New("invalid SSH signature magic")
+	}
+
+	if version := uint32(blob[6])<<24 | uint32(blob[7])<<16 | uint32(blob[8])<<8 | uint32(blob[9]); version != 1 {
+		return nil, fmt.Errorf("unsupported SSH signature version %d", version)
+	}
+
+	var sig sshSignature
+	if err := gossh.Unmarshal(blob[10:], &sig); err != nil {
+		return nil, err
+	}
+
+	return &sig, nil
+}
+
+// GPGKeyring is a throwaway GnuPG home directory holding imported public
+// keys. It has to be closed to remove the directory.
+type GPGKeyring struct {
+	gpgPath string
+	homeDir string
+}
+
+// NewGPGKeyring creates an empty keyring. It fails if gpg isn't installed.
+func NewGPGKeyring() (*GPGKeyring, error) {
+	gpgPath, err := exec.LookPath("gpg")
+	if err != nil {
+		return nil, err
+	}
+
+	homeDir, err := ioutil.TempDir("", "sorcia-gpg-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &GPGKeyring{gpgPath: gpgPath, homeDir: homeDir}, nil
+}
+
+// Close removes the keyring.
+func (k *GPGKeyring) Close() {
+	os.RemoveAll(k.homeDir)
+}
+
+func (k *GPGKeyring) run(stdin []byte, args ...string) (string, error) {
+	args = append([]string{"--homedir", k.homeDir, "--batch", "--no-tty", "--status-fd=1"}, args...)
+	cmd := exec.Command(k.gpgPath, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+
+	return out.String(), err
+}
+
+// Import adds an armored public key to the keyring.
+func (k *GPGKeyring) Import(armoredKey string) error {
+	_, err := k.run([]byte(armoredKey), "--import")
+	return err
+}
+
+// GPGKeyFingerprint returns the fingerprint of the primary key of an armored
+// public key block without importing it anywhere. The block has to contain
+// exactly one public key.
+func GPGKeyFingerprint(armoredKey string) (string, error) {
+	if !strings.Contains(armoredKey, "-----BEGIN PGP PUBLIC KEY BLOCK-----") {
+		return "", errors.New("The key is not an armored GPG public key.")
+	}
+
+	keyring, err := NewGPGKeyring()
+	if err != nil {
+		return "", errors.New("GPG keys can't be added, gpg is not installed on the server.")
+	}
+	defer keyring.Close()
+
+	out, err := keyring.run([]byte(armoredKey), "--with-colons", "--import-options", "show-only", "--import")
+	if err != nil {
+		return "", errors.New("The key is not a valid GPG public key.")
+	}
+
+	var fingerprints []string
+	afterPub := false
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, ":")
+		switch fields[0] {
+		case "pub":
+			afterPub = true
+		case "fpr":
+			if afterPub && len(fields) > 9 {
+				fingerprints = append(fingerprints, fields[9])
+				afterPub = false
+			}
+		}
+	}
+
+	if len(fingerprints) != 1 {
+		return "", errors.New("Please add exactly one GPG public key at a time.")
+	}
+
+	return fingerprints[0], nil
+}
+
+// GPGVerifyResult is the outcome of GPGKeyring.Verify.
+type GPGVerifyResult struct {
+	// Good is true if the signature is valid.
+	Good bool
+	// KnownKey is false if the keyring doesn't have the signing key.
+	KnownKey bool
+	// PrimaryFingerprint is the fingerprint of the primary key the
+	// signing (sub)key belongs to, if the key is known.
+	PrimaryFingerprint string
+}
+
+// Verify checks a detached armored signature over payload.
+func (k *GPGKeyring) Verify(payload []byte, signature string) GPGVerifyResult {
+	var result GPGVerifyResult
+
+	sigFile, err := ioutil.TempFile(k.homeDir, "sig-")
+	if err != nil {
+		CheckError("Error on gpg verify temp file", err)
+		return result
+	}
+	sigFile.WriteString(signature)
+	sigFile.Close()
+
+	// gpg exits non-zero for bad and unknown signatures, the status
+	// lines tell them apart.
+	out, _ := k.run(payload, "--verify", sigFile.Name(), "-")
+
+	result.KnownKey = true
+	var valid, bad bool
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "[GNUPG:]" {
+			continue
+		}
+
+		switch fields[1] {
+		case "NO_PUBKEY":
+			result.KnownKey = false
+		case "VALIDSIG":
+			// VALIDSIG <fpr> <date> <ts> <expire> <version> <reserved>
+			// <pubkey-algo> <hash-algo> <class> <primary-fpr>
+			valid = true
+			result.PrimaryFingerprint = fields[len(fields)-1]
+		case "BADSIG", "EXPKEYSIG", "REVKEYSIG", "EXPSIG":
+			bad = true
+		}
+	}
+	result.Good = valid && !bad
+
+	return result
+}
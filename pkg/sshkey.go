@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// SSHKey is a public key in authorized_keys format which passed ParseSSHKey.
+type SSHKey struct {
+	PublicKey         gossh.PublicKey
+	AuthorizedKey     string
+	Fingerprint       string
+	FingerprintSHA256 string
+}
+
+// ParseSSHKey parses a single public key in authorized_keys format. DSA keys
+// and RSA keys smaller than minRSABits are rejected. The returned errors are
+// meant to be shown to the user.
+func ParseSSHKey(authKey string, minRSABits int) (*SSHKey, error) {
+	authKey = strings.TrimSpace(authKey)
+
+	pub, comment, _, rest, err := gossh.ParseAuthorizedKey([]byte(authKey))
+	if err != nil {
+		return nil, errors.New("The key is not a valid SSH public key.")
+	}
+
+	if len(strings.TrimSpace(string(rest))) > 0 {
+		return nil, errors.New("Only one key can be added at a time.")
+	}
+
+	switch pub.Type() {
+	case gossh.KeyAlgoDSA:
+		return nil, errors.New("DSA keys are not supported anymore, please use an ed25519, ECDSA or RSA key.")
+	case gossh.KeyAlgoRSA:
+		if cpk, ok := pub.(gossh.CryptoPublicKey); ok {
+			if rsaKey, ok := cpk.CryptoPublicKey().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < minRSABits {
+				return nil, fmt.Errorf("RSA keys must be at least %d bits, this key has %d bits.", minRSABits, rsaKey.N.BitLen())
+			}
+		}
+	}
+
+	// Store the key the way ssh tools print it, options and surrounding
+	// whitespace are dropped.
+	normalized := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(pub)))
+	if comment != "" {
+		normalized = normalized + " " + comment
+	}
+
+	return &SSHKey{
+		PublicKey:         pub,
+		AuthorizedKey:     normalized,
+		Fingerprint:       strings.TrimPrefix(gossh.FingerprintLegacyMD5(pub), "MD5:"),
+		FingerprintSHA256: gossh.FingerprintSHA256(pub),
+	}, nil
+}
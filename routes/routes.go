@@ -19,6 +19,8 @@ var decoder = schema.NewDecoder()
 func Router(m *mux.Router, db *sql.DB, conf *pkg.BaseStruct) *mux.Router {
 
 	m.Use(middleware.Middleware)
+	m.Use(middleware.CSRF)
+	m.Use(middleware.RepoContext)
 
 	// Web handlers
 	m.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -31,8 +33,26 @@ func Router(m *mux.Router, db *sql.DB, conf *pkg.BaseStruct) *mux.Router {
 		internal.PostLogin(w, r, db, conf, decoder)
 	}).Methods("POST")
 	m.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
-		internal.GetLogout(w, r)
+		internal.PostLogout(w, r)
+	}).Methods("POST")
+	m.HandleFunc("/invite/{token}", func(w http.ResponseWriter, r *http.Request) {
+		internal.GetInviteSignUp(w, r, db, conf)
+	}).Methods("GET")
+	m.HandleFunc("/invite/{token}", func(w http.ResponseWriter, r *http.Request) {
+		internal.PostInviteSignUp(w, r, db, conf, decoder)
+	}).Methods("POST")
+	m.HandleFunc("/reset-password/{token}", func(w http.ResponseWriter, r *http.Request) {
+		internal.GetResetPassword(w, r, db, conf)
 	}).Methods("GET")
+	m.HandleFunc("/reset-password/{token}", func(w http.ResponseWriter, r *http.Request) {
+		internal.PostResetPassword(w, r, db, conf, decoder)
+	}).Methods("POST")
+	m.HandleFunc("/ssh-host-keys", func(w http.ResponseWriter, r *http.Request) {
+		internal.GetHostKeys(w, r, db, conf)
+	}).Methods("GET")
+	m.HandleFunc("/ssh-host-keys/rotate", middleware.Admin(func(w http.ResponseWriter, r *http.Request) {
+		internal.PostRotateHostKeys(w, r, db, conf)
+	})).Methods("POST")
 	m.HandleFunc("/create-repo", func(w http.ResponseWriter, r *http.Request) {
 		internal.GetCreateRepo(w, r, db, conf)
 	}).Methods("GET")
@@ -45,30 +65,54 @@ func Router(m *mux.Router, db *sql.DB, conf *pkg.BaseStruct) *mux.Router {
 	m.HandleFunc("/settings/password", func(w http.ResponseWriter, r *http.Request) {
 		internal.SettingsPostPassword(w, r, db, decoder)
 	}).Methods("POST")
-	m.HandleFunc("/settings/site", func(w http.ResponseWriter, r *http.Request) {
+	m.HandleFunc("/settings/site", middleware.Admin(func(w http.ResponseWriter, r *http.Request) {
 		internal.SettingsPostSiteSettings(w, r, db, conf)
-	}).Methods("POST")
+	})).Methods("POST")
 	m.HandleFunc("/settings/keys", func(w http.ResponseWriter, r *http.Request) {
 		internal.GetSettingsKeys(w, r, db, conf)
 	}).Methods("GET")
 	m.HandleFunc("/settings/keys/delete/{keyID}", func(w http.ResponseWriter, r *http.Request) {
 		internal.DeleteSettingsKey(w, r, db)
-	}).Methods("GET")
+	}).Methods("POST")
 	m.HandleFunc("/settings/keys", func(w http.ResponseWriter, r *http.Request) {
 		internal.PostAuthKey(w, r, db, conf, decoder)
 	}).Methods("POST")
-	m.HandleFunc("/settings/users", func(w http.ResponseWriter, r *http.Request) {
+	m.HandleFunc("/settings/signing-keys", func(w http.ResponseWriter, r *http.Request) {
+		internal.PostSigningKey(w, r, db, conf, decoder)
+	}).Methods("POST")
+	m.HandleFunc("/settings/signing-keys/delete/{keyID}", func(w http.ResponseWriter, r *http.Request) {
+		internal.DeleteSigningKey(w, r, db)
+	}).Methods("POST")
+	m.HandleFunc("/settings/users", middleware.Admin(func(w http.ResponseWriter, r *http.Request) {
 		internal.GetSettingsUsers(w, r, db, conf)
-	}).Methods("GET")
-	m.HandleFunc("/settings/users", func(w http.ResponseWriter, r *http.Request) {
+	})).Methods("GET")
+	m.HandleFunc("/settings/users", middleware.Admin(func(w http.ResponseWriter, r *http.Request) {
 		internal.PostUser(w, r, db, conf, decoder)
-	}).Methods("POST")
-	m.HandleFunc("/settings/user/revoke-access/{username}", func(w http.ResponseWriter, r *http.Request) {
+	})).Methods("POST")
+	m.HandleFunc("/settings/usage", middleware.Admin(func(w http.ResponseWriter, r *http.Request) {
+		internal.GetSettingsUsage(w, r, db, conf)
+	})).Methods("GET")
+	m.HandleFunc("/settings/users/invite", middleware.Admin(func(w http.ResponseWriter, r *http.Request) {
+		internal.PostCreateInvite(w, r, db, conf, decoder)
+	})).Methods("POST")
+	m.HandleFunc("/settings/users/invite/delete/{inviteID}", middleware.Admin(func(w http.ResponseWriter, r *http.Request) {
+		internal.DeleteInvite(w, r, db)
+	})).Methods("POST")
+	m.HandleFunc("/settings/user/reset-password/{username}", middleware.Admin(func(w http.ResponseWriter, r *http.Request) {
+		internal.PostPasswordResetLink(w, r, db)
+	})).Methods("POST")
+	m.HandleFunc("/settings/user/promote/{username}", middleware.Admin(func(w http.ResponseWriter, r *http.Request) {
+		internal.PostPromoteAdmin(w, r, db)
+	})).Methods("POST")
+	m.HandleFunc("/settings/user/demote/{username}", middleware.Admin(func(w http.ResponseWriter, r *http.Request) {
+		internal.PostDemoteAdmin(w, r, db, conf)
+	})).Methods("POST")
+	m.HandleFunc("/settings/user/revoke-access/{username}", middleware.Admin(func(w http.ResponseWriter, r *http.Request) {
 		internal.RevokeCreateRepoAccess(w, r, db, conf)
-	}).Methods("GET")
-	m.HandleFunc("/settings/user/add-access/{username}", func(w http.ResponseWriter, r *http.Request) {
+	})).Methods("POST")
+	m.HandleFunc("/settings/user/add-access/{username}", middleware.Admin(func(w http.ResponseWriter, r *http.Request) {
 		internal.AddCreateRepoAccess(w, r, db, conf)
-	}).Methods("GET")
+	})).Methods("POST")
 	m.HandleFunc("/r/{reponame}", func(w http.ResponseWriter, r *http.Request) {
 		internal.GetRepo(w, r, db, conf)
 	}).Methods("GET")
@@ -83,7 +127,40 @@ func Router(m *mux.Router, db *sql.DB, conf *pkg.BaseStruct) *mux.Router {
 	}).Methods("POST")
 	m.HandleFunc("/r/{reponame}/settings/user/remove/{username}", func(w http.ResponseWriter, r *http.Request) {
 		internal.RemoveRepoSettingsUser(w, r, db, conf)
-	}).Methods("GET")
+	}).Methods("POST")
+	m.HandleFunc("/r/{reponame}/settings/deploy-keys", func(w http.ResponseWriter, r *http.Request) {
+		internal.PostDeployKey(w, r, db, conf, decoder)
+	}).Methods("POST")
+	m.HandleFunc("/r/{reponame}/settings/deploy-keys/delete/{keyID}", func(w http.ResponseWriter, r *http.Request) {
+		internal.DeleteDeployKey(w, r, db)
+	}).Methods("POST")
+	m.HandleFunc("/r/{reponame}/settings/protected-branches", func(w http.ResponseWriter, r *http.Request) {
+		internal.PostProtectedBranch(w, r, db, conf, decoder)
+	}).Methods("POST")
+	m.HandleFunc("/r/{reponame}/settings/protected-branches/delete/{ruleID}", func(w http.ResponseWriter, r *http.Request) {
+		internal.DeleteProtectedBranch(w, r, db)
+	}).Methods("POST")
+	m.HandleFunc("/r/{reponame}/settings/push-policy", func(w http.ResponseWriter, r *http.Request) {
+		internal.PostPushPolicy(w, r, db, conf, decoder)
+	}).Methods("POST")
+	m.HandleFunc("/r/{reponame}/settings/push-mirrors", func(w http.ResponseWriter, r *http.Request) {
+		internal.PostPushMirror(w, r, db, conf, decoder)
+	}).Methods("POST")
+	m.HandleFunc("/r/{reponame}/settings/push-mirrors/sync/{mirrorID}", func(w http.ResponseWriter, r *http.Request) {
+		internal.PostPushMirrorSync(w, r, db, conf)
+	}).Methods("POST")
+	m.HandleFunc("/r/{reponame}/settings/push-mirrors/delete/{mirrorID}", func(w http.ResponseWriter, r *http.Request) {
+		internal.DeletePushMirror(w, r, db)
+	}).Methods("POST")
+	m.HandleFunc("/r/{reponame}/settings/pull-mirror/sync", func(w http.ResponseWriter, r *http.Request) {
+		internal.PostPullMirrorSync(w, r, db, conf)
+	}).Methods("POST")
+	m.HandleFunc("/r/{reponame}/settings/pull-mirror/delete", func(w http.ResponseWriter, r *http.Request) {
+		internal.DeletePullMirror(w, r, db)
+	}).Methods("POST")
+	m.HandleFunc("/r/{reponame}/settings/hooks", middleware.Admin(func(w http.ResponseWriter, r *http.Request) {
+		internal.PostCustomHooks(w, r, db, conf, decoder)
+	})).Methods("POST")
 	m.HandleFunc("/r/{reponame}/settings/delete", func(w http.ResponseWriter, r *http.Request) {
 		internal.PostRepoSettingsDelete(w, r, db, conf)
 	}).Methods("POST")
@@ -106,11 +183,11 @@ func Router(m *mux.Router, db *sql.DB, conf *pkg.BaseStruct) *mux.Router {
 		internal.GetRepoContributors(w, r, db, conf)
 	}).Methods("GET")
 	m.HandleFunc("/dl/{file}", func(w http.ResponseWriter, r *http.Request) {
-		internal.ServeReleasesFile(w, r, conf)
+		internal.ServeReleasesFile(w, r, db, conf)
 	}).Methods("GET")
 	m.PathPrefix("/r/{reponame[\\d\\w-_\\.]+\\.git$}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		internal.GitviaHTTP(w, r, db, conf)
-	}).Methods("GET", "POST")
+	}).Methods("GET", "POST", "PUT").Name("git-http")
 
 	staticDir, err := filepath.Abs(filepath.Join(conf.Paths.ProjectRoot, "public"))
 	pkg.CheckError("static absolute path failed", err)
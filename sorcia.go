@@ -10,7 +10,7 @@ import (
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Expected 'web' / 'usermod' / 'version' subcommands.")
+		fmt.Println("Expected 'web' / 'usermod' / 'secretscan' / 'version' subcommands.")
 		os.Exit(1)
 	}
 
@@ -22,10 +22,14 @@ func main() {
 		cmd.RunWeb(conf)
 	case "usermod":
 		cmd.UserMod(conf)
+	case "hook":
+		cmd.RunHook(conf)
+	case "secretscan":
+		cmd.SecretScan(conf)
 	case "version":
 		fmt.Println(conf.Version)
 	default:
-		fmt.Println("Expected 'web' / 'usermod' / 'version' subcommands.")
+		fmt.Println("Expected 'web' / 'usermod' / 'secretscan' / 'version' subcommands.")
 		os.Exit(1)
 	}
 }